@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+	"github.com/assaidy/caching-proxy/pkg/proxy"
+)
+
+// runCache is the cache subcommand, which works on the on-disk store of
+// -cache-dir without going through a running proxy:
+//
+//	caching-proxy cache ls -cache-dir /var/cache/proxy
+//	caching-proxy cache show -cache-dir /var/cache/proxy -body 'GET-/products'
+//	caching-proxy cache export -cache-dir /var/cache/proxy -o cache.tar.zst
+//	caching-proxy cache import -cache-dir /var/cache/proxy -i cache.tar.zst
+//	caching-proxy cache check -cache-dir /var/cache/proxy
+//
+// It takes the proxy's flags and -config, for the cache dir and key. Hit
+// counts are as of the proxy's last cleanup or shutdown. Import writes to the store, so
+// the proxy using it must be stopped. Check verifies every body and reports
+// what a proxy starting on the dir would drop, failing when it would.
+func runCache(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: caching-proxy cache ls|show|export|import|check [flags] [key]")
+		return 2
+	}
+	sub, args := args[0], args[1:]
+
+	var cfg proxy.Config
+	fs := flag.NewFlagSet("cache "+sub, flag.ExitOnError)
+	body := fs.Bool("body", false, "show: print the body after the headers")
+	output := fs.String("o", "-", "export: archive to write, compressed as its .zst or .gz suffix says")
+	input := fs.String("i", "-", "import: archive to read")
+	if err := proxy.ParseConfig(fs, &cfg, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cfg.CacheDir == "" {
+		fmt.Fprintln(os.Stderr, "-cache-dir is required")
+		return 1
+	}
+	key, err := cache.LoadKey(cfg.CacheKeyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	verify := cache.VerifyOnRead
+	if sub == "check" {
+		verify = cache.VerifyOnStartup
+	}
+	store, err := cache.OpenDiskStore(cfg.CacheDir, time.Duration(cfg.CacheTTL), 0, cache.DiskOptions{
+		Verify:   verify,
+		Key:      key,
+		ReadOnly: sub != "import",
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch sub {
+	case "ls":
+		listEntries(store)
+	case "show":
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: caching-proxy cache show [flags] key")
+			return 2
+		}
+		return showEntry(store, fs.Arg(0), *body)
+	case "export":
+		err = exportCache(store, *output)
+	case "import":
+		err = importCache(store, *input)
+	case "check":
+		return checkStore(store)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown cache command %q, want ls, show, export, import or check\n", sub)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func listEntries(s *cache.DiskStore) {
+	metas := s.Entries()
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Key < metas[j].Key })
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSTATUS\tSIZE\tAGE\tTTL\tHITS")
+	for _, m := range metas {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%d\n",
+			m.Key, m.StatusCode, m.Size, now.Sub(m.StoredAt).Round(time.Second), ttlLeft(m.ExpiresAt, now), m.Hits)
+	}
+	tw.Flush()
+}
+
+func checkStore(s *cache.DiskStore) int {
+	st := s.LoadStats()
+	fmt.Printf("Entries: %d\nBytes: %d\nCorrupt: %d\nOrphan blobs: %d\nTemp files: %d\nTook: %s\n",
+		st.Entries, st.Bytes, st.Corrupt, st.OrphanBlobs, st.TempFiles, st.Took.Round(time.Millisecond))
+	if st.Corrupt > 0 {
+		return 1
+	}
+	return 0
+}
+
+// ttlLeft formats how long until expires, or "expired".
+func ttlLeft(expires, now time.Time) string {
+	if !now.Before(expires) {
+		return "expired"
+	}
+	return expires.Sub(now).Round(time.Second).String()
+}
+
+func showEntry(s *cache.DiskStore, key string, withBody bool) int {
+	meta, ok := s.Meta(key)
+	entry, err := s.Peek(key)
+	if !ok || err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	now := time.Now()
+	fmt.Printf("Key: %s\nStatus: %d\nSize: %d\nStored: %s (%s ago)\nExpires: %s (%s)\nHits: %d\n\n",
+		meta.Key, meta.StatusCode, meta.Size,
+		meta.StoredAt.Format(time.RFC3339), now.Sub(meta.StoredAt).Round(time.Second),
+		meta.ExpiresAt.Format(time.RFC3339), ttlLeft(meta.ExpiresAt, now), meta.Hits)
+	names := make([]string, 0, len(entry.Headers))
+	for name := range entry.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range entry.Headers[name] {
+			fmt.Printf("%s: %s\n", name, v)
+		}
+	}
+	if withBody {
+		fmt.Println()
+		os.Stdout.Write(entry.Body)
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+	"github.com/klauspost/compress/zstd"
+)
+
+// exportCache writes the export of s to the file name, - for stdout,
+// compressed with zstd or gzip when its suffix is .zst or .gz.
+func exportCache(s *cache.DiskStore, name string) (err error) {
+	var out io.WriteCloser = os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return fmt.Errorf("couldn't create export. error: %v", err)
+		}
+		out = f
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("couldn't write export. error: %v", cerr)
+		}
+	}()
+
+	var zw io.WriteCloser = nopWriteCloser{out}
+	switch {
+	case strings.HasSuffix(name, ".zst") || strings.HasSuffix(name, ".zstd"):
+		if zw, err = zstd.NewWriter(out); err != nil {
+			return err
+		}
+	case strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"):
+		zw = gzip.NewWriter(out)
+	}
+	defer func() {
+		if cerr := zw.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("couldn't write export. error: %v", cerr)
+		}
+	}()
+
+	n, err := s.Export(zw)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d entries\n", n)
+	return nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// importCache imports the export in the file name, - for stdin, into s.
+// Its compression is told from its first bytes.
+func importCache(s *cache.DiskStore, name string) error {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("couldn't open export. error: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(4)
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("couldn't read export. error: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("couldn't read export. error: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	imported, expired, err := s.Import(r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d entries, %d had expired\n", imported, expired)
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/assaidy/caching-proxy/pkg/proxy"
+)
+
+func runDoctor(args []string) int {
+	var cfg proxy.Config
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	if err := proxy.ParseConfig(fs, &cfg, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failed := false
+	for _, res := range proxy.RunChecks(&cfg) {
+		fmt.Printf("[%4s] %s\n", res.Status, res)
+		if res.Status == proxy.CheckFail {
+			failed = true
+		}
+	}
+	if failed {
+		fmt.Fprintln(os.Stderr, "some checks failed, fix them before starting the server")
+		return 1
+	}
+	return 0
+}
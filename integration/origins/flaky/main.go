@@ -0,0 +1,61 @@
+//go:build integration
+
+// Command flaky is an origin whose health can be flipped at runtime, for
+// testing how the proxy behaves when its origin goes down:
+//
+//	POST /_control/fail     every request after this fails with a 500
+//	POST /_control/drop     every request after this has its connection dropped
+//	POST /_control/recover  back to answering normally
+//
+// Healthy responses echo the request and a counter, so tests can tell
+// whether the origin was hit. With ?set-cookie they set a session cookie
+// too.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	modeHealthy int32 = iota
+	modeFail
+	modeDrop
+)
+
+func main() {
+	addr := flag.String("addr", ":80", "address to listen on")
+	flag.Parse()
+
+	var mode atomic.Int32
+	var served atomic.Int64
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /_control/fail", func(w http.ResponseWriter, r *http.Request) { mode.Store(modeFail) })
+	mux.HandleFunc("POST /_control/drop", func(w http.ResponseWriter, r *http.Request) { mode.Store(modeDrop) })
+	mux.HandleFunc("POST /_control/recover", func(w http.ResponseWriter, r *http.Request) { mode.Store(modeHealthy) })
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch mode.Load() {
+		case modeFail:
+			http.Error(w, "flaky origin is failing", http.StatusInternalServerError)
+		case modeDrop:
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		default:
+			n := served.Add(1)
+			w.Header().Set("X-Origin-Count", fmt.Sprint(n))
+			if r.URL.Query().Has("set-cookie") {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(n)})
+			}
+			fmt.Fprintf(w, "%s %s #%d\n", r.Method, r.URL.RequestURI(), n)
+		}
+	})
+
+	log.Printf("flaky origin listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
@@ -0,0 +1,35 @@
+//go:build integration
+
+// Command slow is an origin that takes its time: every response is delayed
+// by -delay, or by the ?delay= query parameter when given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":80", "address to listen on")
+	delay := flag.Duration("delay", 5*time.Second, "how long to wait before answering")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		d := *delay
+		if v, err := time.ParseDuration(r.URL.Query().Get("delay")); err == nil {
+			d = v
+		}
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprintf(w, "%s %s after %s\n", r.Method, r.URL.RequestURI(), d)
+	})
+
+	log.Printf("slow origin listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
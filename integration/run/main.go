@@ -0,0 +1,365 @@
+//go:build integration
+
+// Command run drives end-to-end scenarios against the stack described in
+// integration/docker-compose.yml:
+//
+//	go run -tags integration ./integration/run
+//
+// It brings the stack up, runs every scenario and tears the stack down
+// again unless -keep is given. With -no-compose it runs against a stack
+// that is already up. It exits non-zero when a scenario fails.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type stack struct {
+	proxyNginx   string
+	proxyFlaky   string
+	proxySlow    string
+	proxyBreaker string
+	flaky        string
+}
+
+type scenario struct {
+	name string
+	run  func(s *stack) error
+}
+
+var scenarios = []scenario{
+	{"hit after miss", hitAfterMiss},
+	{"purge propagation", purgePropagation},
+	{"stale serving while origin is down", staleServing},
+	{"dropped origin connection is a 502", droppedConnection},
+	{"slow origin times out with a 504", slowOrigin},
+	{"breaker opens on a failing origin", breakerOpens},
+	{"responses setting cookies aren't cached", setCookieNotCached},
+	{"cache_set_cookie caches without the cookie", setCookieCachedWithout},
+}
+
+func main() {
+	noCompose := flag.Bool("no-compose", false, "don't start or stop the docker compose stack")
+	keep := flag.Bool("keep", false, "leave the stack running afterwards")
+	only := flag.String("run", "", "only run scenarios whose name contains this")
+	flag.Parse()
+
+	s := &stack{
+		proxyNginx:   "http://localhost:9201",
+		proxyFlaky:   "http://localhost:9202",
+		proxySlow:    "http://localhost:9203",
+		proxyBreaker: "http://localhost:9204",
+		flaky:        "http://localhost:9101",
+	}
+
+	if !*noCompose {
+		if err := compose("up", "-d", "--build"); err != nil {
+			log.Fatalf("couldn't start the stack: %v", err)
+		}
+		if !*keep {
+			defer compose("down")
+		}
+	}
+	for _, u := range []string{s.proxyNginx, s.proxyFlaky, s.proxySlow, s.proxyBreaker, s.flaky} {
+		if err := waitReady(u, time.Minute); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	failed := 0
+	for _, sc := range scenarios {
+		if !strings.Contains(sc.name, *only) {
+			continue
+		}
+		start := time.Now()
+		if err := sc.run(s); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s (%s): %v\n", sc.name, time.Since(start).Round(time.Millisecond), err)
+			continue
+		}
+		fmt.Printf("PASS  %s (%s)\n", sc.name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed > 0 {
+		compose("logs")
+		fmt.Printf("%d scenarios failed\n", failed)
+		os.Exit(1)
+	}
+}
+
+func compose(args ...string) error {
+	_, file, _, _ := runtime.Caller(0)
+	composeFile := filepath.Join(filepath.Dir(file), "..", "docker-compose.yml")
+	cmd := exec.Command("docker", append([]string{"compose", "-f", composeFile}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func waitReady(url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("%s not ready after %s", url, timeout)
+}
+
+type result struct {
+	status int
+	cache  string
+	body   string
+	header http.Header
+}
+
+func do(method, url string, body io.Reader) (*result, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &result{status: resp.StatusCode, cache: resp.Header.Get("X-Cache"), body: string(b), header: resp.Header}, nil
+}
+
+func get(url string) (*result, error) {
+	return do(http.MethodGet, url, nil)
+}
+
+func expect(res *result, status int, cache string) error {
+	if res.status != status || res.cache != cache {
+		return fmt.Errorf("got %d %q, want %d %q", res.status, res.cache, status, cache)
+	}
+	return nil
+}
+
+// expectError checks res failed with status, and X-Cache-Error saying why.
+func expectError(res *result, status int, kind string) error {
+	if got := res.header.Get("X-Cache-Error"); res.status != status || got != kind {
+		return fmt.Errorf("got %d %q, want %d %q", res.status, got, status, kind)
+	}
+	return nil
+}
+
+// uniquePath keeps scenarios from seeing each other's cache entries.
+func uniquePath(name string) string {
+	return fmt.Sprintf("/%s-%d", name, time.Now().UnixNano())
+}
+
+func hitAfterMiss(s *stack) error {
+	first, err := get(s.proxyNginx + "/hello.json")
+	if err != nil {
+		return err
+	}
+	if first.status != http.StatusOK {
+		return fmt.Errorf("got %d from nginx", first.status)
+	}
+	second, err := get(s.proxyNginx + "/hello.json")
+	if err != nil {
+		return err
+	}
+	if err := expect(second, http.StatusOK, "HIT"); err != nil {
+		return err
+	}
+	if second.body != first.body {
+		return fmt.Errorf("cached body differs from the origin's")
+	}
+	return nil
+}
+
+func purgePropagation(s *stack) error {
+	path := uniquePath("purge")
+	for _, want := range []string{"MISS", "HIT"} {
+		res, err := get(s.proxyFlaky + path)
+		if err != nil {
+			return err
+		}
+		if err := expect(res, http.StatusOK, want); err != nil {
+			return err
+		}
+	}
+
+	res, err := do("PURGE", s.proxyFlaky+path, nil)
+	if err != nil {
+		return err
+	}
+	if res.status != http.StatusOK || !strings.Contains(res.body, `"purged":1`) {
+		return fmt.Errorf("purge answered %d %s", res.status, res.body)
+	}
+
+	res, err = get(s.proxyFlaky + path)
+	if err != nil {
+		return err
+	}
+	return expect(res, http.StatusOK, "MISS")
+}
+
+func staleServing(s *stack) error {
+	defer do(http.MethodPost, s.flaky+"/_control/recover", nil)
+
+	path := uniquePath("stale")
+	fresh, err := get(s.proxyFlaky + path)
+	if err != nil {
+		return err
+	}
+	if err := expect(fresh, http.StatusOK, "MISS"); err != nil {
+		return err
+	}
+
+	if _, err := do(http.MethodPost, s.flaky+"/_control/fail", nil); err != nil {
+		return err
+	}
+	// Fail requests for other paths until the entry has outlived its 2s ttl
+	// and the proxy has degraded to serving stale; asking for path itself
+	// before then would replace the cached entry with the origin's error.
+	cachedAt := time.Now()
+	deadline := cachedAt.Add(15 * time.Second)
+	for time.Since(cachedAt) < 3*time.Second || !degraded(s.proxyFlaky) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("proxy never degraded")
+		}
+		if _, err := get(s.proxyFlaky + uniquePath("fail")); err != nil {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	res, err := get(s.proxyFlaky + path)
+	if err != nil {
+		return err
+	}
+	if err := expect(res, http.StatusOK, "STALE"); err != nil {
+		return err
+	}
+	if res.body != fresh.body {
+		return fmt.Errorf("stale body differs from the cached one")
+	}
+	return nil
+}
+
+func degraded(proxy string) bool {
+	res, err := get(proxy + "/_cache/stats")
+	if err != nil {
+		return false
+	}
+	var stats struct {
+		Level int `json:"degradation_level"`
+	}
+	return json.Unmarshal([]byte(res.body), &stats) == nil && stats.Level > 0
+}
+
+func droppedConnection(s *stack) error {
+	defer do(http.MethodPost, s.flaky+"/_control/recover", nil)
+
+	if _, err := do(http.MethodPost, s.flaky+"/_control/drop", nil); err != nil {
+		return err
+	}
+	res, err := get(s.proxyFlaky + uniquePath("drop"))
+	if err != nil {
+		return err
+	}
+	return expectError(res, http.StatusBadGateway, "bad_gateway")
+}
+
+func slowOrigin(s *stack) error {
+	start := time.Now()
+	res, err := get(s.proxySlow + uniquePath("slow"))
+	if err != nil {
+		return err
+	}
+	if err := expectError(res, http.StatusGatewayTimeout, "timeout"); err != nil {
+		return err
+	}
+	// the proxy gives up after 2s, the origin answers after 5s
+	if took := time.Since(start); took > 4*time.Second {
+		return fmt.Errorf("took %s to time out", took)
+	}
+	return nil
+}
+
+func breakerOpens(s *stack) error {
+	defer do(http.MethodPost, s.flaky+"/_control/recover", nil)
+
+	if _, err := do(http.MethodPost, s.flaky+"/_control/fail", nil); err != nil {
+		return err
+	}
+	// the breaker needs 20 requests in its window before it judges
+	for range 20 {
+		if _, err := get(s.proxyBreaker + uniquePath("breaker")); err != nil {
+			return err
+		}
+	}
+	res, err := get(s.proxyBreaker + uniquePath("breaker"))
+	if err != nil {
+		return err
+	}
+	if res.header.Get("Retry-After") == "" {
+		return fmt.Errorf("got no Retry-After")
+	}
+	return expectError(res, http.StatusServiceUnavailable, "circuit_open")
+}
+
+func setCookieNotCached(s *stack) error {
+	path := uniquePath("cookie") + "?set-cookie"
+	var cookies []string
+	for range 2 {
+		res, err := get(s.proxyFlaky + path)
+		if err != nil {
+			return err
+		}
+		if err := expect(res, http.StatusOK, "MISS"); err != nil {
+			return err
+		}
+		cookies = append(cookies, res.header.Get("Set-Cookie"))
+	}
+	if cookies[0] == "" || cookies[0] == cookies[1] {
+		return fmt.Errorf("got cookies %q, want a fresh one per request", cookies)
+	}
+	return nil
+}
+
+func setCookieCachedWithout(s *stack) error {
+	path := uniquePath("cookie-cached") + "?set-cookie"
+	first, err := get(s.proxyFlaky + path)
+	if err != nil {
+		return err
+	}
+	if err := expect(first, http.StatusOK, "MISS"); err != nil {
+		return err
+	}
+	if first.header.Get("Set-Cookie") == "" {
+		return fmt.Errorf("the client the response was fetched for got no cookie")
+	}
+	second, err := get(s.proxyFlaky + path)
+	if err != nil {
+		return err
+	}
+	if err := expect(second, http.StatusOK, "HIT"); err != nil {
+		return err
+	}
+	if c := second.header.Get("Set-Cookie"); c != "" {
+		return fmt.Errorf("cached response replayed cookie %q", c)
+	}
+	return nil
+}
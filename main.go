@@ -1,115 +1,68 @@
+// Command caching-proxy runs the caching reverse proxy of package
+// github.com/assaidy/caching-proxy/pkg/proxy, along with the doctor, warm
+// and cache subcommands for operating it.
 package main
 
 import (
 	"context"
-	"fmt"
-	"io"
+	"flag"
 	"log"
-	"net/http"
-	"sync"
-	"time"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/assaidy/caches/cache"
+	"github.com/assaidy/caching-proxy/pkg/proxy"
 )
 
-type CacheEntry struct {
-	StatusCode int
-	Body       []byte
-	Headers    http.Header
-}
-
-type CachingProxyServer struct {
-	Port   string
-	Origin string
-	Cache  *cache.TTLCache[string, *CacheEntry]
-	mu     sync.RWMutex
-}
-
-func NewCachingProxyServer(port, origin string, cacheTTL time.Duration) (*CachingProxyServer, error) {
-	cache, err := cache.NewTTL[string, *CacheEntry](cacheTTL, false)
-	cache.ScheduleCleanup(context.Background(), cacheTTL)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't set a cache for the server. error: %v", err)
-	}
-	return &CachingProxyServer{
-		Port:   port,
-		Origin: origin,
-		Cache:  cache,
-	}, nil
-}
-
-func copyHeaders(dis, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dis.Add(k, v)
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		case "warm":
+			os.Exit(runWarm(os.Args[2:]))
+		case "cache":
+			os.Exit(runCache(os.Args[2:]))
 		}
 	}
-}
-
-func (cps *CachingProxyServer) handleRequests(w http.ResponseWriter, r *http.Request) {
-	key := fmt.Sprintf("%s-%s", r.Method, r.URL.Path)
 
-	cps.mu.RLock()
-	if val, ok := cps.Cache.Get(key); ok && r.Method == "GET" {
-		log.Println("HIT:  ", key)
-
-		w.Header().Set("X-Cache", "HIT")
-		w.WriteHeader(val.StatusCode)
-		copyHeaders(w.Header(), val.Headers)
-		w.Write(val.Body)
-		cps.mu.RUnlock()
-		return
+	var cfg proxy.Config
+	var watch bool
+	fs := flag.NewFlagSet("caching-proxy", flag.ExitOnError)
+	bindMainFlags(fs, &cfg, &watch)
+	if err := proxy.ParseConfig(fs, &cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
 	}
-	cps.mu.RUnlock()
-
-	log.Println("MISS: ", key)
-
-	w.Header().Set("X-Cache", "MISS")
-
-	upstreamReq, err := http.NewRequest(r.Method, cps.Origin+r.URL.Path, r.Body)
-	if err != nil {
-		http.Error(w, "error forwarding request", http.StatusInternalServerError)
-		return
+	cfg.LoadConfig = func() (proxy.Config, error) { return loadConfig(os.Args[1:]) }
+	if err := proxy.SetupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatal(err)
 	}
 
-	resp, err := http.DefaultClient.Do(upstreamReq)
-	if err != nil {
-		http.Error(w, "error forwarding request", http.StatusInternalServerError)
-		return
+	if !cfg.SkipChecks {
+		for _, res := range proxy.RunChecks(&cfg) {
+			if res.Status != proxy.CheckOK {
+				slog.Warn("self-check", "check", res.Name, "status", string(res.Status), "detail", res.Detail)
+			}
+		}
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		http.Error(w, "error forwarding request", http.StatusInternalServerError)
-		return
+		slog.Error("tracing disabled", "err", err)
 	}
 
-	w.WriteHeader(resp.StatusCode)
-	copyHeaders(w.Header(), resp.Header)
-	w.Write(body)
-
-	if r.Method == "GET" {
-		cps.mu.Lock()
-		cps.Cache.Put(key, &CacheEntry{
-			StatusCode: resp.StatusCode,
-			Body:       body,
-			Headers:    resp.Header.Clone(),
-		})
-		cps.mu.Unlock()
+	server, err := proxy.New(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
-	return
-}
-
-func (cps *CachingProxyServer) Run() error {
-	http.HandleFunc("/", cps.handleRequests)
-	return http.ListenAndServe(cps.Port, nil)
-}
-
-func main() {
-	server, err := NewCachingProxyServer(":8080", "http://dummyjson.com", 1*time.Hour)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go reloadConfig(ctx, server, os.Args[1:], cfg.ConfigFile, watch)
+	go upgradeOnSignal(ctx, server)
+	err = server.Run(ctx)
+	shutdownTracing(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("starting caching proxy server at port 8080...")
-	log.Fatal(server.Run())
 }
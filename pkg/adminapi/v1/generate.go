@@ -0,0 +1,5 @@
+// Package adminv1 is the caching proxy's versioned gRPC admin API,
+// generated from admin.proto.
+package adminv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
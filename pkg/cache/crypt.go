@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const KeyEnv = "CACHING_PROXY_CACHE_KEY"
+
+// LoadKey reads the at-rest encryption key from path, or from the
+// CACHING_PROXY_CACHE_KEY env var when path is empty. The key is 32 bytes,
+// hex or base64 encoded. A nil key means encryption is off.
+func LoadKey(path string) ([]byte, error) {
+	encoded := os.Getenv(KeyEnv)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read cache key file. error: %v", err)
+		}
+		encoded = string(data)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("cache key must be 32 bytes, hex or base64 encoded")
+	}
+	return key, nil
+}
+
+// sealer encrypts cache files with AES-256-GCM. Each file is bound to its
+// name through the additional data, so files can't be swapped around.
+type sealer struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// a separate key for naming files, derived so one secret is enough
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("caching-proxy file names"))
+	return &sealer{aead: aead, macKey: mac.Sum(nil)}, nil
+}
+
+func (s *sealer) seal(name string, plain []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return s.aead.Seal(nonce, nonce, plain, []byte(name))
+}
+
+// sealedSize is the size of plain bytes once sealed.
+func (s *sealer) sealedSize(plain int) int {
+	return s.aead.NonceSize() + plain + s.aead.Overhead()
+}
+
+func (s *sealer) open(name string, data []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return s.aead.Open(nil, data[:n], data[n:], []byte(name))
+}
+
+// hash names files by a keyed hash, so plain SHA-256 names don't reveal
+// which known bodies or URLs are in the cache.
+func (s *sealer) hash(data []byte) string {
+	mac := hmac.New(sha256.New, s.macKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
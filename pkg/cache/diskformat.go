@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// diskFormatVersion is the layout DiskStore reads and writes. Bump it when
+// the layout changes and add a migration from the previous version.
+const diskFormatVersion = 1
+
+const formatFile = "FORMAT"
+
+type diskFormat struct {
+	Version int `json:"version"`
+}
+
+// diskMigrations[n] upgrades a cache dir from version n to n+1 in place.
+var diskMigrations = map[int]func(dir string) error{}
+
+// prepareDiskFormat makes sure dir holds the current layout before the store
+// reads it. Older layouts are migrated. A version this binary doesn't know,
+// e.g. after a downgrade, is moved aside and the cache starts cold.
+func prepareDiskFormat(dir string) error {
+	version, err := readDiskFormat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// either a fresh dir or one written before the marker existed,
+		// which is version 1
+		return writeDiskFormat(dir, diskFormatVersion)
+	case err != nil:
+		slog.Warn("cache: unreadable format marker, starting with a cold cache", "file", formatFile, "err", err)
+		return setAside(dir, "unknown")
+	case version > diskFormatVersion || version < 1:
+		slog.Warn("cache: unknown format version, starting with a cold cache",
+			"dir", dir, "version", version, "supported", diskFormatVersion)
+		return setAside(dir, "v"+strconv.Itoa(version))
+	}
+
+	for ; version < diskFormatVersion; version++ {
+		migrate, ok := diskMigrations[version]
+		if !ok {
+			slog.Warn("cache: no migration from format version, starting with a cold cache", "version", version)
+			return setAside(dir, "v"+strconv.Itoa(version))
+		}
+		slog.Info("cache: migrating format", "dir", dir, "from", version, "to", version+1)
+		if err := migrate(dir); err != nil {
+			return fmt.Errorf("couldn't migrate cache dir. error: %v", err)
+		}
+		if err := writeDiskFormat(dir, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDiskFormat(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, formatFile))
+	if err != nil {
+		return 0, err
+	}
+	var f diskFormat
+	if err := json.Unmarshal(data, &f); err != nil {
+		return 0, err
+	}
+	return f.Version, nil
+}
+
+func writeDiskFormat(dir string, version int) error {
+	data, _ := json.Marshal(diskFormat{Version: version})
+	if err := writeFileAtomic(filepath.Join(dir, formatFile), data); err != nil {
+		return fmt.Errorf("couldn't write cache format marker. error: %v", err)
+	}
+	return nil
+}
+
+// setAside moves everything in dir into a subdirectory so a newer binary's
+// data isn't destroyed, then marks dir as an empty current-version cache.
+func setAside(dir, label string) error {
+	aside := filepath.Join(dir, fmt.Sprintf("incompatible-%s-%d", label, time.Now().Unix()))
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("couldn't read cache dir. error: %v", err)
+	}
+	if err := os.Mkdir(aside, 0o755); err != nil {
+		return fmt.Errorf("couldn't set aside old cache. error: %v", err)
+	}
+	for _, f := range files {
+		if f.IsDir() && f.Name() != "entries" && f.Name() != "blobs" {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, f.Name()), filepath.Join(aside, f.Name())); err != nil {
+			return fmt.Errorf("couldn't set aside old cache. error: %v", err)
+		}
+	}
+	slog.Warn("cache: previous contents set aside, delete them once they're no longer needed", "dir", aside)
+	return writeDiskFormat(dir, diskFormatVersion)
+}
@@ -0,0 +1,552 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	VerifyOnRead    = "read"
+	VerifyOnStartup = "startup"
+)
+
+type diskMeta struct {
+	Key        string      `json:"key"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	BodyHash   string      `json:"body_hash"`
+	Size       int         `json:"size"`
+	StoredAt   time.Time   `json:"stored_at"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+	// Hits is written back now and then by Cleanup, for inspecting the
+	// store offline.
+	Hits int64 `json:"hits"`
+
+	flushedHits int64
+}
+
+// DiskStore persists entries under dir so the cache survives restarts.
+// Bodies are content addressed like in MemoryStore: blobs/<sha256> holds the
+// body and entries/<sha256 of key>.json its metadata. A blob whose content no
+// longer matches its name is corrupt; the entries pointing to it are dropped
+// and treated as misses.
+//
+// With an encryption key both files are sealed with AES-GCM and named by a
+// keyed hash instead.
+type DiskStore struct {
+	dir          string
+	ttl          time.Duration
+	maxStale     time.Duration
+	verifyOnRead bool
+	readOnly     bool
+	sealer       *sealer
+	index        map[string]*diskMeta
+	refs         map[string]int
+	sizes        map[string]int
+	evictions    int64
+	loaded       LoadStats
+	mu           sync.Mutex
+}
+
+// LoadStats says what OpenDiskStore found in the cache dir. Corrupt
+// entries, whose metadata can't be read or whose body is missing, of the
+// wrong size or, when verified, of the wrong content, were dropped, and
+// with them the blobs nothing points to and the temporary files a crash
+// left behind. A read only store counts them but leaves them be.
+type LoadStats struct {
+	Entries     int           `json:"entries"`
+	Bytes       int64         `json:"bytes"`
+	Corrupt     int           `json:"corrupt"`
+	OrphanBlobs int           `json:"orphan_blobs"`
+	TempFiles   int           `json:"temp_files"`
+	Took        time.Duration `json:"took"`
+}
+
+type DiskOptions struct {
+	// Verify is "read" or "startup". With "startup" every blob is checked
+	// once when the store is opened instead of on each read.
+	Verify string
+	// Key enables encryption at rest when set, see LoadKey.
+	Key []byte
+	// ReadOnly opens the store for inspection, e.g. while a proxy is using
+	// it, or for serving a fixed set of entries: nothing is created,
+	// migrated, cleaned up, stored, expired or deleted.
+	ReadOnly bool
+}
+
+// OpenDiskStore opens or creates a store in dir and loads its index. Entries
+// that can't be read back, e.g. because they were written with another key
+// or partly before a crash, are dropped, see LoadStats.
+func OpenDiskStore(dir string, ttl, maxStale time.Duration, opts DiskOptions) (*DiskStore, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be greater than zero")
+	}
+	if opts.Verify != VerifyOnRead && opts.Verify != VerifyOnStartup {
+		return nil, fmt.Errorf("unknown integrity check mode %q", opts.Verify)
+	}
+	if opts.ReadOnly {
+		if version, err := readDiskFormat(dir); err != nil || version != diskFormatVersion {
+			return nil, fmt.Errorf("%s isn't a cache dir of format version %d", dir, diskFormatVersion)
+		}
+	} else if err := createDiskStore(dir); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{
+		dir:          dir,
+		ttl:          ttl,
+		maxStale:     maxStale,
+		verifyOnRead: opts.Verify == VerifyOnRead,
+		readOnly:     opts.ReadOnly,
+		index:        make(map[string]*diskMeta),
+		refs:         make(map[string]int),
+		sizes:        make(map[string]int),
+	}
+	if opts.Key != nil {
+		sealer, err := newSealer(opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't set up cache encryption. error: %v", err)
+		}
+		s.sealer = sealer
+	}
+	if err := s.load(opts.Verify == VerifyOnStartup); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createDiskStore lays out dir for a store, migrating an older layout.
+func createDiskStore(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("couldn't create cache dir. error: %v", err)
+	}
+	if err := prepareDiskFormat(dir); err != nil {
+		return err
+	}
+	for _, sub := range []string{"entries", "blobs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return fmt.Errorf("couldn't create cache dir. error: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *DiskStore) hash(data []byte) string {
+	if s.sealer != nil {
+		return s.sealer.hash(data)
+	}
+	return HashBody(data)
+}
+
+func (s *DiskStore) entryPath(key string) string {
+	return filepath.Join(s.dir, "entries", s.hash([]byte(key))+".json")
+}
+
+// readFile reads and, with encryption on, decrypts a cache file.
+func (s *DiskStore) readFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || s.sealer == nil {
+		return data, err
+	}
+	return s.sealer.open(filepath.Base(path), data)
+}
+
+func (s *DiskStore) writeFile(path string, data []byte) error {
+	if s.sealer != nil {
+		data = s.sealer.seal(filepath.Base(path), data)
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (s *DiskStore) blobPath(hash string) string {
+	return filepath.Join(s.dir, "blobs", hash)
+}
+
+// LoadStats returns what opening the store found.
+func (s *DiskStore) LoadStats() LoadStats {
+	return s.loaded
+}
+
+func (s *DiskStore) load(verifyBlobs bool) error {
+	start := time.Now()
+	files, err := os.ReadDir(filepath.Join(s.dir, "entries"))
+	if err != nil {
+		return fmt.Errorf("couldn't read cache dir. error: %v", err)
+	}
+
+	st := &s.loaded
+	verified := make(map[string]bool)
+	for _, f := range files {
+		path := filepath.Join(s.dir, "entries", f.Name())
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			st.TempFiles++
+			if !s.readOnly {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		meta, err := s.readMeta(path)
+		if err == nil {
+			ok, seen := verified[meta.BodyHash]
+			if !seen {
+				ok = s.blobIntact(meta.BodyHash, meta.Size, verifyBlobs)
+				verified[meta.BodyHash] = ok
+			}
+			if !ok {
+				err = fmt.Errorf("body %s is missing or corrupt", meta.BodyHash)
+			}
+		}
+		if err != nil {
+			st.Corrupt++
+			if s.readOnly {
+				continue
+			}
+			slog.Warn("cache: dropping corrupt entry", "file", f.Name(), "err", err)
+			os.Remove(path)
+			continue
+		}
+		meta.flushedHits = meta.Hits
+		s.index[meta.Key] = meta
+		s.refs[meta.BodyHash]++
+		s.sizes[meta.BodyHash] = meta.Size
+	}
+	st.Entries = len(s.index)
+	for _, size := range s.sizes {
+		st.Bytes += int64(size)
+	}
+
+	// blobs left behind by a crash or by entries dropped above
+	blobs, err := os.ReadDir(filepath.Join(s.dir, "blobs"))
+	if err != nil {
+		return fmt.Errorf("couldn't read cache dir. error: %v", err)
+	}
+	for _, b := range blobs {
+		if strings.HasSuffix(b.Name(), ".tmp") {
+			st.TempFiles++
+		} else if s.refs[b.Name()] == 0 {
+			st.OrphanBlobs++
+		} else {
+			continue
+		}
+		if !s.readOnly {
+			os.Remove(filepath.Join(s.dir, "blobs", b.Name()))
+		}
+	}
+	st.Took = time.Since(start)
+
+	if !s.readOnly {
+		slog.Info("cache: loaded", "dir", s.dir, "entries", st.Entries, "bytes", st.Bytes, "corrupt", st.Corrupt,
+			"orphan_blobs", st.OrphanBlobs, "temp_files", st.TempFiles, "verified", verifyBlobs, "took", st.Took)
+	}
+	return nil
+}
+
+func (s *DiskStore) readMeta(path string) (*diskMeta, error) {
+	data, err := s.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Key == "" || meta.BodyHash == "" {
+		return nil, fmt.Errorf("incomplete metadata")
+	}
+	if meta.ExpiresAt.IsZero() {
+		// written before entries recorded their expiry
+		meta.ExpiresAt = meta.StoredAt.Add(s.ttl)
+	}
+	return &meta, nil
+}
+
+// blobIntact reports whether the blob named hash holds size bytes, and
+// with verify that its content matches its name.
+func (s *DiskStore) blobIntact(hash string, size int, verify bool) bool {
+	if !verify {
+		fi, err := os.Stat(s.blobPath(hash))
+		if s.sealer != nil {
+			size = s.sealer.sealedSize(size)
+		}
+		return err == nil && fi.Size() == int64(size)
+	}
+	data, err := s.readFile(s.blobPath(hash))
+	return err == nil && s.hash(data) == hash
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	return s.get(key, 0)
+}
+
+func (s *DiskStore) GetStale(key string) (*Entry, bool) {
+	return s.get(key, s.maxStale)
+}
+
+func (s *DiskStore) addHit(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if meta, ok := s.index[key]; ok {
+		meta.Hits++
+	}
+}
+
+// Peek returns the entry for key, expired or not, without counting a hit.
+// It's for inspecting the store.
+func (s *DiskStore) Peek(key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.index[key]
+	if !ok {
+		return nil, fmt.Errorf("no entry for key %q", key)
+	}
+	body, err := s.readFile(s.blobPath(meta.BodyHash))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read body. error: %v", err)
+	}
+	return &Entry{
+		StatusCode: meta.StatusCode,
+		Body:       body,
+		Headers:    meta.Headers,
+		StoredAt:   meta.StoredAt,
+		ExpiresAt:  meta.ExpiresAt,
+	}, nil
+}
+
+func (s *DiskStore) get(key string, grace time.Duration) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.index[key]
+	if !ok || !time.Now().Before(meta.ExpiresAt.Add(grace)) {
+		return nil, false
+	}
+
+	body, err := s.readFile(s.blobPath(meta.BodyHash))
+	if err == nil && s.verifyOnRead && s.hash(body) != meta.BodyHash {
+		err = fmt.Errorf("checksum mismatch")
+		if !s.readOnly {
+			os.Remove(s.blobPath(meta.BodyHash))
+		}
+	}
+	if err != nil {
+		slog.Warn("cache: dropping corrupt entry", "key", key, "err", err)
+		if !s.readOnly {
+			s.release(key)
+		}
+		return nil, false
+	}
+
+	meta.Hits++
+	return &Entry{
+		StatusCode: meta.StatusCode,
+		Body:       body,
+		Headers:    meta.Headers,
+		StoredAt:   meta.StoredAt,
+		ExpiresAt:  meta.ExpiresAt,
+	}, true
+}
+
+func (s *DiskStore) Put(key string, entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if err := s.put(key, entry, now, now.Add(entry.TTLOr(s.ttl)), 0); err != nil {
+		slog.Error("cache: couldn't store entry", "key", key, "err", err)
+	}
+}
+
+// restore puts entry keeping the StoredAt and ExpiresAt it was exported
+// with.
+func (s *DiskStore) restore(key string, entry *Entry, hits int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(key, entry, entry.StoredAt, entry.ExpiresAt, hits)
+}
+
+func (s *DiskStore) put(key string, entry *Entry, storedAt, expiresAt time.Time, hits int64) error {
+	if s.readOnly {
+		return fmt.Errorf("store is read only")
+	}
+	hash := s.hash(entry.Body)
+	if _, err := os.Stat(s.blobPath(hash)); err != nil {
+		if err := s.writeFile(s.blobPath(hash), entry.Body); err != nil {
+			return err
+		}
+	}
+
+	meta := &diskMeta{
+		Key:         key,
+		StatusCode:  entry.StatusCode,
+		Headers:     entry.Headers,
+		BodyHash:    hash,
+		Size:        len(entry.Body),
+		StoredAt:    storedAt,
+		ExpiresAt:   expiresAt,
+		Hits:        hits,
+		flushedHits: hits,
+	}
+	if err := s.writeMeta(meta); err != nil {
+		return err
+	}
+
+	s.refs[hash]++
+	s.sizes[hash] = len(entry.Body)
+	if old, ok := s.index[key]; ok {
+		s.refs[old.BodyHash]--
+	}
+	s.index[key] = meta
+	return nil
+}
+
+func (s *DiskStore) writeMeta(meta *diskMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(s.entryPath(meta.Key), data)
+}
+
+func (s *DiskStore) Expire(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.index[key]
+	if !ok || s.readOnly {
+		return false
+	}
+	if now := time.Now(); meta.ExpiresAt.After(now) {
+		meta.ExpiresAt = now
+		if err := s.writeMeta(meta); err != nil {
+			slog.Error("cache: couldn't expire entry", "key", key, "err", err)
+		}
+	}
+	return true
+}
+
+func (s *DiskStore) Delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.readOnly && s.release(key)
+}
+
+// release removes key's metadata and drops its reference to the body. The
+// blob is left for the next Cleanup to collect. s.mu must be held.
+func (s *DiskStore) release(key string) bool {
+	meta, ok := s.index[key]
+	if !ok {
+		return false
+	}
+	os.Remove(s.entryPath(key))
+	s.refs[meta.BodyHash]--
+	delete(s.index, key)
+	return true
+}
+
+func (s *DiskStore) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index)
+}
+
+func (s *DiskStore) entryMeta(meta *diskMeta) EntryMeta {
+	return EntryMeta{
+		Key:        meta.Key,
+		StatusCode: meta.StatusCode,
+		ETag:       meta.Headers.Get("ETag"),
+		StoredAt:   meta.StoredAt,
+		ExpiresAt:  meta.ExpiresAt,
+		Size:       meta.Size,
+		Hits:       meta.Hits,
+		Tags:       ResponseTags(meta.Headers),
+	}
+}
+
+func (s *DiskStore) Meta(key string) (EntryMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.index[key]
+	if !ok {
+		return EntryMeta{}, false
+	}
+	return s.entryMeta(meta), true
+}
+
+func (s *DiskStore) Entries() []EntryMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metas := make([]EntryMeta, 0, len(s.index))
+	for _, meta := range s.index {
+		metas = append(metas, s.entryMeta(meta))
+	}
+	return metas
+}
+
+func (s *DiskStore) Stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := StoreStats{Entries: len(s.index), Evictions: s.evictions}
+	for _, size := range s.sizes {
+		st.Bytes += int64(size)
+	}
+	return st
+}
+
+func (s *DiskStore) Cleanup() {
+	if s.readOnly {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, meta := range s.index {
+		if !time.Now().Before(meta.ExpiresAt.Add(s.maxStale)) {
+			s.release(k)
+			s.evictions++
+			continue
+		}
+		if meta.Hits != meta.flushedHits && s.writeMeta(meta) == nil {
+			meta.flushedHits = meta.Hits
+		}
+	}
+	for h, n := range s.refs {
+		if n <= 0 {
+			os.Remove(s.blobPath(h))
+			delete(s.refs, h)
+			delete(s.sizes, h)
+		}
+	}
+}
+
+// writeFileAtomic writes data next to path and renames it into place, so a
+// crash never leaves a partially written file under the final name.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
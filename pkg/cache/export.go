@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An export is a tar of manifest.json followed by <n>.json, the metadata of
+// entry n, and <n>.body, its body, for every entry. Bodies are written
+// decrypted so the archive can be imported under another key.
+
+const exportVersion = 1
+
+type exportManifest struct {
+	Version int `json:"version"`
+	Entries int `json:"entries"`
+}
+
+type exportMeta struct {
+	Key        string      `json:"key"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	StoredAt   time.Time   `json:"stored_at"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+	Hits       int64       `json:"hits"`
+}
+
+// Export writes every entry of s to w as a tar and returns how many there
+// were.
+func (s *DiskStore) Export(w io.Writer) (int, error) {
+	s.mu.Lock()
+	metas := make([]*diskMeta, 0, len(s.index))
+	for _, meta := range s.index {
+		metas = append(metas, meta)
+	}
+	s.mu.Unlock()
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Key < metas[j].Key })
+
+	return writeExport(w, len(metas), func(i int) (exportMeta, []byte, error) {
+		meta := metas[i]
+		body, err := s.readFile(s.blobPath(meta.BodyHash))
+		if err != nil {
+			return exportMeta{}, nil, fmt.Errorf("couldn't read body of %s. error: %v", meta.Key, err)
+		}
+		return exportMeta{
+			Key:        meta.Key,
+			StatusCode: meta.StatusCode,
+			Headers:    meta.Headers,
+			StoredAt:   meta.StoredAt,
+			ExpiresAt:  meta.ExpiresAt,
+			Hits:       meta.Hits,
+		}, body, nil
+	})
+}
+
+// Import puts every entry of the export read from r into s, keeping their
+// creation and expiry times. Entries already expired are skipped.
+func (s *DiskStore) Import(r io.Reader) (imported, expired int, err error) {
+	return readExport(r, s.restore)
+}
+
+// Export writes every entry of s to w, in the format of DiskStore.Export,
+// and returns how many there were.
+func (s *MemoryStore) Export(w io.Writer) (int, error) {
+	type item struct {
+		meta exportMeta
+		body []byte
+	}
+	s.mu.Lock()
+	items := make([]item, 0, len(s.entries))
+	for key, e := range s.entries {
+		items = append(items, item{exportMeta{
+			Key:        key,
+			StatusCode: e.statusCode,
+			Headers:    e.headers,
+			StoredAt:   e.storedAt,
+			ExpiresAt:  e.expiresAt,
+			Hits:       e.hits,
+		}, s.blobs[e.bodyHash].data})
+	}
+	s.mu.Unlock()
+
+	return writeExport(w, len(items), func(i int) (exportMeta, []byte, error) {
+		return items[i].meta, items[i].body, nil
+	})
+}
+
+// Import puts every entry of the export read from r into s, like
+// DiskStore.Import.
+func (s *MemoryStore) Import(r io.Reader) (imported, expired int, err error) {
+	return readExport(r, func(key string, entry *Entry, hits int64) error {
+		s.restore(key, entry, entry.StoredAt, entry.ExpiresAt, hits)
+		return nil
+	})
+}
+
+// writeExport writes an export of n entries, getting entry i from get.
+func writeExport(w io.Writer, n int, get func(i int) (exportMeta, []byte, error)) (int, error) {
+	tw := tar.NewWriter(w)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("couldn't write export. error: %v", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("couldn't write export. error: %v", err)
+		}
+		return nil
+	}
+	manifest, _ := json.Marshal(exportManifest{Version: exportVersion, Entries: n})
+	if err := add("manifest.json", manifest); err != nil {
+		return 0, err
+	}
+	for i := range n {
+		meta, body, err := get(i)
+		if err != nil {
+			return i, err
+		}
+		data, _ := json.Marshal(meta)
+		name := strconv.Itoa(i)
+		if err := add(name+".json", data); err != nil {
+			return i, err
+		}
+		if err := add(name+".body", body); err != nil {
+			return i, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return n, fmt.Errorf("couldn't write export. error: %v", err)
+	}
+	return n, nil
+}
+
+// readExport passes every entry of the export read from r that hasn't
+// expired to restore.
+func readExport(r io.Reader, restore func(key string, entry *Entry, hits int64) error) (imported, expired int, err error) {
+	tr := tar.NewReader(r)
+	next := func() (string, []byte, error) {
+		hdr, err := tr.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := io.ReadAll(tr)
+		return hdr.Name, data, err
+	}
+
+	name, data, err := next()
+	if err != nil || name != "manifest.json" {
+		return 0, 0, fmt.Errorf("not a cache export, manifest.json missing")
+	}
+	var manifest exportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Version != exportVersion {
+		return 0, 0, fmt.Errorf("unsupported cache export version %d", manifest.Version)
+	}
+
+	now := time.Now()
+	for {
+		metaName, data, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, expired, fmt.Errorf("couldn't read export. error: %v", err)
+		}
+		var meta exportMeta
+		if err := json.Unmarshal(data, &meta); err != nil || !strings.HasSuffix(metaName, ".json") {
+			return imported, expired, fmt.Errorf("couldn't read export entry %s", metaName)
+		}
+		bodyName, body, err := next()
+		if err != nil || bodyName != strings.TrimSuffix(metaName, ".json")+".body" {
+			return imported, expired, fmt.Errorf("couldn't read body of %s", meta.Key)
+		}
+		if !now.Before(meta.ExpiresAt) {
+			expired++
+			continue
+		}
+		entry := &Entry{
+			StatusCode: meta.StatusCode,
+			Body:       body,
+			Headers:    meta.Headers,
+			StoredAt:   meta.StoredAt,
+			ExpiresAt:  meta.ExpiresAt,
+		}
+		if err := restore(meta.Key, entry, meta.Hits); err != nil {
+			return imported, expired, fmt.Errorf("couldn't store %s. error: %v", meta.Key, err)
+		}
+		imported++
+	}
+	return imported, expired, nil
+}
@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/memcache"
+)
+
+// MemcachedStore keeps entries on a memcached fleet, spread over the
+// servers by consistent hashing, so the proxy itself holds no state. Each
+// entry is stored under the SHA-256 of its key and memcached drops it once
+// past its stale window. An unreachable server turns its share of the keys
+// into misses.
+//
+// memcached can't list its keys, so Meta, Entries and Stats only know of
+// what this instance has stored or read, and hits are counted per instance.
+type MemcachedStore struct {
+	client    *memcache.Client
+	ttl       time.Duration
+	maxStale  time.Duration
+	index     map[string]*EntryMeta
+	evictions int64
+	mu        sync.Mutex
+}
+
+func NewMemcachedStore(servers []string, ttl, maxStale time.Duration) (*MemcachedStore, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be greater than zero")
+	}
+	client, err := memcache.New(servers)
+	if err != nil {
+		return nil, err
+	}
+	return &MemcachedStore{
+		client:   client,
+		ttl:      ttl,
+		maxStale: maxStale,
+		index:    make(map[string]*EntryMeta),
+	}, nil
+}
+
+func (s *MemcachedStore) Get(key string) (*Entry, bool) {
+	return s.get(key, 0)
+}
+
+func (s *MemcachedStore) GetStale(key string) (*Entry, bool) {
+	return s.get(key, s.maxStale)
+}
+
+func (s *MemcachedStore) get(key string, grace time.Duration) (*Entry, bool) {
+	e, err := s.fetch(key)
+	if err != nil {
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			slog.Warn("cache: couldn't read entry", "key", key, "err", err)
+		}
+		return nil, false
+	}
+	if !time.Now().Before(e.ExpiresAt.Add(grace)) {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	meta, ok := s.index[key]
+	if !ok {
+		m := remoteMeta(e)
+		meta = &m
+		s.index[key] = meta
+	}
+	meta.Hits++
+	s.mu.Unlock()
+
+	return &Entry{
+		StatusCode: e.StatusCode,
+		Body:       e.Body,
+		Headers:    e.Headers,
+		StoredAt:   e.StoredAt,
+		ExpiresAt:  e.ExpiresAt,
+	}, true
+}
+
+func (s *MemcachedStore) fetch(key string) (*remoteEntry, error) {
+	data, err := s.client.Get(HashBody([]byte(key)))
+	if err != nil {
+		return nil, err
+	}
+	var e remoteEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("couldn't decode entry. error: %v", err)
+	}
+	if e.Key != key {
+		return nil, memcache.ErrCacheMiss
+	}
+	return &e, nil
+}
+
+func (s *MemcachedStore) addHit(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if meta, ok := s.index[key]; ok {
+		meta.Hits++
+	}
+}
+
+func (s *MemcachedStore) Put(key string, entry *Entry) {
+	now := time.Now()
+	err := s.put(&remoteEntry{
+		Key:        key,
+		StatusCode: entry.StatusCode,
+		Headers:    entry.Headers,
+		Body:       entry.Body,
+		StoredAt:   now,
+		ExpiresAt:  now.Add(entry.TTLOr(s.ttl)),
+	})
+	if err != nil {
+		slog.Error("cache: couldn't store entry", "key", key, "err", err)
+	}
+}
+
+func (s *MemcachedStore) put(e *remoteEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Set(HashBody([]byte(e.Key)), data, e.ExpiresAt.Add(s.maxStale)); err != nil {
+		return err
+	}
+
+	meta := remoteMeta(e)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.index[e.Key]; ok {
+		meta.Hits = old.Hits
+	}
+	s.index[e.Key] = &meta
+	return nil
+}
+
+func (s *MemcachedStore) Expire(key string) bool {
+	e, err := s.fetch(key)
+	if err != nil {
+		return false
+	}
+	if now := time.Now(); e.ExpiresAt.After(now) {
+		e.ExpiresAt = now
+		if err := s.put(e); err != nil {
+			slog.Error("cache: couldn't expire entry", "key", key, "err", err)
+		}
+	}
+	return true
+}
+
+func (s *MemcachedStore) Delete(key string) bool {
+	s.mu.Lock()
+	delete(s.index, key)
+	s.mu.Unlock()
+
+	err := s.client.Delete(HashBody([]byte(key)))
+	if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		slog.Error("cache: couldn't delete entry", "key", key, "err", err)
+	}
+	return err == nil
+}
+
+func (s *MemcachedStore) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index)
+}
+
+func (s *MemcachedStore) Meta(key string) (EntryMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.index[key]
+	if !ok {
+		return EntryMeta{}, false
+	}
+	return *meta, true
+}
+
+func (s *MemcachedStore) Entries() []EntryMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metas := make([]EntryMeta, 0, len(s.index))
+	for _, meta := range s.index {
+		metas = append(metas, *meta)
+	}
+	return metas
+}
+
+func (s *MemcachedStore) Stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := StoreStats{Entries: len(s.index), Evictions: s.evictions}
+	for _, meta := range s.index {
+		st.Bytes += int64(meta.Size)
+	}
+	return st
+}
+
+// Cleanup forgets entries past their stale window. memcached has already
+// dropped them.
+func (s *MemcachedStore) Cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, meta := range s.index {
+		if !time.Now().Before(meta.ExpiresAt.Add(s.maxStale)) {
+			delete(s.index, key)
+			s.evictions++
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/s3"
+)
+
+// Object metadata S3Store sets on every entry, so Cleanup can learn about
+// entries with a HEAD instead of downloading them.
+const (
+	s3MetaKey       = "X-Amz-Meta-Cache-Key"
+	s3MetaStatus    = "X-Amz-Meta-Status"
+	s3MetaStoredAt  = "X-Amz-Meta-Stored-At"
+	s3MetaExpiresAt = "X-Amz-Meta-Expires-At"
+	s3MetaSize      = "X-Amz-Meta-Size"
+	s3MetaETag      = "X-Amz-Meta-Etag"
+	s3MetaTags      = "X-Amz-Meta-Tags"
+)
+
+type s3Meta struct {
+	EntryMeta
+	// etag is the object's as last listed, to tell when another instance
+	// has rewritten it.
+	etag string
+}
+
+// S3Store keeps entries in an S3 bucket, so instances without a disk of
+// their own, or many instances at once, can share one durable cache. Each
+// entry is an object named by the SHA-256 of its key, and carries when it
+// was stored and when it expires as object metadata, which the client side
+// decides expiry by.
+//
+// Reads always go to the bucket, so entries stored by other instances are
+// seen right away. Meta, Entries and Stats only know of what this instance
+// has stored, read or listed; Cleanup lists the bucket to catch up and
+// deletes entries past their stale window. Hits are counted per instance.
+// Entries aren't encrypted by the proxy, use the bucket's encryption.
+type S3Store struct {
+	client    *s3.Client
+	ttl       time.Duration
+	maxStale  time.Duration
+	index     map[string]*s3Meta
+	evictions int64
+	mu        sync.Mutex
+}
+
+// OpenS3Store opens a store in the bucket cfg points at and lists the
+// entries already in it.
+func OpenS3Store(cfg s3.Config, ttl, maxStale time.Duration) (*S3Store, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be greater than zero")
+	}
+	client, err := s3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &S3Store{
+		client:   client,
+		ttl:      ttl,
+		maxStale: maxStale,
+		index:    make(map[string]*s3Meta),
+	}
+	if err := s.sync(); err != nil {
+		return nil, fmt.Errorf("couldn't list the cache bucket. error: %v", err)
+	}
+	slog.Info("cache: loaded", "bucket", cfg.Bucket, "prefix", cfg.Prefix, "entries", len(s.index))
+	return s, nil
+}
+
+func s3Name(key string) string {
+	return HashBody([]byte(key))
+}
+
+func (s *S3Store) Get(key string) (*Entry, bool) {
+	return s.get(key, 0)
+}
+
+func (s *S3Store) GetStale(key string) (*Entry, bool) {
+	return s.get(key, s.maxStale)
+}
+
+func (s *S3Store) get(key string, grace time.Duration) (*Entry, bool) {
+	obj, err := s.fetch(key)
+	if err != nil {
+		if !errors.Is(err, s3.ErrNotFound) {
+			slog.Warn("cache: couldn't read entry", "key", key, "err", err)
+		}
+		return nil, false
+	}
+	if !time.Now().Before(obj.ExpiresAt.Add(grace)) {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	meta, ok := s.index[s3Name(key)]
+	if !ok {
+		meta = &s3Meta{EntryMeta: remoteMeta(obj)}
+		s.index[s3Name(key)] = meta
+	}
+	meta.Hits++
+	s.mu.Unlock()
+
+	return &Entry{
+		StatusCode: obj.StatusCode,
+		Body:       obj.Body,
+		Headers:    obj.Headers,
+		StoredAt:   obj.StoredAt,
+		ExpiresAt:  obj.ExpiresAt,
+	}, true
+}
+
+func (s *S3Store) fetch(key string) (*remoteEntry, error) {
+	data, _, err := s.client.Get(context.Background(), s3Name(key))
+	if err != nil {
+		return nil, err
+	}
+	var obj remoteEntry
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("couldn't decode entry. error: %v", err)
+	}
+	if obj.Key != key {
+		// a SHA-256 collision, or an object that isn't ours
+		return nil, s3.ErrNotFound
+	}
+	return &obj, nil
+}
+
+func (s *S3Store) addHit(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if meta, ok := s.index[s3Name(key)]; ok {
+		meta.Hits++
+	}
+}
+
+func (s *S3Store) Put(key string, entry *Entry) {
+	now := time.Now()
+	err := s.put(&remoteEntry{
+		Key:        key,
+		StatusCode: entry.StatusCode,
+		Headers:    entry.Headers,
+		Body:       entry.Body,
+		StoredAt:   now,
+		ExpiresAt:  now.Add(entry.TTLOr(s.ttl)),
+	})
+	if err != nil {
+		slog.Error("cache: couldn't store entry", "key", key, "err", err)
+	}
+}
+
+func (s *S3Store) put(obj *remoteEntry) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	meta := remoteMeta(obj)
+	header := http.Header{
+		"Content-Type":  {"application/json"},
+		s3MetaKey:       {url.QueryEscape(obj.Key)},
+		s3MetaStatus:    {strconv.Itoa(obj.StatusCode)},
+		s3MetaStoredAt:  {obj.StoredAt.UTC().Format(time.RFC3339Nano)},
+		s3MetaExpiresAt: {obj.ExpiresAt.UTC().Format(time.RFC3339Nano)},
+		s3MetaSize:      {strconv.Itoa(meta.Size)},
+	}
+	if meta.ETag != "" {
+		header.Set(s3MetaETag, url.QueryEscape(meta.ETag))
+	}
+	if len(meta.Tags) > 0 {
+		header.Set(s3MetaTags, url.QueryEscape(strings.Join(meta.Tags, ",")))
+	}
+	if err := s.client.Put(context.Background(), s3Name(obj.Key), data, header); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index[s3Name(obj.Key)] = &s3Meta{EntryMeta: meta}
+	return nil
+}
+
+// Expire rewrites the entry with an expiry of now. S3 can't change the
+// metadata of an object in place.
+func (s *S3Store) Expire(key string) bool {
+	obj, err := s.fetch(key)
+	if err != nil {
+		return false
+	}
+	if now := time.Now(); obj.ExpiresAt.After(now) {
+		obj.ExpiresAt = now
+		if err := s.put(obj); err != nil {
+			slog.Error("cache: couldn't expire entry", "key", key, "err", err)
+		}
+	}
+	return true
+}
+
+func (s *S3Store) Delete(key string) bool {
+	name := s3Name(key)
+	s.mu.Lock()
+	_, ok := s.index[name]
+	delete(s.index, name)
+	s.mu.Unlock()
+
+	if !ok {
+		// another instance may have stored it
+		if _, err := s.client.Head(context.Background(), name); err != nil {
+			return false
+		}
+	}
+	if err := s.client.Delete(context.Background(), name); err != nil {
+		slog.Error("cache: couldn't delete entry", "key", key, "err", err)
+		return false
+	}
+	return true
+}
+
+func (s *S3Store) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index)
+}
+
+func (s *S3Store) Meta(key string) (EntryMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.index[s3Name(key)]
+	if !ok {
+		return EntryMeta{}, false
+	}
+	return meta.EntryMeta, true
+}
+
+func (s *S3Store) Entries() []EntryMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metas := make([]EntryMeta, 0, len(s.index))
+	for _, meta := range s.index {
+		metas = append(metas, meta.EntryMeta)
+	}
+	return metas
+}
+
+func (s *S3Store) Stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := StoreStats{Entries: len(s.index), Evictions: s.evictions}
+	for _, meta := range s.index {
+		st.Bytes += int64(meta.Size)
+	}
+	return st
+}
+
+// Cleanup brings the index up to date with the bucket and deletes entries
+// past their stale window, whichever instance stored them.
+func (s *S3Store) Cleanup() {
+	if err := s.sync(); err != nil {
+		slog.Error("cache: couldn't list the cache bucket", "err", err)
+		return
+	}
+
+	s.mu.Lock()
+	var expired []string
+	for name, meta := range s.index {
+		if !time.Now().Before(meta.ExpiresAt.Add(s.maxStale)) {
+			expired = append(expired, name)
+			delete(s.index, name)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, name := range expired {
+		if err := s.client.Delete(context.Background(), name); err != nil {
+			slog.Error("cache: couldn't delete expired entry", "object", name, "err", err)
+			continue
+		}
+		s.mu.Lock()
+		s.evictions++
+		s.mu.Unlock()
+	}
+}
+
+// sync lists the bucket, reading the metadata of objects that are new or
+// changed since the last listing and forgetting ones that are gone.
+func (s *S3Store) sync() error {
+	ctx := context.Background()
+	objects, err := s.client.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	known := make(map[string]string, len(s.index))
+	for name, meta := range s.index {
+		known[name] = meta.etag
+	}
+	s.mu.Unlock()
+
+	listed := make(map[string]bool, len(objects))
+	fresh := make(map[string]*s3Meta)
+	for _, obj := range objects {
+		listed[obj.Key] = true
+		if etag, ok := known[obj.Key]; ok && etag == obj.ETag {
+			continue
+		}
+		header, err := s.client.Head(ctx, obj.Key)
+		if errors.Is(err, s3.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		meta, ok := parseS3Meta(header)
+		if !ok {
+			// not one of our entries
+			continue
+		}
+		meta.etag = obj.ETag
+		fresh[obj.Key] = meta
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.index {
+		if !listed[name] {
+			delete(s.index, name)
+		}
+	}
+	for name, meta := range fresh {
+		if old, ok := s.index[name]; ok {
+			meta.Hits = old.Hits
+		}
+		s.index[name] = meta
+	}
+	return nil
+}
+
+func parseS3Meta(h http.Header) (*s3Meta, bool) {
+	key, err := url.QueryUnescape(h.Get(s3MetaKey))
+	if err != nil || key == "" {
+		return nil, false
+	}
+	status, _ := strconv.Atoi(h.Get(s3MetaStatus))
+	size, _ := strconv.Atoi(h.Get(s3MetaSize))
+	storedAt, err := time.Parse(time.RFC3339Nano, h.Get(s3MetaStoredAt))
+	if err != nil {
+		return nil, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339Nano, h.Get(s3MetaExpiresAt))
+	if err != nil {
+		return nil, false
+	}
+	meta := &s3Meta{EntryMeta: EntryMeta{
+		Key:        key,
+		StatusCode: status,
+		StoredAt:   storedAt,
+		ExpiresAt:  expiresAt,
+		Size:       size,
+	}}
+	meta.ETag, _ = url.QueryUnescape(h.Get(s3MetaETag))
+	if tags, _ := url.QueryUnescape(h.Get(s3MetaTags)); tags != "" {
+		meta.Tags = strings.Split(tags, ",")
+	}
+	return meta, true
+}
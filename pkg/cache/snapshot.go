@@ -0,0 +1,94 @@
+package cache
+
+import "io"
+
+// Snapshotter is implemented by stores keeping entries only in memory,
+// which would start empty after a restart. SaveSnapshot writes them out on
+// shutdown and LoadSnapshot reads them back on start, both in the format of
+// an export.
+type Snapshotter interface {
+	SaveSnapshot(w io.Writer) (int, error)
+	LoadSnapshot(r io.Reader) (loaded, expired int, err error)
+}
+
+// SaveSnapshot is Export, hit counts included.
+func (s *MemoryStore) SaveSnapshot(w io.Writer) (int, error) {
+	return s.Export(w)
+}
+
+// LoadSnapshot is Import.
+func (s *MemoryStore) LoadSnapshot(r io.Reader) (loaded, expired int, err error) {
+	return s.Import(r)
+}
+
+// SaveSnapshot writes the entries of the memory tier to w, most recently
+// used first. Hit counts are the slow store's to keep.
+func (s *TieredStore) SaveSnapshot(w io.Writer) (int, error) {
+	s.mu.Lock()
+	items := make([]*tieredItem, 0, s.lru.Len())
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		items = append(items, el.Value.(*tieredItem))
+	}
+	s.mu.Unlock()
+
+	return writeExport(w, len(items), func(i int) (exportMeta, []byte, error) {
+		e := items[i].entry
+		return exportMeta{
+			Key:        items[i].key,
+			StatusCode: e.StatusCode,
+			Headers:    e.Headers,
+			StoredAt:   e.StoredAt,
+			ExpiresAt:  e.ExpiresAt,
+		}, e.Body, nil
+	})
+}
+
+// LoadSnapshot puts the entries of a snapshot written by SaveSnapshot back
+// in the memory tier, in the order they were used. Entries the slow store
+// no longer holds as they were, e.g. because another instance sharing it
+// replaced or purged them meanwhile, are left out and not counted.
+func (s *TieredStore) LoadSnapshot(r io.Reader) (loaded, expired int, err error) {
+	var items []tieredItem
+	_, expired, err = readExport(r, func(key string, entry *Entry, _ int64) error {
+		if meta, ok := s.back.Meta(key); ok && meta.StoredAt.Equal(entry.StoredAt) {
+			items = append(items, tieredItem{key: key, entry: entry})
+		}
+		return nil
+	})
+	// least recently used first, leaving the most recent at the front
+	for i := len(items) - 1; i >= 0; i-- {
+		s.keep(items[i].key, items[i].entry)
+	}
+	return len(items), expired, err
+}
+
+// Flush writes back the hit counts Cleanup hasn't written yet, so the next
+// process opening the store starts from them.
+func (s *DiskStore) Flush() error {
+	if s.readOnly {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for _, meta := range s.index {
+		if meta.Hits == meta.flushedHits {
+			continue
+		}
+		if werr := s.writeMeta(meta); werr != nil {
+			err = werr
+			continue
+		}
+		meta.flushedHits = meta.Hits
+	}
+	return err
+}
+
+// Flush flushes the slow store when it has anything to flush.
+func (s *TieredStore) Flush() error {
+	if f, ok := s.back.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+// Package cache holds the stores the proxy caches responses in: an
+// in-memory MemoryStore, a DiskStore that survives restarts, and an S3Store
+// and a MemcachedStore shared by every instance using them.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a cached response.
+type Entry struct {
+	StatusCode int
+	Body       []byte
+	Headers    http.Header
+	// TTL overrides the store's TTL when putting the entry.
+	TTL time.Duration
+	// StoredAt and ExpiresAt are filled in by the store on reads.
+	StoredAt  time.Time
+	ExpiresAt time.Time
+}
+
+// TTLOr returns the entry's TTL, or def when it has none.
+func (e *Entry) TTLOr(def time.Duration) time.Duration {
+	if e.TTL > 0 {
+		return e.TTL
+	}
+	return def
+}
+
+// Store is a cache backend. Get only returns fresh entries, GetStale also
+// returns expired ones still within the store's stale window.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	GetStale(key string) (*Entry, bool)
+	Put(key string, entry *Entry)
+	Delete(key string) bool
+	// Expire marks an entry as expired without deleting it, so it can still
+	// be served stale.
+	Expire(key string) bool
+	Size() int
+	Cleanup()
+
+	// Meta describes an entry without reading its body, and doesn't count
+	// as a hit.
+	Meta(key string) (EntryMeta, bool)
+	// Entries lists the metadata of every entry, stale ones included.
+	Entries() []EntryMeta
+	Stats() StoreStats
+}
+
+type StoreStats struct {
+	Entries int `json:"entries"`
+	// Bytes counts every distinct body once.
+	Bytes int64 `json:"bytes"`
+	// Evictions counts entries dropped by Cleanup once past their stale
+	// window.
+	Evictions int64 `json:"evictions"`
+}
+
+type EntryMeta struct {
+	Key        string    `json:"key"`
+	StatusCode int       `json:"status_code"`
+	ETag       string    `json:"etag,omitempty"`
+	StoredAt   time.Time `json:"stored_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Size       int       `json:"size"`
+	Hits       int64     `json:"hits"`
+	Tags       []string  `json:"tags,omitempty"`
+}
+
+type storedEntry struct {
+	statusCode int
+	headers    http.Header
+	bodyHash   string
+	storedAt   time.Time
+	expiresAt  time.Time
+	hits       int64
+}
+
+// blob is a response body shared by every entry with the same content.
+type blob struct {
+	data []byte
+	refs int
+}
+
+// MemoryStore keeps entries in memory, storing each distinct body once keyed
+// by its SHA-256 hash. Blobs nobody references anymore are dropped by Cleanup.
+// Expired entries are kept for another maxStale so they can be served stale.
+type MemoryStore struct {
+	ttl       time.Duration
+	maxStale  time.Duration
+	entries   map[string]*storedEntry
+	blobs     map[string]*blob
+	evictions int64
+	mu        sync.Mutex
+}
+
+func NewMemoryStore(ttl, maxStale time.Duration) (*MemoryStore, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be greater than zero")
+	}
+	return &MemoryStore{
+		ttl:      ttl,
+		maxStale: maxStale,
+		entries:  make(map[string]*storedEntry),
+		blobs:    make(map[string]*blob),
+	}, nil
+}
+
+// HashBody is the hex SHA-256 of body, which content addressed bodies are
+// stored under.
+func HashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the entry for key if it hasn't expired yet.
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	return s.get(key, 0)
+}
+
+// GetStale is like Get but also returns expired entries still within maxStale.
+func (s *MemoryStore) GetStale(key string) (*Entry, bool) {
+	return s.get(key, s.maxStale)
+}
+
+func (s *MemoryStore) get(key string, grace time.Duration) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || !time.Now().Before(e.expiresAt.Add(grace)) {
+		return nil, false
+	}
+	e.hits++
+	return &Entry{
+		StatusCode: e.statusCode,
+		Body:       s.blobs[e.bodyHash].data,
+		Headers:    e.headers,
+		StoredAt:   e.storedAt,
+		ExpiresAt:  e.expiresAt,
+	}, true
+}
+
+func (s *MemoryStore) Put(key string, entry *Entry) {
+	now := time.Now()
+	s.restore(key, entry, now, now.Add(entry.TTLOr(s.ttl)), 0)
+}
+
+// restore puts entry with the times and hits given.
+func (s *MemoryStore) restore(key string, entry *Entry, storedAt, expiresAt time.Time, hits int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := HashBody(entry.Body)
+	if b, ok := s.blobs[hash]; ok {
+		b.refs++
+	} else {
+		s.blobs[hash] = &blob{data: entry.Body, refs: 1}
+	}
+
+	s.release(key)
+	s.entries[key] = &storedEntry{
+		statusCode: entry.StatusCode,
+		headers:    entry.Headers,
+		bodyHash:   hash,
+		storedAt:   storedAt,
+		expiresAt:  expiresAt,
+		hits:       hits,
+	}
+}
+
+func (s *MemoryStore) Delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.release(key)
+}
+
+func (s *MemoryStore) Expire(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	if now := time.Now(); e.expiresAt.After(now) {
+		e.expiresAt = now
+	}
+	return true
+}
+
+// release removes key and drops its reference to the body. The blob itself is
+// left for the next Cleanup to collect. s.mu must be held.
+func (s *MemoryStore) release(key string) bool {
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	s.blobs[e.bodyHash].refs--
+	delete(s.entries, key)
+	return true
+}
+
+func (s *MemoryStore) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *MemoryStore) meta(key string, e *storedEntry) EntryMeta {
+	return EntryMeta{
+		Key:        key,
+		StatusCode: e.statusCode,
+		ETag:       e.headers.Get("ETag"),
+		StoredAt:   e.storedAt,
+		ExpiresAt:  e.expiresAt,
+		Size:       len(s.blobs[e.bodyHash].data),
+		Hits:       e.hits,
+		Tags:       ResponseTags(e.headers),
+	}
+}
+
+func (s *MemoryStore) Meta(key string) (EntryMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return EntryMeta{}, false
+	}
+	return s.meta(key, e), true
+}
+
+func (s *MemoryStore) Entries() []EntryMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metas := make([]EntryMeta, 0, len(s.entries))
+	for k, e := range s.entries {
+		metas = append(metas, s.meta(k, e))
+	}
+	return metas
+}
+
+func (s *MemoryStore) Stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := StoreStats{Entries: len(s.entries), Evictions: s.evictions}
+	for _, b := range s.blobs {
+		st.Bytes += int64(len(b.data))
+	}
+	return st
+}
+
+// Cleanup removes entries past their stale window and garbage-collects
+// unreferenced blobs.
+func (s *MemoryStore) Cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, e := range s.entries {
+		if !time.Now().Before(e.expiresAt.Add(s.maxStale)) {
+			s.release(k)
+			s.evictions++
+		}
+	}
+	for h, b := range s.blobs {
+		if b.refs <= 0 {
+			delete(s.blobs, h)
+		}
+	}
+}
+
+// remoteEntry is an entry as the stores keeping it on other servers encode
+// it: whole, with its key to tell hash collisions apart.
+type remoteEntry struct {
+	Key        string      `json:"key"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+	StoredAt   time.Time   `json:"stored_at"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+}
+
+func remoteMeta(e *remoteEntry) EntryMeta {
+	return EntryMeta{
+		Key:        e.Key,
+		StatusCode: e.StatusCode,
+		ETag:       e.Headers.Get("ETag"),
+		StoredAt:   e.StoredAt,
+		ExpiresAt:  e.ExpiresAt,
+		Size:       len(e.Body),
+		Tags:       ResponseTags(e.Headers),
+	}
+}
@@ -0,0 +1,23 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ResponseTags returns the cache tags an origin attached to a response via
+// Surrogate-Key (space separated) or Cache-Tag (comma separated).
+func ResponseTags(h http.Header) []string {
+	var tags []string
+	for _, v := range h.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	for _, v := range h.Values("Cache-Tag") {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TieredStore keeps the most recently used entries of a slower store, like
+// a DiskStore, in memory, so hot entries are served without reading the
+// disk. Puts write through to both tiers, deletes and expirations drop the
+// memory copy, and the slow store stays the source of truth for metadata.
+type TieredStore struct {
+	back    Store
+	maxSize int64
+	size    int64
+	lru     *list.List
+	items   map[string]*list.Element
+	mu      sync.Mutex
+}
+
+type tieredItem struct {
+	key   string
+	entry *Entry
+}
+
+// hitCounter is implemented by stores whose hit counts the memory tier
+// reports its hits to.
+type hitCounter interface {
+	addHit(key string)
+}
+
+// NewTieredStore puts a memory tier of up to maxBytes of bodies in front of
+// back.
+func NewTieredStore(back Store, maxBytes int64) *TieredStore {
+	return &TieredStore{
+		back:    back,
+		maxSize: maxBytes,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// front returns key's entry from the memory tier while it's fresh.
+func (s *TieredStore) front(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*tieredItem).entry
+	if !time.Now().Before(entry.ExpiresAt) {
+		s.remove(el)
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return entry, true
+}
+
+// keep adds entry to the memory tier, evicting the least recently used
+// entries to make room.
+func (s *TieredStore) keep(key string, entry *Entry) {
+	size := int64(len(entry.Body))
+	if size > s.maxSize {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	s.items[key] = s.lru.PushFront(&tieredItem{key: key, entry: entry})
+	s.size += size
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back())
+	}
+}
+
+// forget drops key from the memory tier.
+func (s *TieredStore) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+}
+
+// remove drops el from the memory tier. s.mu must be held.
+func (s *TieredStore) remove(el *list.Element) {
+	item := el.Value.(*tieredItem)
+	s.lru.Remove(el)
+	delete(s.items, item.key)
+	s.size -= int64(len(item.entry.Body))
+}
+
+func (s *TieredStore) Get(key string) (*Entry, bool) {
+	if entry, ok := s.front(key); ok {
+		if hc, ok := s.back.(hitCounter); ok {
+			hc.addHit(key)
+		}
+		return entry, true
+	}
+	entry, ok := s.back.Get(key)
+	if ok {
+		s.keep(key, entry)
+	}
+	return entry, ok
+}
+
+// GetStale serves fresh entries from memory, stale ones only live in the
+// slow store.
+func (s *TieredStore) GetStale(key string) (*Entry, bool) {
+	if entry, ok := s.Get(key); ok {
+		return entry, true
+	}
+	return s.back.GetStale(key)
+}
+
+func (s *TieredStore) Put(key string, entry *Entry) {
+	s.back.Put(key, entry)
+	meta, ok := s.back.Meta(key)
+	if !ok {
+		s.forget(key)
+		return
+	}
+	stored := *entry
+	stored.StoredAt = meta.StoredAt
+	stored.ExpiresAt = meta.ExpiresAt
+	s.keep(key, &stored)
+}
+
+func (s *TieredStore) Delete(key string) bool {
+	s.forget(key)
+	return s.back.Delete(key)
+}
+
+func (s *TieredStore) Expire(key string) bool {
+	s.forget(key)
+	return s.back.Expire(key)
+}
+
+func (s *TieredStore) Size() int                         { return s.back.Size() }
+func (s *TieredStore) Meta(key string) (EntryMeta, bool) { return s.back.Meta(key) }
+func (s *TieredStore) Entries() []EntryMeta              { return s.back.Entries() }
+func (s *TieredStore) Stats() StoreStats                 { return s.back.Stats() }
+
+// Cleanup cleans up the slow store and drops expired entries from memory.
+func (s *TieredStore) Cleanup() {
+	s.back.Cleanup()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for el := s.lru.Front(); el != nil; {
+		next := el.Next()
+		if !now.Before(el.Value.(*tieredItem).entry.ExpiresAt) {
+			s.remove(el)
+		}
+		el = next
+	}
+}
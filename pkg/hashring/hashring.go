@@ -0,0 +1,52 @@
+// Package hashring spreads keys over a set of nodes by consistent hashing.
+// Each node takes many places on the ring, as in ketama, so adding or
+// removing a node only moves the keys that hashed to it.
+package hashring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// pointsPerNode is how many places each node takes on the ring.
+const pointsPerNode = 160
+
+type point struct {
+	hash uint32
+	node int
+}
+
+// Ring maps keys to nodes. It's immutable and safe for concurrent use.
+type Ring struct {
+	points []point
+}
+
+// New places nodes on a ring. Keys map to the index of their node in
+// nodes.
+func New(nodes []string) *Ring {
+	r := &Ring{}
+	for n, name := range nodes {
+		for i := 0; i < pointsPerNode/4; i++ {
+			sum := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				r.points = append(r.points, point{binary.LittleEndian.Uint32(sum[j*4:]), n})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// Get returns the index of the node owning key: the first on the ring at or
+// after the key's hash. The ring must have at least one node.
+func (r *Ring) Get(key string) int {
+	sum := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(sum[:4])
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
@@ -0,0 +1,223 @@
+// Package memcache is a small client for the memcached text protocol. Keys
+// are spread over a list of servers by consistent hashing, see hashring.
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/hashring"
+)
+
+// ErrCacheMiss is returned for keys the server doesn't have.
+var ErrCacheMiss = errors.New("memcache: cache miss")
+
+const (
+	maxIdlePerServer = 8
+	defaultTimeout   = time.Second
+	// relativeExpiryLimit is the longest expiry memcached reads as seconds
+	// from now, longer ones must be given as a unix time.
+	relativeExpiryLimit = 30 * 24 * time.Hour
+)
+
+// Client talks to a fixed list of servers. It's safe for concurrent use.
+type Client struct {
+	servers []*server
+	ring    *hashring.Ring
+	timeout time.Duration
+}
+
+type server struct {
+	addr string
+	idle []net.Conn
+	mu   sync.Mutex
+}
+
+// New returns a client for servers, given as host:port. No connection is
+// made until the first request.
+func New(servers []string) (*Client, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("memcache: no servers")
+	}
+	c := &Client{timeout: defaultTimeout}
+	for _, addr := range servers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("memcache: invalid server %q: %v", addr, err)
+		}
+		c.servers = append(c.servers, &server{addr: addr})
+	}
+	c.ring = hashring.New(servers)
+	return c, nil
+}
+
+func validKey(key string) error {
+	if len(key) == 0 || len(key) > 250 {
+		return fmt.Errorf("memcache: key must be 1 to 250 bytes")
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return fmt.Errorf("memcache: key %q has spaces or control characters", key)
+		}
+	}
+	return nil
+}
+
+// do runs fn on a connection to the server owning key. Connections are
+// reused unless fn fails, since the stream may be left mid-reply.
+func (c *Client) do(key string, fn func(rw *bufio.ReadWriter) error) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	srv := c.servers[c.ring.Get(key)]
+	conn, err := srv.conn(c.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	err = fn(rw)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		conn.Close()
+		return fmt.Errorf("memcache: %s: %v", srv.addr, err)
+	}
+	srv.release(conn)
+	return err
+}
+
+func (s *server) conn(timeout time.Duration) (net.Conn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return conn, nil
+	}
+	s.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", s.addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("memcache: %v", err)
+	}
+	return conn, nil
+}
+
+func (s *server) release(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= maxIdlePerServer {
+		conn.Close()
+		return
+	}
+	s.idle = append(s.idle, conn)
+}
+
+// Get returns the value stored under key.
+func (c *Client) Get(key string) ([]byte, error) {
+	var value []byte
+	err := c.do(key, func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "get %s\r\n", key)
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return ErrCacheMiss
+		}
+		// VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("unexpected reply %q", line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil || size < 0 {
+			return fmt.Errorf("unexpected reply %q", line)
+		}
+		value = make([]byte, size+2)
+		if _, err := io.ReadFull(rw, value); err != nil {
+			return err
+		}
+		value = value[:size]
+		if line, err := readLine(rw.Reader); err != nil || line != "END" {
+			return fmt.Errorf("unexpected end of value: %q %v", line, err)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Set stores value under key until expires, forever when it's zero.
+func (c *Client) Set(key string, value []byte, expires time.Time) error {
+	return c.do(key, func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "set %s 0 %d %d\r\n", key, expiry(expires), len(value))
+		rw.Write(value)
+		rw.WriteString("\r\n")
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return fmt.Errorf("set %s: %s", key, line)
+		}
+		return nil
+	})
+}
+
+// Delete removes key, reporting ErrCacheMiss if it wasn't there.
+func (c *Client) Delete(key string) error {
+	return c.do(key, func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "delete %s\r\n", key)
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(rw.Reader)
+		switch {
+		case err != nil:
+			return err
+		case line == "DELETED":
+			return nil
+		case line == "NOT_FOUND":
+			return ErrCacheMiss
+		default:
+			return fmt.Errorf("delete %s: %s", key, line)
+		}
+	})
+}
+
+// expiry is how expires is given to memcached: seconds from now up to 30
+// days, a unix time past that.
+func expiry(expires time.Time) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+	d := time.Until(expires)
+	switch {
+	case d <= 0:
+		// memcached reads negative expiries as already expired
+		return -1
+	case d > relativeExpiryLimit:
+		return expires.Unix()
+	default:
+		return int64(d.Round(time.Second)/time.Second) + 1
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
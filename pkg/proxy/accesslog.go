@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// AccessLogConfig writes one line per proxied request to a file of its own,
+// in Apache's combined log format or as JSON.
+type AccessLogConfig struct {
+	// Path is the file to log to. Leaving it empty disables the access log.
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	// The file is rotated once it reaches MaxBytes, or once it's been
+	// written to for RotateEvery. Zero disables either trigger.
+	MaxBytes    int64    `json:"max_bytes"`
+	RotateEvery Duration `json:"rotate_every"`
+	// MaxBackups is how many rotated files are kept, all of them when zero.
+	MaxBackups int `json:"max_backups"`
+}
+
+func (c *AccessLogConfig) validate() error {
+	if c.Path == "" {
+		return nil
+	}
+	if c.Format != accessLogCombined && c.Format != accessLogJSON {
+		return fmt.Errorf("access_log: format must be %q or %q", accessLogCombined, accessLogJSON)
+	}
+	if c.MaxBytes < 0 || c.RotateEvery < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("access_log: max_bytes, rotate_every and max_backups must not be negative")
+	}
+	return nil
+}
+
+type accessEntry struct {
+	r *http.Request
+	// client is r's client IP, through the trusted proxies.
+	client   string
+	time     time.Time
+	status   int
+	bytes    int
+	cache    string
+	duration time.Duration
+	// requestID is only logged in the JSON format, combined has no field
+	// for it.
+	requestID string
+}
+
+type accessLog struct {
+	format string
+	out    *rotatingFile
+}
+
+func openAccessLog(cfg AccessLogConfig) (*accessLog, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	out, err := openRotatingFile(cfg.Path, cfg.MaxBytes, time.Duration(cfg.RotateEvery), cfg.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open access log. error: %v", err)
+	}
+	return &accessLog{format: cfg.Format, out: out}, nil
+}
+
+// log writes e to the access log. It's a no-op on a nil accessLog, so
+// callers don't need to check whether one is configured.
+func (al *accessLog) log(e *accessEntry) {
+	if al == nil {
+		return
+	}
+	var line []byte
+	if al.format == accessLogJSON {
+		line = e.json()
+	} else {
+		line = e.combined()
+	}
+	al.out.Write(line)
+}
+
+func (al *accessLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	return al.out.Close()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// combined formats e as `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"`.
+func (e *accessEntry) combined() []byte {
+	r := e.r
+	user, _, _ := r.BasicAuth()
+	size := "-"
+	if e.bytes > 0 {
+		size = strconv.Itoa(e.bytes)
+	}
+	return fmt.Appendf(nil, "%s - %s [%s] \"%s %s %s\" %d %s %s %s\n",
+		e.client,
+		orDash(user),
+		e.time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.URL.RequestURI(), r.Proto,
+		e.status,
+		size,
+		strconv.Quote(orDash(r.Referer())),
+		strconv.Quote(orDash(r.UserAgent())),
+	)
+}
+
+func (e *accessEntry) json() []byte {
+	r := e.r
+	fields := map[string]any{
+		"time":        e.time.Format(time.RFC3339Nano),
+		"remote_addr": e.client,
+		"method":      r.Method,
+		"uri":         r.URL.RequestURI(),
+		"proto":       r.Proto,
+		"status":      e.status,
+		"bytes":       e.bytes,
+		"referer":     r.Referer(),
+		"user_agent":  r.UserAgent(),
+		"cache":       e.cache,
+		"duration_ms": float64(e.duration.Microseconds()) / 1000,
+	}
+	if e.requestID != "" {
+		fields["request_id"] = e.requestID
+	}
+	data, _ := json.Marshal(fields)
+	return append(data, '\n')
+}
+
+// rotatingFile is an append-only file that's renamed aside, to
+// "<path>.<timestamp>", when it grows past maxBytes or gets older than
+// every.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	every      time.Duration
+	maxBackups int
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxBytes int64, every time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, every: every, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	full := rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes
+	old := rf.every > 0 && time.Since(rf.openedAt) >= rf.every
+	if full || old {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	aside := rf.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(rf.path, aside); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	return rf.removeOldBackups()
+}
+
+func (rf *rotatingFile) removeOldBackups() error {
+	if rf.maxBackups == 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return err
+	}
+	// timestamps sort lexically, oldest first
+	slices.Sort(backups)
+	for len(backups) > rf.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
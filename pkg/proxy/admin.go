@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+const adminPrefix = "/_cache/"
+
+func (cps *Server) adminHandler() http.Handler {
+	auth := &cps.config().AdminAuth
+	read, purge, warm, debug := auth.Read.guard, auth.Purge.guard, auth.Warm.guard, auth.Debug.guard
+	maintenance := auth.Maintenance.guard
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /_cache/meta", read(http.HandlerFunc(cps.handleMeta)))
+	mux.Handle("GET /_cache/stats", read(http.HandlerFunc(cps.handleStats)))
+	mux.Handle("GET /_cache/metrics", read(cps.metrics.handler()))
+	mux.Handle("GET /_cache/top", read(http.HandlerFunc(cps.handleTopKeys)))
+	mux.Handle("GET /_cache/recent", read(http.HandlerFunc(cps.handleRecent)))
+	mux.HandleFunc("GET /_cache/dashboard", cps.handleDashboard)
+	mux.Handle("DELETE /_cache/{key...}", purge(http.HandlerFunc(cps.handleDelete)))
+	mux.Handle("PURGE /", purge(http.HandlerFunc(cps.handlePurge)))
+	mux.Handle("POST /_cache/purge", purge(http.HandlerFunc(cps.handlePurgeMatching)))
+	mux.Handle("POST /_cache/purge-tag", purge(http.HandlerFunc(cps.handlePurgeTag)))
+	mux.Handle("POST /_cache/warm", warm(http.HandlerFunc(cps.handleWarm)))
+	mux.Handle("GET /_cache/maintenance", read(http.HandlerFunc(cps.handleMaintenance)))
+	mux.Handle("PUT /_cache/maintenance", maintenance(http.HandlerFunc(cps.handleMaintenance)))
+	mux.Handle("DELETE /_cache/maintenance", maintenance(http.HandlerFunc(cps.handleMaintenance)))
+	mux.Handle("GET /_cache/debug/", debug(http.StripPrefix("/_cache", debugHandler())))
+	return mux
+}
+
+// isAdminRequest tells whether r belongs to the admin API when it shares the
+// proxy's listener.
+func isAdminRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, adminPrefix) || r.Method == "PURGE"
+}
+
+// purge deletes every entry whose key satisfies match and returns how many
+// were deleted. A soft purge only marks them expired, so they can still be
+// served stale while the origin is refetched.
+func (cps *Server) purge(match func(key string) bool, soft bool) int {
+	n := 0
+	for _, meta := range cps.Cache.Entries() {
+		if !match(meta.Key) {
+			continue
+		}
+		if soft && cps.Cache.Expire(meta.Key) || !soft && cps.Cache.Delete(meta.Key) {
+			n++
+		}
+	}
+	return n
+}
+
+// globToRegexp turns a glob over cache keys into a regexp. Unlike path.Match
+// '*' also matches '/', so "GET-/api/*" covers the whole subtree.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+type purgeRequest struct {
+	Regex string `json:"regex"`
+	Glob  string `json:"glob"`
+	Soft  bool   `json:"soft"`
+}
+
+// handlePurgeMatching purges every key matching a regex or glob:
+//
+//	POST /_cache/purge {"glob": "GET-/products/*", "soft": true}
+func (cps *Server) handlePurgeMatching(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	var re *regexp.Regexp
+	var err error
+	switch {
+	case req.Regex != "" && req.Glob != "":
+		writeJSONError(w, http.StatusBadRequest, "give either regex or glob, not both")
+		return
+	case req.Regex != "":
+		re, err = regexp.Compile(req.Regex)
+	case req.Glob != "":
+		re, err = globToRegexp(req.Glob)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "regex or glob is required")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid pattern: "+err.Error())
+		return
+	}
+
+	n := cps.invalidate(invalidation{Regex: re.String(), Soft: req.Soft})
+	slog.Info("purge", "regex", re.String(), "soft", req.Soft, "entries", n)
+	writeJSON(w, http.StatusOK, map[string]any{"purged": n, "soft": req.Soft})
+}
+
+// pathMatcher matches keys of path, or of every path under it when path ends
+// with '*'.
+func pathMatcher(path string) func(key string) bool {
+	if prefix, ok := strings.CutSuffix(path, "*"); ok {
+		return func(key string) bool { return strings.HasPrefix(keyPath(key), prefix) }
+	}
+	return func(key string) bool { return keyPath(key) == path }
+}
+
+// handleDelete purges one exact cache key (DELETE /_cache/GET-/a), or every
+// path under a prefix (DELETE /_cache/?prefix=/api/).
+func (cps *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key != "" {
+		if cps.invalidate(invalidation{Key: key}) == 0 {
+			writeJSONError(w, http.StatusNotFound, "no such entry")
+			return
+		}
+		slog.Info("purge", "key", key, "entries", 1)
+		writeJSON(w, http.StatusOK, map[string]int{"purged": 1})
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeJSONError(w, http.StatusBadRequest, "key or prefix is required")
+		return
+	}
+	n := cps.invalidate(invalidation{Prefix: prefix})
+	slog.Info("purge", "prefix", prefix, "entries", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+// handlePurge invalidates every variant cached for the request's path, as in
+// `curl -X PURGE http://proxy/products/1`. A path ending in '*' purges the
+// whole subtree. Only the cache namespace of the request's host is purged.
+func (cps *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	n := cps.invalidate(invalidation{Path: r.URL.Path, Host: r.Host})
+	slog.Info("purge", "path", r.URL.Path, "entries", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// handleMeta serves the metadata of one entry (?key=GET-/a) or of every
+// variant cached for a path (?path=/a), never the bodies.
+func (cps *Server) handleMeta(w http.ResponseWriter, r *http.Request) {
+	if key := r.URL.Query().Get("key"); key != "" {
+		meta, ok := cps.Cache.Meta(key)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no such entry")
+			return
+		}
+		writeJSON(w, http.StatusOK, meta)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSONError(w, http.StatusBadRequest, "key or path is required")
+		return
+	}
+	variants := []cache.EntryMeta{}
+	for _, meta := range cps.Cache.Entries() {
+		if keyPath(meta.Key) == path {
+			variants = append(variants, meta)
+		}
+	}
+	if len(variants) == 0 {
+		writeJSONError(w, http.StatusNotFound, "nothing cached for path")
+		return
+	}
+	sort.Slice(variants, func(i, j int) bool { return variants[i].Key < variants[j].Key })
+	writeJSON(w, http.StatusOK, map[string]any{"path": path, "variants": variants})
+}
+
+type purgeTagRequest struct {
+	Tags []string `json:"tags"`
+	Soft bool     `json:"soft"`
+}
+
+// handlePurgeTag invalidates every entry the origin tagged with one of the
+// given Surrogate-Key/Cache-Tag values:
+//
+//	POST /_cache/purge-tag {"tags": ["product-42"]}
+func (cps *Server) handlePurgeTag(w http.ResponseWriter, r *http.Request) {
+	var req purgeTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(req.Tags) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "tags is required")
+		return
+	}
+
+	n := cps.invalidate(invalidation{Tags: req.Tags, Soft: req.Soft})
+	slog.Info("purge", "tags", req.Tags, "soft", req.Soft, "entries", n)
+	writeJSON(w, http.StatusOK, map[string]any{"purged": n, "soft": req.Soft})
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminAuthConfig protects the admin API per endpoint group. Read covers
+// meta, stats, metrics, top and recent, Purge the DELETE, PURGE and purge
+// endpoints, Warm the warm endpoint and Debug the pprof and expvar
+// endpoints. The gRPC admin API's reads and purges are covered by Read and
+// Purge too.
+type AdminAuthConfig struct {
+	Read  AdminAccess `json:"read"`
+	Purge AdminAccess `json:"purge"`
+	Warm  AdminAccess `json:"warm"`
+	Debug AdminAccess `json:"debug"`
+	// Maintenance switches maintenance mode.
+	Maintenance AdminAccess `json:"maintenance"`
+	// Reload reloads the config over the gRPC admin API.
+	Reload AdminAccess `json:"reload"`
+}
+
+// AdminAccess is who may use an endpoint group: clients presenting Token as
+// a bearer token or one of Users (name to password) with basic auth, from
+// one of the Allow IPs or CIDRs. A group without credentials is open, a
+// group without Allow is reachable from anywhere. Warm, Debug, Maintenance
+// and Reload stay disabled without credentials though, and so do Read and
+// Purge when the admin API shares a listener with the proxied traffic.
+type AdminAccess struct {
+	Token string            `json:"token"`
+	Users map[string]string `json:"users"`
+	Allow []string          `json:"allow"`
+
+	allowNets []*net.IPNet
+	// required keeps the group disabled until credentials are configured.
+	required bool
+}
+
+// validate defaults each group's token to the admin_token. public tells
+// whether the admin API is served to the proxy's clients.
+func (c *AdminAuthConfig) validate(token string, public bool) error {
+	c.Read.required = public
+	c.Purge.required = public
+	c.Warm.required = true
+	c.Debug.required = true
+	c.Maintenance.required = true
+	c.Reload.required = true
+	for name, a := range map[string]*AdminAccess{"read": &c.Read, "purge": &c.Purge, "warm": &c.Warm, "debug": &c.Debug, "maintenance": &c.Maintenance, "reload": &c.Reload} {
+		if a.Token == "" {
+			a.Token = token
+		}
+		nets, err := parseCIDRs(a.Allow)
+		if err != nil {
+			return fmt.Errorf("admin_auth: %s: %v", name, err)
+		}
+		a.allowNets = nets
+	}
+	return nil
+}
+
+// guard wraps h so only clients allowed by a reach it.
+func (a *AdminAccess) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.check(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (a *AdminAccess) check(w http.ResponseWriter, r *http.Request) bool {
+	status, msg := a.deny(r)
+	if status == 0 {
+		return true
+	}
+	if status == http.StatusUnauthorized {
+		if a.Token != "" {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+		}
+		if len(a.Users) > 0 {
+			w.Header().Add("WWW-Authenticate", `Basic realm="caching-proxy admin"`)
+		}
+	}
+	writeJSONError(w, status, msg)
+	return false
+}
+
+// deny returns why r may not use the group, as a 401 or 403 status and a
+// message, or a zero status when it may.
+func (a *AdminAccess) deny(r *http.Request) (int, string) {
+	if len(a.allowNets) > 0 && !ipAllowed(a.allowNets, r.RemoteAddr) {
+		return http.StatusForbidden, "admin API is not allowed for this client"
+	}
+	if a.Token == "" && len(a.Users) == 0 {
+		if a.required {
+			return http.StatusForbidden, "endpoint disabled, set admin_token to enable it"
+		}
+		return 0, ""
+	}
+	if a.authorized(r) {
+		return 0, ""
+	}
+	return http.StatusUnauthorized, "invalid or missing admin credentials"
+}
+
+func (a *AdminAccess) authorized(r *http.Request) bool {
+	if got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.Token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(a.Token)) == 1
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, ok := a.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The read and purge groups mustn't be open to the proxy's clients.
+func TestAdminAuthPublic(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		adminAddr  string
+		token      string
+		bearer     string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "stats on the proxy listener", method: http.MethodGet, path: "/_cache/stats", wantStatus: http.StatusForbidden},
+		{name: "purge on the proxy listener", method: "PURGE", path: "/a", wantStatus: http.StatusForbidden},
+		{name: "stats with the token", token: "s3cret", bearer: "s3cret", method: http.MethodGet, path: "/_cache/stats", wantStatus: http.StatusOK},
+		{name: "stats with a wrong token", token: "s3cret", bearer: "nope", method: http.MethodGet, path: "/_cache/stats", wantStatus: http.StatusUnauthorized},
+		{name: "stats on the admin listener", adminAddr: "127.0.0.1:0", method: http.MethodGet, path: "/_cache/stats", wantStatus: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cps := newTestServer(t, "http://127.0.0.1:1", func(cfg *Config) {
+				cfg.AdminAddr = tc.adminAddr
+				cfg.AdminToken = tc.token
+			})
+			h := cps.Handler()
+			if tc.adminAddr != "" {
+				h = cps.AdminHandler()
+			}
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.bearer)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+		})
+	}
+}
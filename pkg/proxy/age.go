@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// originAge is the Age header of a response, how long an upstream cache
+// already held it (RFC 9111, section 5.1). A missing or invalid Age is 0.
+func originAge(h http.Header) time.Duration {
+	secs, err := strconv.ParseInt(strings.TrimSpace(h.Get("Age")), 10, 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// currentAge is how old the cached val is at now: the age it arrived with
+// plus the time it's been stored here.
+func currentAge(val *cache.Entry, now time.Time) time.Duration {
+	return originAge(val.Headers) + max(now.Sub(val.StoredAt), 0)
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// bufferBody reads r's body and puts a copy back, so it can still be sent
+// to the origin.
+func bufferBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read request body. error: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// tooLarge tells whether err comes from a body over MaxRequestBody.
+func tooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+func isJSON(h http.Header) bool {
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// normalizeBody returns body in a canonical form, so requests that only
+// differ in formatting share an entry: JSON is compacted with its object
+// keys sorted. Other bodies are taken as they are.
+func normalizeBody(h http.Header, body []byte) []byte {
+	if !isJSON(h) {
+		return body
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// isGraphQLMutation tells whether body is a GraphQL request for a mutation,
+// or a batch holding one, which must reach the origin every time.
+func isGraphQLMutation(h http.Header, body []byte) bool {
+	if !isJSON(h) {
+		return false
+	}
+	type operation struct {
+		Query string `json:"query"`
+	}
+	var ops []operation
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return false
+		}
+	} else {
+		var op operation
+		if err := json.Unmarshal(body, &op); err != nil {
+			return false
+		}
+		ops = append(ops, op)
+	}
+	for _, op := range ops {
+		if graphQLMutation.MatchString(graphQLComment.ReplaceAllString(op.Query, "")) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	graphQLComment = regexp.MustCompile(`#[^\n]*`)
+	// a mutation starts the document or follows the previous definition
+	graphQLMutation = regexp.MustCompile(`(^|\})\s*mutation\b`)
+)
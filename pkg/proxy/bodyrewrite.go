@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// BodyRewriteConfig rewrites the origin's base URL to the proxy's public
+// one in response bodies before they're cached, so links and asset
+// references keep pointing at the cache. PublicURL defaults to the scheme
+// and Host the request came in with, but as the Host is the client's to
+// pick, bodies rewritten with it aren't cached. Only bodies of Types up to
+// MaxBytes are rewritten, and only uncompressed ones, so origins are asked
+// for the identity upstream_encoding when it's enabled.
+type BodyRewriteConfig struct {
+	Enabled   bool     `json:"enabled"`
+	PublicURL string   `json:"public_url"`
+	Types     []string `json:"types"`
+	MaxBytes  int64    `json:"max_bytes"`
+}
+
+var defaultBodyRewriteTypes = []string{
+	"text/html",
+	"text/css",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+}
+
+func (c *BodyRewriteConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.PublicURL != "" {
+		if err := validateOriginURL(c.PublicURL); err != nil {
+			return fmt.Errorf("body_rewrite: public_url %v", err)
+		}
+		c.PublicURL = strings.TrimSuffix(c.PublicURL, "/")
+	}
+	if c.Types == nil {
+		c.Types = defaultBodyRewriteTypes
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("body_rewrite: max_bytes must not be negative")
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = 1 << 20
+	}
+	return nil
+}
+
+// rewriteBody returns body with o's backend URLs replaced by the public
+// URL of r, fixing up resp's Content-Length to match. fromHost tells
+// whether the body was rewritten with r's Host, not PublicURL.
+func (c *BodyRewriteConfig) rewriteBody(r *http.Request, o *origin, resp *http.Response, body []byte) (rewritten []byte, fromHost bool) {
+	if !c.Enabled || int64(len(body)) > c.MaxBytes || resp.Header.Get("Content-Encoding") != "" ||
+		!hasMediaType(resp.Header, c.Types) {
+		return body, false
+	}
+	public := c.PublicURL
+	if public == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		public = (&url.URL{Scheme: scheme, Host: r.Host}).String()
+	}
+	rewritten = body
+	replaced := false
+	for _, b := range o.backends {
+		base := []byte(strings.TrimSuffix(b.url, "/"))
+		if bytes.Contains(rewritten, base) {
+			rewritten = bytes.ReplaceAll(rewritten, base, []byte(public))
+			replaced = true
+		}
+	}
+	if len(rewritten) != len(body) && resp.Header.Get("Content-Length") != "" {
+		resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	}
+	return rewritten, replaced && c.PublicURL == ""
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Bodies rewritten with the Host a client sent must not be served to
+// other clients.
+func TestBodyRewriteHost(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		publicURL  string
+		wantLink   string
+		wantCached bool
+	}{
+		{name: "request host", publicURL: "", wantLink: "http://evil.example/x", wantCached: false},
+		{name: "public url", publicURL: "https://cdn.example", wantLink: "https://cdn.example/x", wantCached: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var originURL string
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				io.WriteString(w, `<a href="`+originURL+`/x">`)
+			}))
+			defer origin.Close()
+			originURL = origin.URL
+			cps := newTestServer(t, origin.URL, func(cfg *Config) {
+				cfg.BodyRewrite.Enabled = true
+				cfg.BodyRewrite.PublicURL = tc.publicURL
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/page", nil)
+			r.Host = "evil.example"
+			rec := httptest.NewRecorder()
+			cps.Handler().ServeHTTP(rec, r)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200", rec.Code)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tc.wantLink) {
+				t.Errorf("got body %q, want a link to %s", body, tc.wantLink)
+			}
+			if _, cached := cps.Cache.Get("GET-/page"); cached != tc.wantCached {
+				t.Errorf("cached = %v, want %v", cached, tc.wantCached)
+			}
+		})
+	}
+}
+
+// An origin that gzips for clients asking for it still gets its bodies
+// rewritten, whatever upstream_encoding says.
+func TestBodyRewriteGzipOrigin(t *testing.T) {
+	var originURL string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		body := `<a href="` + originURL + `/x">`
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			io.WriteString(w, body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, body)
+		zw.Close()
+	}))
+	defer origin.Close()
+	originURL = origin.URL
+	cps := newTestServer(t, origin.URL, func(cfg *Config) {
+		cfg.BodyRewrite.Enabled = true
+		cfg.BodyRewrite.PublicURL = "https://cdn.example"
+		cfg.Compression.UpstreamEncoding = encodingGzip
+	})
+
+	rec := httptest.NewRecorder()
+	cps.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+
+	if body := rec.Body.String(); !strings.Contains(body, "https://cdn.example/x") {
+		t.Errorf("got body %q, want it rewritten", body)
+	}
+}
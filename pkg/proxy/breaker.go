@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// BreakerConfig opens a circuit on the origin once too many of its requests
+// fail, so a backend that's down gets a rest instead of more traffic.
+type BreakerConfig struct {
+	// ErrorRate is the fraction of failed origin requests within Window,
+	// out of at least MinRequests, that opens the circuit. Zero disables
+	// the breaker.
+	ErrorRate   float64  `json:"error_rate"`
+	MinRequests int      `json:"min_requests"`
+	Window      Duration `json:"window"`
+	// CoolDown is how long the circuit stays open before a single probe
+	// request is let through to see whether the origin is back.
+	CoolDown Duration `json:"cool_down"`
+}
+
+func (c *BreakerConfig) validate() error {
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return fmt.Errorf("breaker: error_rate must be between 0 and 1")
+	}
+	if c.ErrorRate == 0 {
+		return nil
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 20
+	}
+	if c.Window <= 0 {
+		c.Window = Duration(10 * time.Second)
+	}
+	if c.CoolDown <= 0 {
+		return fmt.Errorf("breaker: cool_down must be greater than zero")
+	}
+	return nil
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// breaker is a circuit breaker counting failures over fixed windows.
+type breaker struct {
+	cfg BreakerConfig
+
+	mu          sync.Mutex
+	state       breakerState
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	probing     bool
+	opened      int64
+	// onOpen is told why, whenever the circuit opens.
+	onOpen func(reason string)
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	return &breaker{cfg: cfg, state: breakerClosed, windowStart: time.Now()}
+}
+
+// allow reports whether a request may go to the origin, and if not how long
+// until the circuit lets a probe through.
+func (b *breaker) allow() (bool, time.Duration) {
+	if b.cfg.ErrorRate == 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		wait := time.Until(b.openedAt.Add(time.Duration(b.cfg.CoolDown)))
+		if wait > 0 {
+			return false, wait
+		}
+		b.state = breakerHalfOpen
+		b.probing = false
+		slog.Info("breaker: half-open, probing origin")
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, time.Second
+		}
+		b.probing = true
+	}
+	return true, 0
+}
+
+// record accounts for the outcome of a request allow let through.
+func (b *breaker) record(failed bool) {
+	if b.cfg.ErrorRate == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case breakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.trip(now, "probe failed")
+			return
+		}
+		b.state = breakerClosed
+		b.resetWindow(now)
+		slog.Info("breaker: closed, origin is back")
+		return
+	case breakerOpen:
+		// a request let through before the circuit opened
+		return
+	}
+
+	if now.Sub(b.windowStart) >= time.Duration(b.cfg.Window) {
+		b.resetWindow(now)
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= b.cfg.MinRequests && float64(b.failures)/float64(b.requests) >= b.cfg.ErrorRate {
+		b.trip(now, fmt.Sprintf("%d of %d origin requests failed", b.failures, b.requests))
+	}
+}
+
+// cancel gives up a request allow let through without it counting either
+// way, like one whose client went away. A half-open circuit then lets the
+// next request probe the origin instead.
+func (b *breaker) cancel() {
+	if b.cfg.ErrorRate == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *breaker) trip(now time.Time, reason string) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.opened++
+	b.resetWindow(now)
+	slog.Warn("breaker: open", "reason", reason, "cool_down", time.Duration(b.cfg.CoolDown))
+	if b.onOpen != nil {
+		b.onOpen(reason)
+	}
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// BreakerStats is the breaker's state as reported by the stats endpoint.
+type BreakerStats struct {
+	State    breakerState `json:"state"`
+	OpenedAt *time.Time   `json:"opened_at,omitempty"`
+	// Opened counts how many times the circuit has opened.
+	Opened int64 `json:"opened"`
+}
+
+func (b *breaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStats{State: b.state, Opened: b.opened}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		st.OpenedAt = &openedAt
+	}
+	return st
+}
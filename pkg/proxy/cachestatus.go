@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+const defaultCacheStatusHeader = "X-Cache"
+
+// cacheStatuses are the results the cache status header can carry.
+var cacheStatuses = []string{
+	"HIT", "MISS", "STALE", "BYPASS", "REFRESH", "EXPIRED", "REVALIDATED",
+	"PEER", "HISTORY", "STREAM", "TUNNEL", "RECORD",
+}
+
+// CacheStatusConfig is the response header telling how the proxy answered,
+// X-Cache: HIT, MISS, STALE, BYPASS and the like.
+type CacheStatusConfig struct {
+	// Header is the header's name, empty to leave it off responses.
+	Header string `json:"header"`
+	// Detailed tells misses of an entry that had expired apart as EXPIRED,
+	// and those the origin answered with a 304 for the entry's ETag as
+	// REVALIDATED. Both are MISS otherwise.
+	Detailed bool `json:"detailed"`
+	// Values renames results, e.g. {"HIT": "TCP_HIT"}, for tooling that
+	// expects other names.
+	Values map[string]string `json:"values"`
+}
+
+func (c *CacheStatusConfig) validate() error {
+	if c.Header != "" && !httpguts.ValidHeaderFieldName(c.Header) {
+		return fmt.Errorf("cache_status: invalid header name %q", c.Header)
+	}
+	for result, v := range c.Values {
+		if !slices.Contains(cacheStatuses, result) {
+			return fmt.Errorf("cache_status: unknown result %q", result)
+		}
+		if !httpguts.ValidHeaderFieldValue(v) {
+			return fmt.Errorf("cache_status: invalid value %q for %s", v, result)
+		}
+	}
+	return nil
+}
+
+// set sets the cache status header in h to result, as named by the config.
+func (c *CacheStatusConfig) set(h http.Header, result string) {
+	if c.Header == "" {
+		return
+	}
+	if !c.Detailed && (result == "EXPIRED" || result == "REVALIDATED") {
+		result = "MISS"
+	}
+	if v, ok := c.Values[result]; ok {
+		result = v
+	}
+	h.Set(c.Header, result)
+}
+
+// notRevalidated are the stored headers a 304 doesn't replace, as they
+// describe the stored body.
+var notRevalidated = []string{"Content-Length", "Content-Encoding", "Content-Type", "Content-Range"}
+
+// revalidationETag returns the ETag to ask the origin whether key's expired
+// entry changed with, empty when there's no such entry or it's past the
+// stale window, which is as long as expired entries can be read back.
+func (cps *Server) revalidationETag(key string) string {
+	meta, ok := cps.Cache.Meta(key)
+	if !ok || meta.ETag == "" {
+		return ""
+	}
+	if !time.Now().Before(meta.ExpiresAt.Add(time.Duration(cps.config().Degradation.MaxStale))) {
+		return ""
+	}
+	return meta.ETag
+}
+
+// revalidated returns key's expired entry as a response to store again,
+// with the headers of the origin's 304 resp. ok is false when the entry is
+// gone meanwhile.
+func (cps *Server) revalidated(key string, resp *http.Response) (fresh *http.Response, body []byte, ok bool) {
+	cps.mu.RLock()
+	val, ok := cps.Cache.GetStale(key)
+	cps.mu.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	h := val.Headers.Clone()
+	for k, vv := range resp.Header {
+		if !isHopHeader(k) && !slices.Contains(notRevalidated, k) {
+			h[k] = vv
+		}
+	}
+	return &http.Response{
+		StatusCode: val.StatusCode,
+		Header:     h,
+		ProtoMajor: resp.ProtoMajor,
+		ProtoMinor: resp.ProtoMinor,
+	}, val.Body, true
+}
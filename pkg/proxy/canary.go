@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	mathrand "math/rand/v2"
+	"net/http"
+)
+
+// CanaryConfig sends a Weight fraction of a route's requests, e.g. 0.05, to
+// Origin, a new version of the route's origin, and the rest where they'd go
+// otherwise. With Sticky a client, by IP, stays on the version it got
+// first instead of each request being picked on its own. The versions are
+// cached apart unless SharedCache is set, then whichever fetched an object
+// answers for both until it expires.
+type CanaryConfig struct {
+	Origin      string  `json:"origin"`
+	Weight      float64 `json:"weight"`
+	Sticky      bool    `json:"sticky"`
+	SharedCache bool    `json:"shared_cache"`
+}
+
+func (c *CanaryConfig) validate() error {
+	if err := validateOriginURL(c.Origin); err != nil {
+		return fmt.Errorf("canary: %v", err)
+	}
+	if c.Weight < 0 || c.Weight > 1 {
+		return fmt.Errorf("canary: weight must be between 0 and 1")
+	}
+	return nil
+}
+
+// picked tells whether r, from client, goes to the canary. A nil config
+// picks nothing, and a refresh-ahead request goes where its entry came
+// from. Canary requests aren't asked of peers, so a peer's request is
+// always for the current version.
+func (c *CanaryConfig) picked(r *http.Request, client string) bool {
+	if c == nil || isPeerRequest(r) {
+		return false
+	}
+	if key, ok := r.Context().Value(refreshKey{}).(string); ok && !c.SharedCache {
+		_, canary := keyVariant(key, canaryVariant)
+		return canary
+	}
+	if c.Sticky {
+		h := fnv.New64a()
+		h.Write([]byte(client))
+		return float64(h.Sum64()%10000) < c.Weight*10000
+	}
+	return mathrand.Float64() < c.Weight
+}
+
+// canaryOrigin returns the origin of route's canary.
+func (cps *Server) canaryOrigin(route *RouteConfig) *origin {
+	return cps.live.Load().origins[newOriginSpec(route.Canary.Origin, nil, "").name()]
+}
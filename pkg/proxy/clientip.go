@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address r came from. When the peer is one of the
+// trusted proxies, X-Forwarded-For is walked from the right, skipping
+// trusted hops, and the first untrusted address is the client.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if len(trusted) == 0 || !ipAllowed(trusted, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !ipAllowed(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientAllowed reports whether ip may use the proxy: when AllowClients
+// is set it must be in it, and it mustn't be in DenyClients.
+func (c *Config) clientAllowed(ip string) bool {
+	if len(c.allowNets) > 0 && !ipAllowed(c.allowNets, ip) {
+		return false
+	}
+	return !ipAllowed(c.denyNets, ip)
+}
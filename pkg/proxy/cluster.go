@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/hashring"
+)
+
+// ClusterConfig makes proxies behind the same load balancer share one
+// cache. Every key is owned by one of Peers, picked by consistent hashing,
+// and a proxy missing a GET asks the owner for it before going to the
+// origin, so the cluster fetches each object from the origin once. Peers
+// are the proxies' base URLs, Self is this proxy's among them.
+type ClusterConfig struct {
+	Peers []string `json:"peers"`
+	Self  string   `json:"self"`
+}
+
+func (c *ClusterConfig) validate() error {
+	if len(c.Peers) == 0 {
+		return nil
+	}
+	for i, p := range c.Peers {
+		if err := validateOriginURL(p); err != nil {
+			return fmt.Errorf("cluster: peer %v", err)
+		}
+		c.Peers[i] = strings.TrimSuffix(p, "/")
+	}
+	c.Self = strings.TrimSuffix(c.Self, "/")
+	if !slices.Contains(c.Peers, c.Self) {
+		return fmt.Errorf("cluster: self must be one of the peers")
+	}
+	return nil
+}
+
+// peerHeader marks requests one peer sends another, which the owner
+// answers itself instead of asking a peer in turn.
+const peerHeader = "X-Cache-Peer"
+
+// peerRequestHeaders aren't sent to the owner: the whole object is
+// wanted, and the client's debug and history headers only apply here.
+var peerRequestHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "X-Cache-Debug", "X-Proxy-As-Of"}
+
+// peerResponseHeaders are set by the owner for its own answer, and again by
+// this proxy for ours.
+var peerResponseHeaders = []string{"Via", "X-Cache", "X-Cache-Key", "X-Cache-Age", "X-Cache-TTL-Remaining"}
+
+type peer struct {
+	url string
+	// downUntil is when a peer that couldn't be reached gets asked again,
+	// in unix nanoseconds.
+	downUntil atomic.Int64
+}
+
+type cluster struct {
+	self  string
+	peers []*peer
+	ring  *hashring.Ring
+}
+
+// newCluster returns nil when cfg has no peers.
+func newCluster(cfg ClusterConfig) *cluster {
+	if len(cfg.Peers) == 0 {
+		return nil
+	}
+	c := &cluster{self: cfg.Self, ring: hashring.New(cfg.Peers)}
+	for _, u := range cfg.Peers {
+		c.peers = append(c.peers, &peer{url: u})
+	}
+	return c
+}
+
+// owner returns the peer to ask for key, or nil when this proxy owns it,
+// there's no cluster or the owner is down.
+func (c *cluster) owner(key string) *peer {
+	if c == nil {
+		return nil
+	}
+	p := c.peers[c.ring.Get(key)]
+	if p.url == c.self || time.Now().UnixNano() < p.downUntil.Load() {
+		return nil
+	}
+	return p
+}
+
+func isPeerRequest(r *http.Request) bool {
+	return r.Header.Get(peerHeader) != ""
+}
+
+// fetchFromPeer asks p for r's object. Only answers below 500 are used, the
+// origin is asked itself otherwise. A peer that can't be reached is left
+// alone for passiveRetryAfter, its keys going to the origin meanwhile.
+func (cps *Server) fetchFromPeer(ctx context.Context, r *http.Request, p *peer, path string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.URL.RawQuery = r.URL.RawQuery
+	// the owner builds the same key from the same request
+	req.Host = r.Host
+	forwardHeaders(req.Header, r.Header)
+	for _, h := range peerRequestHeaders {
+		req.Header.Del(h)
+	}
+	cps.config().Compression.setUpstreamEncoding(req.Header)
+	req.Header.Set(peerHeader, cps.cluster.self)
+	injectTrace(ctx, req.Header)
+
+	resp, err := cps.client.Do(req)
+	if err != nil {
+		p.downUntil.Store(time.Now().Add(passiveRetryAfter).UnixNano())
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || isStreamingResponse(resp) {
+		return nil, nil, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, h := range peerResponseHeaders {
+		resp.Header.Del(h)
+	}
+	if name := cps.config().CacheStatus.Header; name != "" {
+		resp.Header.Del(name)
+	}
+	slog.Debug("fetched from peer", "peer", p.url, "path", path)
+	return resp, body, nil
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// CompressionConfig gzips uncompressed text responses for clients that
+// accept it. Every client gets the encoding it asked for from the same
+// cache entry: gzipped on the way out, or gunzipped for clients that don't
+// take gzip.
+type CompressionConfig struct {
+	Gzip bool `json:"gzip"`
+	// UpstreamEncoding is the Accept-Encoding sent to origins instead of
+	// the client's, so there's one canonical entry per resource. With
+	// "gzip" entries are stored the way the origin compressed them, with
+	// "identity" they're stored uncompressed, as they always are with
+	// body_rewrite enabled.
+	UpstreamEncoding string `json:"upstream_encoding"`
+	// Level is a compress/gzip level, 1 to 9.
+	Level int `json:"level"`
+	// MinBytes is the smallest body worth compressing.
+	MinBytes int `json:"min_bytes"`
+	// Types are the compressible media types, "text/*" matching every
+	// text type.
+	Types []string `json:"types"`
+}
+
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+const (
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+func (c *CompressionConfig) validate() error {
+	switch c.UpstreamEncoding {
+	case "":
+		c.UpstreamEncoding = encodingGzip
+	case encodingGzip, encodingIdentity:
+	default:
+		return fmt.Errorf("compression: upstream_encoding must be %q or %q", encodingGzip, encodingIdentity)
+	}
+	if c.Level == 0 {
+		c.Level = gzip.DefaultCompression
+	}
+	if c.Level != gzip.DefaultCompression && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+		return fmt.Errorf("compression: level must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
+	}
+	if c.MinBytes < 0 {
+		return fmt.Errorf("compression: min_bytes must not be negative")
+	}
+	if c.MinBytes == 0 {
+		c.MinBytes = 1024
+	}
+	if c.Types == nil {
+		c.Types = defaultCompressTypes
+	}
+	return nil
+}
+
+// compressible tells whether a response with header h and a body of size
+// bytes is worth gzipping.
+func (c *CompressionConfig) compressible(h http.Header, size int) bool {
+	if !c.Gzip || size < c.MinBytes || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	return hasMediaType(h, c.Types)
+}
+
+// hasMediaType reports whether h's Content-Type is one of types, where
+// "text/*" matches every text type.
+func hasMediaType(h http.Header, types []string) bool {
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mt, prefix) || t == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// writeGzip writes body gzipped as the response, after status.
+func (cps *Server) writeGzip(w http.ResponseWriter, status int, body []byte) {
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the compressed bytes differ from what the origin tagged
+		h.Set("ETag", "W/"+etag)
+	}
+	w.WriteHeader(status)
+
+	level := cps.config().Compression.Level
+	// levels run from gzip.DefaultCompression, -1
+	pool := &cps.gzipWriters[level-gzip.DefaultCompression]
+	gz, _ := pool.Get().(*gzip.Writer)
+	if gz == nil {
+		gz, _ = gzip.NewWriterLevel(w, level)
+	} else {
+		gz.Reset(w)
+	}
+	gz.Write(body)
+	gz.Close()
+	pool.Put(gz)
+}
+
+// setUpstreamEncoding sets the canonical Accept-Encoding on the origin
+// request h. With identity it's left to the transport, which asks for gzip
+// and decompresses the response itself.
+func (c *CompressionConfig) setUpstreamEncoding(h http.Header) {
+	if c.UpstreamEncoding == encodingGzip {
+		h.Set("Accept-Encoding", encodingGzip)
+	}
+}
+
+// gunzipEntry returns val decompressed, for clients that don't accept the
+// gzip encoding it was stored with.
+func gunzipEntry(val *cache.Entry) (*cache.Entry, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(val.Body))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	out := *val
+	out.Body = body
+	out.Headers = val.Headers.Clone()
+	out.Headers.Del("Content-Encoding")
+	out.Headers.Del("Content-Length")
+	if etag := out.Headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		out.Headers.Set("ETag", "W/"+etag)
+	}
+	return &out, nil
+}
+
+// acceptsEncoding tells whether r's Accept-Encoding allows coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	ok := false
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.TrimSpace(name)
+			if !strings.EqualFold(name, coding) && name != "*" {
+				continue
+			}
+			q := 1.0
+			if qs, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				q, _ = strconv.ParseFloat(qs, 64)
+			}
+			if strings.EqualFold(name, coding) {
+				// an explicit q for the coding wins over "*"
+				return q > 0
+			}
+			ok = q > 0
+		}
+	}
+	return ok
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A reloaded compression level applies to responses from then on.
+func TestGzipLevelReload(t *testing.T) {
+	cps := newTestServer(t, "http://127.0.0.1:1", func(cfg *Config) {
+		cfg.Compression.Level = gzip.BestSpeed
+	})
+	// byte 8 of a gzip header, XFL, is 4 for the fastest level and 2 for
+	// the best compression
+	xfl := func() byte {
+		rec := httptest.NewRecorder()
+		cps.writeGzip(rec, http.StatusOK, []byte("hello hello hello"))
+		return rec.Body.Bytes()[8]
+	}
+	if got := xfl(); got != 4 {
+		t.Fatalf("got XFL %d at level %d, want 4", got, gzip.BestSpeed)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Origin = "http://127.0.0.1:1"
+	cfg.Compression.Level = gzip.BestCompression
+	if err := cps.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := xfl(); got != 2 {
+		t.Errorf("got XFL %d after reloading level %d, want 2", got, gzip.BestCompression)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConcurrencyConfig caps the requests in flight to the origins, MaxInflight
+// across all of them and MaxInflightPerOrigin to each. Zero is no limit. A
+// request over a limit waits up to QueueTimeout for a slot, and is shed with
+// a 503 after that.
+type ConcurrencyConfig struct {
+	MaxInflight          int      `json:"max_inflight"`
+	MaxInflightPerOrigin int      `json:"max_inflight_per_origin"`
+	QueueTimeout         Duration `json:"queue_timeout"`
+}
+
+func (c *ConcurrencyConfig) validate() error {
+	if c.MaxInflight < 0 || c.MaxInflightPerOrigin < 0 || c.QueueTimeout < 0 {
+		return fmt.Errorf("concurrency: limits and queue_timeout must not be negative")
+	}
+	return nil
+}
+
+var errOverloaded = errors.New("too many requests in flight to the origin")
+
+// semaphore hands out a fixed number of slots. The nil semaphore has
+// infinitely many.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n == 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire takes a slot, waiting up to timeout for one to free up.
+func (s semaphore) acquire(ctx context.Context, timeout time.Duration) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	default:
+	}
+	if timeout == 0 {
+		return errOverloaded
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-t.C:
+		return errOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// acquireUpstream takes a global and an o slot for an origin request. The
+// returned release may be called more than once.
+func (cps *Server) acquireUpstream(ctx context.Context, o *origin) (func(), error) {
+	timeout := time.Duration(cps.config().Concurrency.QueueTimeout)
+	if err := cps.inflight.acquire(ctx, timeout); err != nil {
+		return nil, err
+	}
+	if err := o.inflight.acquire(ctx, timeout); err != nil {
+		cps.inflight.release()
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			o.inflight.release()
+			cps.inflight.release()
+		})
+	}, nil
+}
@@ -0,0 +1,820 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+	"github.com/assaidy/caching-proxy/pkg/s3"
+)
+
+// Duration is a time.Duration that reads and writes JSON as "10m", "1h30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config configures a Server. It's read from flags and a JSON file by
+// ParseConfig, or filled in by embedders starting from DefaultConfig.
+type Config struct {
+	// Port is the address to listen on: a host:port, unix:/path/to.sock or
+	// systemd[:name] for a socket passed by systemd socket activation. The
+	// admin and metrics addresses take the same forms.
+	Port   string `json:"port"`
+	Origin string `json:"origin"`
+	// ProxyProtocol expects a PROXY protocol header, as TCP load balancers
+	// send, on every connection to Port, and takes the client's address
+	// from it. Listeners set it each for themselves.
+	ProxyProtocol bool `json:"proxy_protocol"`
+	// H2C serves HTTP/2 without TLS on Port, see ListenerConfig.
+	H2C bool `json:"h2c"`
+	// Origins lists backends to balance over instead of a single Origin,
+	// with Balance "round-robin" or "least-conn".
+	Origins     []string          `json:"origins"`
+	Balance     string            `json:"balance"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	CacheTTL    Duration          `json:"ttl"`
+	// TTLJitter spreads every entry's TTL randomly by up to this fraction
+	// either way, 0.1 for ±10%, so entries cached together don't all
+	// expire together.
+	TTLJitter float64 `json:"ttl_jitter"`
+	// MaxObjectBytes is the largest response body that's cached, zero for no
+	// limit. MaxRequestBody is the largest request body accepted, larger
+	// ones are refused with a 413.
+	MaxObjectBytes int64        `json:"max_object_bytes"`
+	MaxRequestBody int64        `json:"max_request_body"`
+	Bypass         BypassConfig `json:"bypass"`
+	// RequestControls lets trusted clients bypass or refresh the cache for
+	// a request by header.
+	RequestControls RequestControlsConfig `json:"request_controls"`
+	// CacheMethods are the request methods served from the cache, GET and
+	// HEAD by default, requests of other methods are passed to the origin.
+	// HEAD is answered from cached GETs and a HEAD miss stores nothing.
+	// CacheStatuses are the response statuses stored.
+	CacheMethods  []string `json:"cache_methods"`
+	CacheStatuses []int    `json:"cache_statuses"`
+	// Key picks what cache keys are made of besides method and path.
+	// KeyFunc replaces it for embedders: its result stands for the method,
+	// path and query, the host namespace and route variants are still
+	// added. Refresh ahead can't rebuild requests from such keys and is
+	// off with a KeyFunc.
+	Key     KeyConfig                    `json:"key"`
+	KeyFunc func(r *http.Request) string `json:"-"`
+	// ViaName is how the proxy names itself in Via headers, and recognizes
+	// requests looping back to it. Proxies chained on purpose need names of
+	// their own.
+	ViaName string `json:"via_name"`
+	// DebugHeaders adds X-Cache-Key, X-Cache-Age and X-Cache-TTL-Remaining
+	// to every response. Clients can ask for them with X-Cache-Debug.
+	DebugHeaders bool `json:"debug_headers"`
+	// CacheStatus is the X-Cache header telling clients how they were
+	// answered.
+	CacheStatus CacheStatusConfig `json:"cache_status"`
+	// RequestIDHeader carries every request's ID, to find it in the logs of
+	// the proxy and the origin and in traces: the client's own when it sends
+	// one, a new one otherwise. It's passed on to the origin and sent back
+	// with the response. Empty disables request IDs.
+	RequestIDHeader string `json:"request_id_header"`
+	// RefreshAhead refetches the RefreshTop most hit entries this long
+	// before they expire. Zero disables refreshing.
+	RefreshAhead Duration `json:"refresh_ahead"`
+	RefreshTop   int      `json:"refresh_top"`
+	// RangeMiss is what a Range request that misses the cache does: "fetch"
+	// the whole object, cache it and answer from it, or "pass" the range to
+	// the origin and cache nothing. Hits always serve the range from the
+	// cached object.
+	RangeMiss string `json:"range_miss"`
+	// RateLimit limits requests per client IP. TrustedProxies are the IPs
+	// or CIDRs of proxies in front of this one, whose X-Forwarded-For is
+	// believed to find the client, for rate limits, the client lists and
+	// the access log. Without them the peer's address is the client's.
+	RateLimit      RateLimitConfig `json:"rate_limit"`
+	TrustedProxies []string        `json:"trusted_proxies"`
+	// AllowClients, when set, are the only client IPs or CIDRs answered,
+	// and DenyClients are refused whether allowed or not, both with 403.
+	AllowClients []string `json:"allow_clients"`
+	DenyClients  []string `json:"deny_clients"`
+	// Listeners are the addresses to listen on, each with what it serves.
+	// When set, Port, AdminAddr and MetricsAddr aren't used.
+	Listeners []ListenerConfig `json:"listeners"`
+	// AdminAddr is where the /_cache/ admin API listens. When empty it's
+	// served on Port next to the proxied traffic, and its read and purge
+	// groups need credentials there.
+	AdminAddr string `json:"admin_addr"`
+	// MetricsAddr is where Prometheus metrics are served on /metrics. They
+	// are also always available on the admin API as /_cache/metrics.
+	MetricsAddr string `json:"metrics_addr"`
+	// GRPCAddr is where the admin API is served over gRPC too, see package
+	// adminv1. It's off when empty.
+	GRPCAddr string `json:"grpc_addr"`
+	// AdminToken is the bearer token for admin endpoints that make the proxy
+	// do work, like warming, and the default token of every AdminAuth group.
+	AdminToken string          `json:"admin_token"`
+	AdminAuth  AdminAuthConfig `json:"admin_auth"`
+
+	// ShutdownTimeout is how long in-flight requests get to finish once the
+	// proxy is asked to stop.
+	ShutdownTimeout Duration      `json:"shutdown_timeout"`
+	Timeouts        TimeoutConfig `json:"timeouts"`
+
+	Upstream UpstreamConfig `json:"upstream"`
+	Retry    RetryConfig    `json:"retry"`
+	Hedge    HedgeConfig    `json:"hedge"`
+	Breaker  BreakerConfig  `json:"breaker"`
+	Shadow   ShadowConfig   `json:"shadow"`
+
+	Maintenance MaintenanceConfig `json:"maintenance"`
+	// Offline never contacts the origins: requests are answered from the
+	// cache, expired entries included, which are then kept for good, and
+	// misses get a 504. With an imported or warmed cache it serves recorded
+	// responses, e.g. for demos and air-gapped tests.
+	Offline bool `json:"offline"`
+	// Record fetches every request from the origin and keeps every
+	// response, whatever its TTL or cacheability, in this dir, the
+	// fixtures of e.g. an integration test. Replay serves strictly from
+	// such a dir, offline, leaving it as it is. Either replaces the cache.
+	Record string `json:"record"`
+	Replay string `json:"replay"`
+	// Compression gzips text responses toward clients.
+	Compression CompressionConfig `json:"compression"`
+	// RequestHeaders edit every request sent to the origin, e.g. adding an
+	// API key or stripping the clients' X-Internal-* headers.
+	// ResponseHeaders edit every proxied response, cached or not, as it's
+	// sent to the client.
+	RequestHeaders  HeaderRules `json:"request_headers"`
+	ResponseHeaders HeaderRules `json:"response_headers"`
+	// CORS answers preflights and adds the CORS headers at the proxy, for
+	// origins that don't.
+	CORS CORSConfig `json:"cors"`
+	// BodyRewrite points the origin's absolute URLs in text bodies at the
+	// proxy.
+	BodyRewrite BodyRewriteConfig `json:"body_rewrite"`
+	// Concurrency caps the requests in flight to the origins.
+	Concurrency ConcurrencyConfig `json:"concurrency"`
+
+	// LogLevel is debug, info, warn or error. LogFormat is "text" or "json".
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+	// AccessLog is written separately from the operational log above.
+	AccessLog AccessLogConfig `json:"access_log"`
+
+	CacheDir string `json:"cache_dir"`
+	// CacheS3 keeps the cache in an S3 bucket instead, shared by every
+	// proxy pointed at the same bucket and prefix.
+	CacheS3 *s3.Config `json:"cache_s3"`
+	// CacheMemcached keeps the cache on these memcached servers instead,
+	// given as host:port and spread over by consistent hashing.
+	CacheMemcached []string `json:"cache_memcached"`
+	// MemoryCacheBytes keeps up to this many bytes of the most recently
+	// used entries of the disk, S3 or memcached cache in memory too. Zero
+	// disables it. Memory copies live until they expire even if another
+	// instance sharing the cache purges them.
+	MemoryCacheBytes int64 `json:"memory_cache_bytes"`
+	// CacheSnapshot is a file the in-memory cache, or the memory copies of
+	// MemoryCacheBytes, is saved to on shutdown and loaded from on start,
+	// so a restart keeps what was hot. Disk cache hit counts are written
+	// back on shutdown either way.
+	CacheSnapshot string `json:"cache_snapshot"`
+	// IntegrityCheck is "read" to verify bodies on every read from the disk
+	// cache, or "startup" to verify them all once when the cache is opened.
+	IntegrityCheck string `json:"integrity_check"`
+	// CacheKeyFile holds the key to encrypt the disk cache with, see
+	// cache.LoadKey.
+	CacheKeyFile string `json:"cache_key_file"`
+
+	// ErrorBodies overrides the body sent for each kind of upstream failure:
+	// bad_gateway, timeout, circuit_open, internal, overloaded and offline.
+	ErrorBodies map[string]string `json:"error_bodies"`
+	ErrorPages  ErrorPagesConfig  `json:"error_pages"`
+
+	Routes []RouteConfig `json:"routes"`
+	// Hosts are sites picked by the Host header, each with its own origin,
+	// routes and cache namespace. Other hosts get Origin and Routes.
+	Hosts []HostConfig `json:"hosts"`
+
+	Cluster      ClusterConfig      `json:"cluster"`
+	Invalidation InvalidationConfig `json:"invalidation"`
+	Degradation  DegradationConfig  `json:"degradation"`
+	History      HistoryConfig      `json:"history"`
+	Sampling     SamplingConfig     `json:"sampling"`
+	Webhooks     WebhooksConfig     `json:"webhooks"`
+
+	ConfigFile string `json:"-"`
+	SkipChecks bool   `json:"-"`
+	// Hooks let embedders intercept requests, see Hooks.
+	Hooks []Hooks `json:"-"`
+	// LoadConfig rereads the config for reloads asked over the gRPC admin
+	// API, which fail without it.
+	LoadConfig func() (Config, error) `json:"-"`
+
+	trustedNets []*net.IPNet
+	allowNets   []*net.IPNet
+	denyNets    []*net.IPNet
+}
+
+type RouteConfig struct {
+	// Path is matched exactly, or as a prefix when it ends with '*'.
+	// Pattern is a regular expression matched against the path instead.
+	Path     string `json:"path"`
+	Pattern  string `json:"pattern"`
+	Priority string `json:"priority"`
+	// Origin is where the route's requests go instead of the default
+	// origin, or Origins for several backends balanced as Balance says.
+	Origin  string   `json:"origin"`
+	Origins []string `json:"origins"`
+	Balance string   `json:"balance"`
+	// Canary splits the route's traffic with a new version of its origin.
+	Canary *CanaryConfig `json:"canary"`
+	// StripPrefix removes a leading part of the path before it's sent to
+	// the origin and Rewrite then rewrites what's left, so the public URLs
+	// needn't match the origin's. Cache keys keep the public path.
+	StripPrefix string       `json:"strip_prefix"`
+	Rewrite     *PathRewrite `json:"rewrite"`
+	// TTL overrides how long the route's responses are cached. NoCache
+	// sends every request to the origin and stores nothing, and
+	// MaxObjectBytes overrides the largest body that's cached.
+	TTL            Duration `json:"ttl"`
+	NoCache        bool     `json:"no_cache"`
+	MaxObjectBytes int64    `json:"max_object_bytes"`
+	// AllowCredentials caches the route's responses even for requests with
+	// credentials, for content that's the same for every user.
+	AllowCredentials bool `json:"allow_credentials"`
+	// CacheSetCookie caches responses that set cookies, which are never
+	// cached otherwise. The cached copy is stored without its Set-Cookie
+	// headers, only the client the response was fetched for gets them.
+	CacheSetCookie bool `json:"cache_set_cookie"`
+	// TrailingSlash is "strip" or "add" to make "/a", "/a/" and "//a" share
+	// one cache entry. With CanonicalRedirect clients are sent a 301 to the
+	// canonical path instead of being served under the other spellings.
+	TrailingSlash     string `json:"trailing_slash"`
+	CanonicalRedirect bool   `json:"canonical_redirect"`
+	// Languages makes the route vary on Accept-Language, normalized to a
+	// fixed set of locales.
+	Languages *LanguageConfig `json:"languages"`
+	// ClientHints makes the route vary on normalized device client hints.
+	ClientHints *ClientHintsConfig `json:"client_hints"`
+	// SampleRate is the fraction of origin responses archived to the
+	// sampling bucket, e.g. 0.01 for 1%.
+	SampleRate float64 `json:"sample_rate"`
+	// RateLimit limits each client on this route, on top of the proxy wide
+	// limit.
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+	// Key overrides the proxy wide key rules for the route.
+	Key *KeyConfig `json:"key"`
+	// CachePost caches POST requests too, keyed by a hash of their body,
+	// e.g. for a read-only GraphQL API. JSON bodies are normalized first,
+	// and GraphQL mutations always go to the origin.
+	CachePost bool `json:"cache_post"`
+	// FinishOnDisconnect lets an origin fetch for a cacheable request
+	// finish and be cached when the client goes away, for responses that
+	// are expensive to produce, and past the request timeout too. Otherwise
+	// the fetch is cancelled.
+	FinishOnDisconnect bool `json:"finish_on_disconnect"`
+	// RequestHeaders edit the route's requests to the origin and
+	// ResponseHeaders its responses, after the proxy wide rules.
+	RequestHeaders  *HeaderRules `json:"request_headers"`
+	ResponseHeaders *HeaderRules `json:"response_headers"`
+
+	re *regexp.Regexp
+}
+
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+)
+
+// name identifies the route in errors.
+func (rc *RouteConfig) name() string {
+	if rc.Pattern != "" {
+		return rc.Pattern
+	}
+	return rc.Path
+}
+
+// PathRewrite replaces what Pattern matches in the path with With, where $1
+// and up are the pattern's groups.
+type PathRewrite struct {
+	Pattern string `json:"pattern"`
+	With    string `json:"with"`
+
+	re *regexp.Regexp
+}
+
+// originPath returns the path the origin is asked for path. A nil route
+// leaves it as it is.
+func (rc *RouteConfig) originPath(path string) string {
+	if rc == nil {
+		return path
+	}
+	if rc.StripPrefix != "" {
+		if rest, ok := strings.CutPrefix(path, rc.StripPrefix); ok {
+			path = rest
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+		}
+	}
+	if rc.Rewrite != nil {
+		path = rc.Rewrite.re.ReplaceAllString(path, rc.Rewrite.With)
+	}
+	return path
+}
+
+func (rc *RouteConfig) matches(path string) bool {
+	if rc.re != nil {
+		return rc.re.MatchString(path)
+	}
+	if prefix, ok := strings.CutSuffix(rc.Path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == rc.Path
+}
+
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Port, "port", ":8080", "address to listen on: host:port, unix:/path/to.sock or systemd[:name]")
+	fs.StringVar(&c.Port, "listen", ":8080", "same as -port")
+	fs.BoolVar(&c.H2C, "h2c", false, "serve HTTP/2 without TLS on -port, to clients that know to use it")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", false, "expect a PROXY protocol v1 or v2 header on every connection to -port, from a TCP load balancer")
+	fs.StringVar(&c.Origin, "origin", "http://dummyjson.com", "origin server to forward requests to")
+	fs.StringVar(&c.Balance, "balance", balanceRoundRobin, "how to balance over several origins: round-robin or least-conn")
+	fs.DurationVar((*time.Duration)(&c.CacheTTL), "ttl", 1*time.Hour, "how long responses are kept in the cache")
+	fs.Float64Var(&c.TTLJitter, "ttl-jitter", 0, "fraction to randomly spread TTLs by either way, e.g. 0.1 for ±10%")
+	fs.DurationVar((*time.Duration)(&c.ShutdownTimeout), "shutdown-timeout", 30*time.Second, "how long in-flight requests get to finish on shutdown")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.Read), "read-timeout", 30*time.Second, "how long a client gets to send its request")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.Write), "write-timeout", 90*time.Second, "how long answering a request may take, origin fetch included")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.Idle), "idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.Request), "request-timeout", 0, "how long a proxied request may take in all, 0 for no limit")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.OriginDial), "origin-dial-timeout", 5*time.Second, "how long connecting to the origin may take")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.OriginResponseHeader), "origin-header-timeout", 30*time.Second, "how long to wait for the origin's response headers")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.OriginTotal), "origin-timeout", time.Minute, "how long a whole origin request, body included, may take")
+	fs.IntVar(&c.Upstream.MaxIdleConnsPerHost, "max-idle-conns-per-host", 64, "idle keep-alive connections kept per origin host")
+	fs.IntVar(&c.Upstream.MaxIdleConns, "max-idle-conns", 256, "idle keep-alive connections kept across all origin hosts")
+	fs.IntVar(&c.Upstream.MaxConnsPerHost, "max-conns-per-host", 0, "connections allowed per origin host, 0 for no limit")
+	fs.DurationVar((*time.Duration)(&c.Upstream.IdleConnTimeout), "idle-conn-timeout", 90*time.Second, "how long idle origin connections are kept")
+	fs.DurationVar((*time.Duration)(&c.Upstream.KeepAlive), "upstream-keep-alive", 30*time.Second, "TCP keep-alive interval for origin connections")
+	fs.BoolVar(&c.Upstream.HTTP2, "upstream-http2", true, "speak HTTP/2 to TLS origins that support it, HTTP/1.1 when false")
+	fs.StringVar(&c.Upstream.Proxy, "upstream-proxy", "", "http://, https:// or socks5:// proxy to reach origins through, HTTPS_PROXY and HTTP_PROXY when empty")
+	fs.Var((*stringList)(&c.Upstream.NoProxy), "upstream-no-proxy", "comma separated hosts, .domains and CIDRs reached without -upstream-proxy")
+	fs.DurationVar((*time.Duration)(&c.Upstream.DNS.CacheTTL), "dns-cache-ttl", 0, "how long origin DNS answers are cached, and kept past while lookups fail, 0 to not cache")
+	fs.DurationVar((*time.Duration)(&c.Upstream.DNS.Refresh), "dns-refresh", 0, "how often origin hosts are looked up again, following DNS failovers, 0 to not")
+	fs.StringVar(&c.Upstream.DNS.Resolver, "dns-resolver", "", "host:port of a DNS server to look origins up with instead of the system's")
+	fs.BoolVar(&c.Upstream.H2C, "upstream-h2c", false, "speak HTTP/2 without TLS to http:// origins")
+	fs.DurationVar((*time.Duration)(&c.Upstream.HTTP2PingInterval), "upstream-http2-ping-interval", 30*time.Second, "ping HTTP/2 origin connections silent this long, 0 to not ping")
+	fs.DurationVar((*time.Duration)(&c.Upstream.HTTP2PingTimeout), "upstream-http2-ping-timeout", 15*time.Second, "close HTTP/2 origin connections not answering a ping this fast")
+	fs.IntVar(&c.Retry.Attempts, "retries", 2, "how many times a failed idempotent origin request is retried")
+	fs.DurationVar((*time.Duration)(&c.Retry.Backoff), "retry-backoff", 100*time.Millisecond, "wait before the first retry, doubling after each")
+	fs.DurationVar((*time.Duration)(&c.Retry.MaxBackoff), "retry-max-backoff", 2*time.Second, "longest wait between retries")
+	fs.BoolVar(&c.Retry.StaleOnError, "stale-on-error", true, "serve expired entries when the origin keeps failing")
+	fs.DurationVar((*time.Duration)(&c.Hedge.Delay), "hedge-delay", 0, "send GET requests to the origin again when it hasn't answered after this long, 0 to not")
+	fs.Float64Var(&c.Hedge.Percentile, "hedge-percentile", 0, "hedge after this percentile of the origin's recent latencies instead, e.g. 0.95")
+	fs.BoolVar(&c.Offline, "offline", false, "serve only from the cache, expired entries included, never contacting the origin")
+	fs.StringVar(&c.Record, "record", "", "dir to record every origin response into as a fixture, fetching every request")
+	fs.StringVar(&c.Replay, "replay", "", "dir of recorded fixtures to serve strictly from, offline")
+	fs.BoolVar(&c.Maintenance.Enabled, "maintenance", false, "start in maintenance mode, answering with a 503")
+	fs.StringVar(&c.Shadow.Origin, "shadow-origin", "", "second origin to mirror requests to in the background, its answers discarded")
+	fs.Float64Var(&c.Shadow.Rate, "shadow-rate", 1, "fraction of requests mirrored to -shadow-origin")
+	fs.Float64Var(&c.Breaker.ErrorRate, "breaker-error-rate", 0.5, "fraction of failing origin requests that opens the circuit, 0 to disable")
+	fs.DurationVar((*time.Duration)(&c.Breaker.CoolDown), "breaker-cool-down", 30*time.Second, "how long the circuit stays open before probing the origin")
+	fs.IntVar(&c.Concurrency.MaxInflight, "max-inflight", 0, "origin requests allowed in flight at once, 0 for no limit")
+	fs.IntVar(&c.Concurrency.MaxInflightPerOrigin, "max-inflight-per-origin", 0, "requests allowed in flight to each origin at once, 0 for no limit")
+	fs.DurationVar((*time.Duration)(&c.Concurrency.QueueTimeout), "queue-timeout", 0, "how long a request over the in-flight limit waits before it's shed with a 503")
+	fs.Int64Var(&c.MaxObjectBytes, "max-object-size", 0, "largest response body to cache in bytes, 0 for no limit")
+	fs.Int64Var(&c.MaxRequestBody, "max-request-body", 0, "largest request body accepted in bytes, 0 for no limit")
+	fs.BoolVar(&c.Bypass.Authorization, "bypass-authorization", true, "bypass the cache for requests with an Authorization header")
+	fs.StringVar(&c.RequestControls.Secret, "request-control-secret", "", "secret clients send in X-Cache-Secret to use X-Cache-Bypass and X-Cache-Refresh")
+	fs.Var((*stringList)(&c.RequestControls.Allow), "request-control-clients", "comma separated client IPs or CIDRs allowed to use X-Cache-Bypass and X-Cache-Refresh")
+	fs.Float64Var(&c.RateLimit.Rate, "rate-limit", 0, "requests per second allowed per client IP, 0 for no limit")
+	fs.IntVar(&c.RateLimit.Burst, "rate-burst", 0, "requests a client may send at once above -rate-limit, defaults to the rate")
+	fs.DurationVar((*time.Duration)(&c.RefreshAhead), "refresh-ahead", 0, "refetch hot entries this long before they expire, 0 to disable")
+	fs.IntVar(&c.RefreshTop, "refresh-top", 100, "how many of the most hit entries -refresh-ahead keeps fresh")
+	fs.StringVar(&c.RangeMiss, "range-miss", rangeMissFetch, "what Range requests missing the cache do: fetch the whole object or pass the range to the origin")
+	fs.BoolVar(&c.Compression.Gzip, "gzip", false, "gzip uncompressed text responses for clients that accept it")
+	fs.BoolVar(&c.BodyRewrite.Enabled, "body-rewrite", false, "rewrite the origin's URLs in text bodies to the proxy's before caching them")
+	fs.StringVar(&c.BodyRewrite.PublicURL, "public-url", "", "the proxy's public base URL for -body-rewrite, defaults to each request's scheme and Host, whose rewritten bodies aren't cached")
+	fs.StringVar(&c.Compression.UpstreamEncoding, "upstream-encoding", encodingGzip, "Accept-Encoding sent to origins: gzip to cache compressed responses, or identity, always identity with -body-rewrite")
+	fs.StringVar(&c.ViaName, "via-name", defaultViaName, "name of the proxy in Via headers, distinct for every proxy in a chain")
+	fs.BoolVar(&c.DebugHeaders, "debug-headers", false, "add X-Cache-Key, X-Cache-Age and X-Cache-TTL-Remaining to every response")
+	fs.StringVar(&c.CacheStatus.Header, "cache-status-header", defaultCacheStatusHeader, "header telling clients how the cache answered, empty to not")
+	fs.BoolVar(&c.CacheStatus.Detailed, "cache-status-detailed", false, "report EXPIRED and REVALIDATED misses apart instead of as MISS")
+	fs.StringVar(&c.RequestIDHeader, "request-id-header", defaultRequestIDHeader, "header carrying each request's ID to the origin and back, empty to not")
+	fs.StringVar(&c.AdminAddr, "admin-addr", "", "separate address for the /_cache/ admin API, defaults to -port")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", "", "separate address to serve Prometheus /metrics on")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", "", "address to serve the admin API over gRPC on")
+	fs.StringVar(&c.CacheDir, "cache-dir", "", "directory to persist the cache in, in-memory only when empty")
+	fs.Var((*stringList)(&c.CacheMemcached), "cache-memcached", "comma separated memcached servers to keep the cache on")
+	fs.Int64Var(&c.MemoryCacheBytes, "memory-cache-size", 0, "bytes of hot disk, S3 or memcached cache entries to also keep in memory, 0 to disable")
+	fs.StringVar(&c.CacheSnapshot, "cache-snapshot", "", "file to save the in-memory cache to on shutdown and load it from on start")
+	fs.Var((*stringList)(&c.TrustedProxies), "trusted-proxies", "comma separated IPs or CIDRs of proxies in front of this one, whose X-Forwarded-For is believed")
+	fs.Var((*stringList)(&c.AllowClients), "allow-clients", "comma separated client IPs or CIDRs that are the only ones answered")
+	fs.Var((*stringList)(&c.DenyClients), "deny-clients", "comma separated client IPs or CIDRs refused with 403")
+	fs.Var((*stringList)(&c.CORS.AllowedOrigins), "cors-origins", "comma separated origins allowed to call through the proxy by CORS, * for any")
+	fs.Var((*stringList)(&c.Cluster.Peers), "peers", "comma separated base URLs of every proxy in the cluster, this one included")
+	fs.StringVar(&c.Cluster.Self, "self", "", "this proxy's base URL among -peers")
+	fs.StringVar(&c.Invalidation.Redis, "invalidation-redis", "", "redis:// URL to publish purges on and apply other proxies' purges from")
+	fs.StringVar(&c.Invalidation.Channel, "invalidation-channel", "caching-proxy:invalidate", "Redis channel purges are published on")
+	fs.Var((*stringList)(&c.Webhooks.URLs), "webhooks", "comma separated URLs to post origin_down, circuit_open, cache_full and purge_completed events to")
+	fs.IntVar(&c.Webhooks.Retries, "webhook-retries", 3, "how many times a failed webhook post is tried again")
+	fs.StringVar(&c.IntegrityCheck, "integrity-check", cache.VerifyOnRead, "when to verify cached bodies on disk: read or startup")
+	fs.StringVar(&c.CacheKeyFile, "cache-key-file", "", "file with a key to encrypt the disk cache with, defaults to $"+cache.KeyEnv)
+	fs.StringVar(&c.LogLevel, "log-level", "info", "minimum level to log: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", logFormatText, "log format: text or json")
+	fs.StringVar(&c.AccessLog.Path, "access-log", "", "file to write an access log of proxied requests to")
+	fs.StringVar(&c.AccessLog.Format, "access-log-format", accessLogCombined, "access log format: combined or json")
+	fs.StringVar(&c.ConfigFile, "config", "", "path to a JSON config file, flags given explicitly override it")
+}
+
+// DefaultConfig returns the Config the command line flags default to.
+func DefaultConfig() Config {
+	var cfg Config
+	cfg.bindFlags(flag.NewFlagSet("", flag.ContinueOnError))
+	return cfg
+}
+
+// ParseConfig binds the proxy's flags to cfg and parses args into it,
+// loading the -config file if one is given. Flags set on the command line
+// win over values from the file.
+func ParseConfig(fs *flag.FlagSet, cfg *Config, args []string) error {
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cfg.ConfigFile == "" {
+		return cfg.validate()
+	}
+
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	data, err := os.ReadFile(cfg.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read config file. error: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("couldn't parse config file %s. error: %v", cfg.ConfigFile, err)
+	}
+	for name, val := range explicit {
+		fs.Set(name, val)
+	}
+	return cfg.validate()
+}
+
+func (c *Config) validate() error {
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("ttl must be greater than zero")
+	}
+	if c.TTLJitter < 0 || c.TTLJitter >= 1 {
+		return fmt.Errorf("ttl_jitter must be at least 0 and less than 1")
+	}
+	if len(c.Origins) > 0 {
+		// -origin always has a value, the list wins
+		c.Origin = ""
+	}
+	if err := validateOrigins(c.Origin, c.Origins, &c.Balance); err != nil {
+		return err
+	}
+	if err := c.HealthCheck.validate(); err != nil {
+		return err
+	}
+	if c.MaxObjectBytes < 0 || c.MaxRequestBody < 0 || c.MemoryCacheBytes < 0 {
+		return fmt.Errorf("max_object_bytes, max_request_body and memory_cache_bytes must not be negative")
+	}
+	if err := c.Bypass.validate(); err != nil {
+		return err
+	}
+	if err := c.RequestControls.validate(); err != nil {
+		return err
+	}
+	if err := c.validateCacheable(); err != nil {
+		return err
+	}
+	if err := c.Key.validate(); err != nil {
+		return err
+	}
+	if err := validateViaName(c.ViaName); err != nil {
+		return err
+	}
+	if err := c.CacheStatus.validate(); err != nil {
+		return err
+	}
+	if err := validateRequestIDHeader(c.RequestIDHeader); err != nil {
+		return err
+	}
+	if c.RefreshAhead < 0 || c.RefreshTop < 0 {
+		return fmt.Errorf("refresh_ahead and refresh_top must not be negative")
+	}
+	if c.RefreshTop == 0 {
+		c.RefreshTop = 100
+	}
+	if c.RefreshAhead >= c.CacheTTL {
+		return fmt.Errorf("refresh_ahead must be shorter than ttl")
+	}
+	switch c.RangeMiss {
+	case rangeMissFetch, rangeMissPass:
+	default:
+		return fmt.Errorf("range_miss must be %q or %q", rangeMissFetch, rangeMissPass)
+	}
+	if err := c.Compression.validate(); err != nil {
+		return err
+	}
+	if err := c.Concurrency.validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	nets, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	c.trustedNets = nets
+	if c.allowNets, err = parseCIDRs(c.AllowClients); err != nil {
+		return fmt.Errorf("allow_clients: %v", err)
+	}
+	if c.denyNets, err = parseCIDRs(c.DenyClients); err != nil {
+		return fmt.Errorf("deny_clients: %v", err)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative")
+	}
+	if err := c.Breaker.validate(); err != nil {
+		return err
+	}
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+	if err := c.Hedge.validate(); err != nil {
+		return err
+	}
+	if err := c.Shadow.validate(); err != nil {
+		return err
+	}
+	if err := c.Maintenance.validate(); err != nil {
+		return err
+	}
+	if err := c.CORS.validate(); err != nil {
+		return err
+	}
+	if err := c.BodyRewrite.validate(); err != nil {
+		return err
+	}
+	if c.BodyRewrite.Enabled {
+		// -upstream-encoding always has a value, and compressed bodies
+		// can't be rewritten
+		c.Compression.UpstreamEncoding = encodingIdentity
+	}
+	if err := c.RequestHeaders.validate(); err != nil {
+		return fmt.Errorf("request_headers: %v", err)
+	}
+	if err := c.ResponseHeaders.validate(); err != nil {
+		return fmt.Errorf("response_headers: %v", err)
+	}
+	if err := c.Upstream.validate(); err != nil {
+		return err
+	}
+	for _, addr := range []string{c.Port, c.AdminAddr, c.MetricsAddr, c.GRPCAddr} {
+		if addr == "" {
+			continue
+		}
+		if err := validateListenAddr(addr); err != nil {
+			return err
+		}
+	}
+	for i := range c.Listeners {
+		if err := c.Listeners[i].validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Timeouts.validate(); err != nil {
+		return err
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		return fmt.Errorf("log_format must be %q or %q", logFormatText, logFormatJSON)
+	}
+	if c.sharedCache() && c.CacheDir != "" || c.CacheS3 != nil && len(c.CacheMemcached) > 0 {
+		return fmt.Errorf("set only one of cache_dir, cache_s3 and cache_memcached")
+	}
+	if err := c.validateFixtures(); err != nil {
+		return err
+	}
+	if c.CacheSnapshot != "" && (c.CacheDir != "" || c.sharedCache()) && c.MemoryCacheBytes == 0 {
+		return fmt.Errorf("cache_snapshot needs the in-memory cache, or memory_cache_bytes with cache_dir, cache_s3 or cache_memcached")
+	}
+	for _, addr := range c.CacheMemcached {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("cache_memcached: invalid server %q: %v", addr, err)
+		}
+	}
+	if c.CacheS3 != nil {
+		if err := c.CacheS3.Validate(); err != nil {
+			return fmt.Errorf("cache_s3: %v", err)
+		}
+	}
+	if c.IntegrityCheck != cache.VerifyOnRead && c.IntegrityCheck != cache.VerifyOnStartup {
+		return fmt.Errorf("integrity_check must be %q or %q", cache.VerifyOnRead, cache.VerifyOnStartup)
+	}
+	if err := c.ErrorPages.validate(); err != nil {
+		return err
+	}
+	for name := range c.ErrorBodies {
+		if !slices.Contains(upstreamErrorNames[:], name) {
+			return fmt.Errorf("error_bodies: unknown kind %q", name)
+		}
+	}
+	for i := range c.Routes {
+		if err := c.validateRoute(&c.Routes[i], i); err != nil {
+			return err
+		}
+	}
+	for i := range c.Hosts {
+		if err := c.validateHost(&c.Hosts[i], i); err != nil {
+			return err
+		}
+	}
+	if err := c.Cluster.validate(); err != nil {
+		return err
+	}
+	if err := c.Invalidation.validate(); err != nil {
+		return err
+	}
+	if err := c.Webhooks.validate(); err != nil {
+		return err
+	}
+	if err := c.AccessLog.validate(); err != nil {
+		return err
+	}
+	if err := c.AdminAuth.validate(c.AdminToken, c.adminIsPublic()); err != nil {
+		return err
+	}
+	if err := c.History.validate(); err != nil {
+		return err
+	}
+	if c.Sampling.S3 != nil {
+		if err := c.Sampling.S3.Validate(); err != nil {
+			return fmt.Errorf("sampling: %v", err)
+		}
+	}
+	return c.Degradation.validate()
+}
+
+func (c *Config) validateRoute(rc *RouteConfig, i int) error {
+	switch {
+	case rc.Path == "" && rc.Pattern == "":
+		return fmt.Errorf("route %d: path or pattern is required", i)
+	case rc.Path != "" && rc.Pattern != "":
+		return fmt.Errorf("route %s: set either path or pattern, not both", rc.name())
+	case rc.Pattern != "":
+		re, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return fmt.Errorf("route %d: invalid pattern: %v", i, err)
+		}
+		rc.re = re
+	}
+	if rc.Origin != "" {
+		if err := validateOriginURL(rc.Origin); err != nil {
+			return fmt.Errorf("route %s: %v", rc.name(), err)
+		}
+	}
+	if err := validateOrigins(rc.Origin, rc.Origins, &rc.Balance); err != nil {
+		return fmt.Errorf("route %s: %v", rc.name(), err)
+	}
+	if rc.Canary != nil {
+		if err := rc.Canary.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", rc.name(), err)
+		}
+	}
+	if rc.TTL < 0 || rc.MaxObjectBytes < 0 {
+		return fmt.Errorf("route %s: ttl and max_object_bytes must not be negative", rc.name())
+	}
+	switch rc.Priority {
+	case "":
+		rc.Priority = priorityNormal
+	case priorityLow, priorityNormal:
+	default:
+		return fmt.Errorf("route %s: unknown priority %q", rc.name(), rc.Priority)
+	}
+	switch rc.TrailingSlash {
+	case slashKeep, slashStrip, slashAdd:
+	default:
+		return fmt.Errorf("route %s: trailing_slash must be %q or %q", rc.name(), slashStrip, slashAdd)
+	}
+	if rc.CanonicalRedirect && rc.TrailingSlash == slashKeep {
+		return fmt.Errorf("route %s: canonical_redirect needs a trailing_slash policy", rc.name())
+	}
+	if rc.RateLimit != nil {
+		if err := rc.RateLimit.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", rc.name(), err)
+		}
+	}
+	if rc.Key != nil {
+		if err := rc.Key.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", rc.name(), err)
+		}
+	}
+	if rc.SampleRate < 0 || rc.SampleRate > 1 {
+		return fmt.Errorf("route %s: sample_rate must be between 0 and 1", rc.name())
+	}
+	if rc.SampleRate > 0 && c.Sampling.S3 == nil {
+		return fmt.Errorf("route %s: sample_rate needs sampling.s3 configured", rc.name())
+	}
+	if rc.Languages != nil {
+		if err := rc.Languages.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", rc.name(), err)
+		}
+	}
+	if rc.ClientHints != nil {
+		if err := rc.ClientHints.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", rc.name(), err)
+		}
+	}
+	if rc.Rewrite != nil {
+		re, err := regexp.Compile(rc.Rewrite.Pattern)
+		if err != nil {
+			return fmt.Errorf("route %s: rewrite: invalid pattern: %v", rc.name(), err)
+		}
+		rc.Rewrite.re = re
+	}
+	if rc.RequestHeaders != nil {
+		if err := rc.RequestHeaders.validate(); err != nil {
+			return fmt.Errorf("route %s: request_headers: %v", rc.name(), err)
+		}
+	}
+	if rc.ResponseHeaders != nil {
+		if err := rc.ResponseHeaders.validate(); err != nil {
+			return fmt.Errorf("route %s: response_headers: %v", rc.name(), err)
+		}
+	}
+	return nil
+}
+
+// sharedCache reports whether the cache lives on servers shared with other
+// instances.
+func (c *Config) sharedCache() bool {
+	return c.CacheS3 != nil || len(c.CacheMemcached) > 0
+}
+
+// stringList is a flag holding a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// jitter spreads ttl by up to TTLJitter either way.
+func (c *Config) jitter(ttl time.Duration) time.Duration {
+	if c.TTLJitter == 0 {
+		return ttl
+	}
+	return time.Duration(float64(ttl) * (1 + c.TTLJitter*(2*rand.Float64()-1)))
+}
+
+// route returns the first route matching path, or nil. Duplicate slashes in
+// path are ignored for matching.
+func (c *Config) route(path string) *RouteConfig {
+	return matchRoute(c.Routes, path)
+}
+
+func matchRoute(routes []RouteConfig, path string) *RouteConfig {
+	path = collapseSlashes(path)
+	for i := range routes {
+		if routes[i].matches(path) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	bypassHeader        = "X-Cache-Bypass"
+	refreshHeader       = "X-Cache-Refresh"
+	controlSecretHeader = "X-Cache-Secret"
+)
+
+const (
+	controlBypass  = "bypass"
+	controlRefresh = "refresh"
+)
+
+// RequestControlsConfig lets trusted clients steer the cache for a single
+// request, to debug it or bust one URL: "X-Cache-Bypass: 1" sends the
+// request to the origin with its headers and stores nothing, like a
+// bypassed request, and "X-Cache-Refresh: 1" skips the lookup and replaces
+// the cached copy with what the origin answers. Clients are trusted when
+// their IP is in Allow or they send Secret in X-Cache-Secret. The headers
+// are ignored otherwise, and never passed on to the origin.
+type RequestControlsConfig struct {
+	Secret string   `json:"secret"`
+	Allow  []string `json:"allow"`
+
+	allowNets []*net.IPNet
+}
+
+func (c *RequestControlsConfig) validate() error {
+	nets, err := parseCIDRs(c.Allow)
+	if err != nil {
+		return fmt.Errorf("request_controls: %v", err)
+	}
+	c.allowNets = nets
+	return nil
+}
+
+func (c *RequestControlsConfig) enabled() bool {
+	return c.Secret != "" || len(c.allowNets) > 0
+}
+
+// take returns controlBypass or controlRefresh when r, from client, asks
+// for it and is trusted to, "" otherwise. The control headers are removed
+// from r either way.
+func (c *RequestControlsConfig) take(r *http.Request, client string) string {
+	bypass, refresh := isOn(r.Header.Get(bypassHeader)), isOn(r.Header.Get(refreshHeader))
+	secret := r.Header.Get(controlSecretHeader)
+	r.Header.Del(bypassHeader)
+	r.Header.Del(refreshHeader)
+	r.Header.Del(controlSecretHeader)
+	if !bypass && !refresh || !c.enabled() {
+		return ""
+	}
+	trusted := ipAllowed(c.allowNets, client) ||
+		c.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) == 1
+	switch {
+	case !trusted:
+		return ""
+	case bypass:
+		return controlBypass
+	default:
+		return controlRefresh
+	}
+}
+
+func isOn(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig answers CORS preflight requests at the proxy and adds the CORS
+// headers to every response, cached or not, so pages on AllowedOrigins can
+// call through the proxy without the origin knowing about CORS. "*" in
+// AllowedOrigins allows every origin, and in AllowedHeaders whatever
+// headers the preflight asks for. It's off without AllowedOrigins.
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how long browsers may cache a preflight's answer.
+	MaxAge Duration `json:"max_age"`
+}
+
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+func (c *CORSConfig) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return nil
+	}
+	for i, o := range c.AllowedOrigins {
+		if o != "*" && !strings.Contains(o, "://") {
+			return fmt.Errorf("cors: allowed origin %q must be a scheme://host[:port] or *", o)
+		}
+		c.AllowedOrigins[i] = strings.TrimSuffix(o, "/")
+	}
+	if c.AllowedMethods == nil {
+		c.AllowedMethods = defaultCORSMethods
+	}
+	for i, m := range c.AllowedMethods {
+		c.AllowedMethods[i] = strings.ToUpper(m)
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("cors: max_age must not be negative")
+	}
+	return nil
+}
+
+// allowed returns r's Origin when it's allowed, "" otherwise.
+func (c *CORSConfig) allowed(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !slices.Contains(c.AllowedOrigins, "*") && !slices.Contains(c.AllowedOrigins, origin) {
+		return ""
+	}
+	return origin
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setHeaders sets the CORS headers of a response to origin, replacing any
+// the origin server sent.
+func (c *CORSConfig) setHeaders(h http.Header, origin string) {
+	if slices.Contains(c.AllowedOrigins, "*") && !c.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		addVary(h, "Origin")
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+// answerPreflight answers the preflight r from origin.
+func (c *CORSConfig) answerPreflight(w http.ResponseWriter, r *http.Request, origin string) {
+	h := w.Header()
+	c.setHeaders(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	if slices.Contains(c.AllowedHeaders, "*") {
+		if asked := r.Header.Get("Access-Control-Request-Headers"); asked != "" {
+			h.Set("Access-Control-Allow-Headers", asked)
+		}
+	} else if len(c.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge).Seconds())))
+	}
+	addVary(h, "Access-Control-Request-Method", "Access-Control-Request-Headers")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// dashboardHTML is the admin dashboard, a single page polling the stats,
+// top and recent endpoints and purging through the purge endpoints.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+const (
+	// recentRequestsLen is how many requests /_cache/recent remembers.
+	recentRequestsLen = 100
+	defaultTopKeys    = 20
+	maxTopKeys        = 1000
+)
+
+type recentRequest struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Status     int       `json:"status"`
+	Cache      string    `json:"cache"`
+	Bytes      int       `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	Key        string    `json:"key,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// recentRequests is a ring of the last proxied requests.
+type recentRequests struct {
+	mu   sync.Mutex
+	buf  [recentRequestsLen]recentRequest
+	next int
+	full bool
+}
+
+func (rr *recentRequests) add(req recentRequest) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.buf[rr.next] = req
+	rr.next = (rr.next + 1) % len(rr.buf)
+	rr.full = rr.full || rr.next == 0
+}
+
+// list returns the requests newest first.
+func (rr *recentRequests) list() []recentRequest {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	n := rr.next
+	if rr.full {
+		n = len(rr.buf)
+	}
+	reqs := make([]recentRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		reqs = append(reqs, rr.buf[(rr.next-i+len(rr.buf))%len(rr.buf)])
+	}
+	return reqs
+}
+
+// handleDashboard serves the dashboard page. It holds no data of its own,
+// so it's open; the endpoints it calls are guarded as usual and it asks for
+// a token when they refuse it.
+func (cps *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(dashboardHTML)
+}
+
+// handleTopKeys serves the metadata of the n most hit entries (?n=20).
+func (cps *Server) handleTopKeys(w http.ResponseWriter, r *http.Request) {
+	n := defaultTopKeys
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxTopKeys {
+			writeJSONError(w, http.StatusBadRequest, "n must be between 1 and "+strconv.Itoa(maxTopKeys))
+			return
+		}
+	}
+	entries := cps.Cache.Entries()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hits != entries[j].Hits {
+			return entries[i].Hits > entries[j].Hits
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	if entries == nil {
+		entries = []cache.EntryMeta{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+// handleRecent serves the last proxied requests, newest first.
+func (cps *Server) handleRecent(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"requests": cps.recent.list()})
+}
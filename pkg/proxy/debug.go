@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"html"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+)
+
+// debugHandler serves the runtime's profiles under /debug/pprof/ as
+// net/http/pprof does, and the expvar variables, memstats among them, on
+// /debug/vars. net/http/pprof isn't imported because it registers its
+// handlers on http.DefaultServeMux, exposing them wherever an embedder
+// serves it.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/{$}", handlePprofIndex)
+	mux.HandleFunc("GET /debug/pprof/profile", handleCPUProfile)
+	mux.HandleFunc("GET /debug/pprof/trace", handleTrace)
+	mux.HandleFunc("GET /debug/pprof/{name}", handleProfile)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	return mux
+}
+
+func handlePprofIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, "<html><body><h1>profiles</h1><ul>\n")
+	for _, p := range pprof.Profiles() {
+		name := html.EscapeString(p.Name())
+		fmt.Fprintf(w, "<li><a href=\"%s?debug=1\">%s</a> (%d)</li>\n", name, name, p.Count())
+	}
+	fmt.Fprint(w, "<li><a href=\"profile?seconds=30\">profile</a> (30s of CPU)</li>\n")
+	fmt.Fprint(w, "<li><a href=\"trace?seconds=1\">trace</a> (1s execution trace)</li>\n")
+	fmt.Fprint(w, "</ul></body></html>\n")
+}
+
+// handleProfile writes a named profile, in the binary format go tool pprof
+// reads, or as text with debug=1 or 2.
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	p := pprof.Lookup(r.PathValue("name"))
+	if p == nil {
+		http.Error(w, "unknown profile", http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if p.Name() == "heap" && r.URL.Query().Get("gc") != "" {
+		runtime.GC()
+	}
+	setProfileHeaders(w, p.Name(), debug != 0)
+	p.WriteTo(w, debug)
+}
+
+func handleCPUProfile(w http.ResponseWriter, r *http.Request) {
+	d := profileDuration(r, 30*time.Second)
+	setProfileHeaders(w, "profile", false)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, fmt.Sprintf("couldn't start the CPU profile. error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, d)
+	pprof.StopCPUProfile()
+}
+
+func handleTrace(w http.ResponseWriter, r *http.Request) {
+	d := profileDuration(r, time.Second)
+	setProfileHeaders(w, "trace", false)
+	if err := trace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, fmt.Sprintf("couldn't start the trace. error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, d)
+	trace.Stop()
+}
+
+func setProfileHeaders(w http.ResponseWriter, name string, text bool) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if text {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+}
+
+// profileDuration is the seconds parameter of r, def when it's missing.
+func profileDuration(r *http.Request, def time.Duration) time.Duration {
+	if s, err := strconv.ParseFloat(r.URL.Query().Get("seconds"), 64); err == nil && s > 0 {
+		return time.Duration(s * float64(time.Second))
+	}
+	return def
+}
+
+// sleep waits for d, or until the client goes away.
+func sleep(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
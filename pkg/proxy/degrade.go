@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DegradationStep string
+
+const (
+	// stepServeStale answers from expired entries without asking the origin.
+	stepServeStale DegradationStep = "serve-stale"
+	// stepNoStore stops caching new responses.
+	stepNoStore DegradationStep = "no-store"
+	// stepShedLowPriority rejects requests to low priority routes with 503.
+	stepShedLowPriority DegradationStep = "shed-low-priority"
+)
+
+type DegradationConfig struct {
+	// Ladder lists the steps in the order they are taken under stress.
+	// Leaving it empty disables degradation.
+	Ladder   []DegradationStep `json:"ladder"`
+	Interval Duration          `json:"interval"`
+	// MaxStale is how long past its TTL an entry may still be served stale.
+	MaxStale Duration `json:"max_stale"`
+
+	// The origin counts as down when at least this fraction of its requests
+	// failed during the last interval.
+	OriginErrorRate float64 `json:"origin_error_rate"`
+	// Memory is under pressure once the heap grows past this many bytes.
+	// Zero disables the check.
+	MaxHeapBytes uint64 `json:"max_heap_bytes"`
+	// The disk is full once the cache dir has fewer free bytes than this.
+	// Zero disables the check.
+	MinFreeDiskBytes uint64 `json:"min_free_disk_bytes"`
+}
+
+const minOriginSamples = 5
+
+func (c *DegradationConfig) validate() error {
+	seen := make(map[DegradationStep]bool)
+	for _, step := range c.Ladder {
+		switch step {
+		case stepServeStale, stepNoStore, stepShedLowPriority:
+		default:
+			return fmt.Errorf("degradation: unknown step %q", step)
+		}
+		if seen[step] {
+			return fmt.Errorf("degradation: step %q listed twice", step)
+		}
+		seen[step] = true
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(5 * time.Second)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("degradation: interval must be greater than zero")
+	}
+	if c.OriginErrorRate == 0 {
+		c.OriginErrorRate = 0.5
+	}
+	if c.OriginErrorRate < 0 || c.OriginErrorRate > 1 {
+		return fmt.Errorf("degradation: origin_error_rate must be between 0 and 1")
+	}
+	if c.MaxStale < 0 {
+		return fmt.Errorf("degradation: max_stale must not be negative")
+	}
+	return nil
+}
+
+// degrader walks up the ladder one step per interval while the proxy is under
+// stress, and back down one step per interval once it recovers.
+type degrader struct {
+	cfg        DegradationConfig
+	cacheDir   string
+	level      atomic.Int32
+	originReqs atomic.Int64
+	originErrs atomic.Int64
+}
+
+func newDegrader(cfg DegradationConfig, cacheDir string) *degrader {
+	return &degrader{cfg: cfg, cacheDir: cacheDir}
+}
+
+// Level is the number of ladder steps currently in effect.
+func (d *degrader) Level() int {
+	return int(d.level.Load())
+}
+
+func (d *degrader) active(step DegradationStep) bool {
+	level := d.Level()
+	for i := 0; i < level; i++ {
+		if d.cfg.Ladder[i] == step {
+			return true
+		}
+	}
+	return false
+}
+
+// activeSteps lists the ladder steps currently in effect.
+func (d *degrader) activeSteps() []DegradationStep {
+	return append([]DegradationStep{}, d.cfg.Ladder[:d.Level()]...)
+}
+
+func (d *degrader) recordOrigin(failed bool) {
+	d.originReqs.Add(1)
+	if failed {
+		d.originErrs.Add(1)
+	}
+}
+
+// stress reports why the proxy is under stress, or "" if it isn't.
+func (d *degrader) stress() string {
+	reqs, errs := d.originReqs.Swap(0), d.originErrs.Swap(0)
+	if reqs >= minOriginSamples && float64(errs)/float64(reqs) >= d.cfg.OriginErrorRate {
+		return fmt.Sprintf("origin down (%d/%d requests failed)", errs, reqs)
+	}
+	if d.cfg.MaxHeapBytes > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if ms.HeapAlloc >= d.cfg.MaxHeapBytes {
+			return fmt.Sprintf("memory pressure (heap at %d bytes)", ms.HeapAlloc)
+		}
+	}
+	if d.cfg.MinFreeDiskBytes > 0 && d.cacheDir != "" {
+		if free, err := diskFree(d.cacheDir); err == nil && free < d.cfg.MinFreeDiskBytes {
+			return fmt.Sprintf("disk full (%d bytes free)", free)
+		}
+	}
+	return ""
+}
+
+func (d *degrader) evaluate() {
+	level := d.Level()
+	reason := d.stress()
+	switch {
+	case reason != "" && level < len(d.cfg.Ladder):
+		d.level.Store(int32(level + 1))
+		slog.Warn("degrading", "reason", reason, "from", level, "to", level+1, "step", d.cfg.Ladder[level])
+	case reason == "" && level > 0:
+		d.level.Store(int32(level - 1))
+		slog.Info("recovering from degradation", "from", level, "to", level-1)
+	}
+}
+
+func (d *degrader) run(ctx context.Context, wg *sync.WaitGroup) {
+	if len(d.cfg.Ladder) == 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Duration(d.cfg.Interval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.evaluate()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package proxy
+
+import "errors"
+
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNSConfig controls how origin host names are looked up. Answers are
+// cached for CacheTTL, zero to not cache, and a cached answer keeps being
+// used past it while lookups fail, so origins stay reachable through a DNS
+// outage. Resolver is a host:port DNS server asked instead of the system's
+// resolver, and Hosts pins names to IPs that are used without a lookup.
+//
+// Connections are spread over all of a host's addresses. With Refresh the
+// hosts are looked up again that often in the background, and when their
+// addresses change idle connections are closed, so a failover done in DNS
+// reaches the proxy without a restart. Addresses that refuse connections
+// are skipped for a while, and with CacheTTL or Refresh set the origin's
+// health check probes every address, skipping those failing it until they
+// pass again.
+type DNSConfig struct {
+	CacheTTL Duration            `json:"cache_ttl"`
+	Refresh  Duration            `json:"refresh"`
+	Resolver string              `json:"resolver"`
+	Hosts    map[string][]string `json:"hosts"`
+}
+
+func (c *DNSConfig) validate() error {
+	if c.CacheTTL < 0 || c.Refresh < 0 {
+		return fmt.Errorf("dns: cache_ttl and refresh must not be negative")
+	}
+	if c.Resolver != "" {
+		if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+			return fmt.Errorf("dns: resolver must be a host:port: %v", err)
+		}
+	}
+	for name, ips := range c.Hosts {
+		if len(ips) == 0 {
+			return fmt.Errorf("dns: hosts: %s has no IPs", name)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("dns: hosts: %s: invalid IP %q", name, ip)
+			}
+		}
+	}
+	return nil
+}
+
+type dnsAnswer struct {
+	ips     []string
+	expires time.Time
+	// next rotates the address dialed first.
+	next atomic.Uint64
+}
+
+// rotated returns the IPs starting from the next one in turn.
+func (a *dnsAnswer) rotated() []string {
+	i := int(a.next.Add(1) % uint64(len(a.ips)))
+	return append(slices.Clone(a.ips[i:]), a.ips[:i]...)
+}
+
+// resolver looks origin hosts up as DNSConfig says.
+type resolver struct {
+	cfg DNSConfig
+	r   *net.Resolver
+	mu  sync.Mutex
+	// answers are the cached lookups, by host.
+	answers map[string]*dnsAnswer
+	// down are the addresses skipped, until when.
+	down map[string]time.Time
+}
+
+// dialIPKey pins the connections of a request, through its context, to one
+// of its host's addresses.
+type dialIPKey struct{}
+
+func newResolver(cfg DNSConfig, d *net.Dialer) *resolver {
+	r := &resolver{cfg: cfg, r: net.DefaultResolver, answers: map[string]*dnsAnswer{}, down: map[string]time.Time{}}
+	if cfg.Resolver != "" {
+		r.r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, cfg.Resolver)
+			},
+		}
+	}
+	return r
+}
+
+func (r *resolver) caching() bool {
+	return r.cfg.CacheTTL > 0 || r.cfg.Refresh > 0
+}
+
+// lookup returns host's IPs, pinned, cached or freshly looked up, in the
+// order to dial them.
+func (r *resolver) lookup(ctx context.Context, host string) ([]string, error) {
+	if ips, ok := r.cfg.Hosts[host]; ok {
+		return ips, nil
+	}
+	if !r.caching() {
+		return r.r.LookupHost(ctx, host)
+	}
+	r.mu.Lock()
+	cached, ok := r.answers[host]
+	r.mu.Unlock()
+	// refreshed in the background, an answer doesn't go stale
+	if ok && (r.cfg.Refresh > 0 || time.Now().Before(cached.expires)) {
+		return cached.rotated(), nil
+	}
+	ips, err := r.r.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			slog.Warn("dns: lookup failed, using the last answer", "host", host, "err", err)
+			return cached.rotated(), nil
+		}
+		return nil, err
+	}
+	answer := &dnsAnswer{ips: ips, expires: time.Now().Add(time.Duration(r.cfg.CacheTTL))}
+	r.mu.Lock()
+	r.answers[host] = answer
+	r.mu.Unlock()
+	return answer.rotated(), nil
+}
+
+// setDown skips ip for d, or stops skipping it when d is zero.
+func (r *resolver) setDown(ip string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d == 0 {
+		delete(r.down, ip)
+		return
+	}
+	r.down[ip] = time.Now().Add(d)
+}
+
+// usable drops the addresses that are down from ips, unless all of them
+// are.
+func (r *resolver) usable(ips []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	up := slices.DeleteFunc(slices.Clone(ips), func(ip string) bool { return now.Before(r.down[ip]) })
+	if len(up) == 0 {
+		return ips
+	}
+	return up
+}
+
+// dialContext dials addr through d, trying its host's usable IPs in turn.
+func (r *resolver) dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		if ip, ok := ctx.Value(dialIPKey{}).(string); ok {
+			return d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		}
+		ips, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range r.usable(ips) {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+			if ctx.Err() == nil {
+				r.setDown(ip, passiveRetryAfter)
+			}
+		}
+		return nil, err
+	}
+}
+
+// run looks every host up again each Refresh until ctx is done, calling
+// changed when some host's addresses did.
+func (r *resolver) run(ctx context.Context, wg *sync.WaitGroup, changed func()) {
+	if r.cfg.Refresh == 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Duration(r.cfg.Refresh))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if r.refresh(ctx) {
+				changed()
+			}
+		}
+	}()
+}
+
+func (r *resolver) refresh(ctx context.Context) bool {
+	r.mu.Lock()
+	hosts := make(map[string][]string, len(r.answers))
+	for host, a := range r.answers {
+		hosts[host] = a.ips
+	}
+	r.mu.Unlock()
+
+	changed := false
+	for host, old := range hosts {
+		ips, err := r.r.LookupHost(ctx, host)
+		if err != nil {
+			slog.Warn("dns: lookup failed, keeping the last answer", "host", host, "err", err)
+			continue
+		}
+		if !slices.Equal(slices.Sorted(slices.Values(ips)), slices.Sorted(slices.Values(old))) {
+			slog.Info("dns: origin addresses changed", "host", host, "addrs", ips, "were", old)
+			changed = true
+		}
+		r.mu.Lock()
+		r.answers[host] = &dnsAnswer{ips: ips, expires: time.Now().Add(time.Duration(r.cfg.CacheTTL))}
+		r.mu.Unlock()
+	}
+	return changed
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// CheckStatus is the outcome of a self-check.
+type CheckStatus string
+
+const (
+	CheckOK   CheckStatus = "OK"
+	CheckWarn CheckStatus = "WARN"
+	CheckFail CheckStatus = "FAIL"
+)
+
+type CheckResult struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+func (r CheckResult) String() string {
+	return fmt.Sprintf("%s: %s", r.Name, r.Detail)
+}
+
+const (
+	minFreeDisk      = 512 << 20
+	minOpenFiles     = 4096
+	maxClockSkew     = 30 * time.Second
+	certExpiryMargin = 14 * 24 * time.Hour
+)
+
+// RunChecks verifies that the environment is fit to serve traffic. Every
+// non-OK result carries a hint on how to fix it.
+func RunChecks(cfg *Config) []CheckResult {
+	results := checkListeners(cfg)
+	if cfg.offline() {
+		// the origins are never asked, they needn't be reachable
+		return append(results, checkCacheDir(cfg.CacheDir), checkOpenFiles())
+	}
+	var urls []string
+	for _, spec := range cfg.originSpecs() {
+		for _, u := range spec.urls {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return append(results, checkCacheDir(cfg.CacheDir), checkOpenFiles(),
+			CheckResult{Name: "origin", Status: CheckFail, Detail: "no origin configured. set -origin or origins"})
+	}
+	// the origins are reached the way the proxy reaches them, through its
+	// upstream TLS settings and DNS pins
+	res := newResolver(cfg.Upstream.DNS, &net.Dialer{Timeout: time.Duration(cfg.Timeouts.OriginDial)})
+	client, err := newUpstreamClient(cfg.Upstream, cfg.Timeouts, res)
+	if err != nil {
+		return append(results, checkCacheDir(cfg.CacheDir), checkOpenFiles(),
+			CheckResult{Name: "origin", Status: CheckFail, Detail: fmt.Sprintf("couldn't set up the origin client (%v). check the upstream settings", err)})
+	}
+	client.Timeout = 10 * time.Second
+	origin, resp := checkOrigin(client, urls[0])
+	results = append(results, checkCacheDir(cfg.CacheDir), origin, checkOriginTLS(resp), checkClock(resp), checkOpenFiles())
+	// every other backend of every origin
+	for _, u := range urls[1:] {
+		origin, resp := checkOrigin(client, u)
+		results = append(results, origin, checkOriginTLS(resp))
+	}
+	return results
+}
+
+// checkListeners loads the certificate of every HTTPS listener.
+func checkListeners(cfg *Config) []CheckResult {
+	var results []CheckResult
+	for _, l := range cfg.listeners() {
+		if l.CertFile != "" {
+			results = append(results, checkListenerTLS(l))
+		}
+	}
+	return results
+}
+
+func checkCacheDir(dir string) CheckResult {
+	res := CheckResult{Name: "cache dir", Status: CheckOK}
+	if dir == "" {
+		res.Detail = "no -cache-dir set, caching in memory only"
+		return res
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		res.Status = CheckFail
+		res.Detail = fmt.Sprintf("couldn't create %s (%v). create it or point -cache-dir somewhere writable", dir, err)
+		return res
+	}
+	probe, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		res.Status = CheckFail
+		res.Detail = fmt.Sprintf("%s is not writable (%v). fix its permissions for the user running the proxy", dir, err)
+		return res
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	free, err := diskFree(dir)
+	if err != nil {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("%s is writable but free space is unknown: %v", dir, err)
+		return res
+	}
+	if free < minFreeDisk {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("only %d MiB free on the filesystem of %s. free up space or move -cache-dir", free>>20, dir)
+		return res
+	}
+	res.Detail = fmt.Sprintf("%s is writable, %d MiB free", dir, free>>20)
+	return res
+}
+
+func checkOrigin(client *http.Client, origin string) (CheckResult, *http.Response) {
+	res := CheckResult{Name: "origin"}
+
+	start := time.Now()
+	resp, err := client.Get(origin)
+	if err != nil {
+		res.Status = CheckFail
+		res.Detail = fmt.Sprintf("couldn't reach %s (%v). check the -origin flag and that the origin is up", origin, err)
+		return res, nil
+	}
+	resp.Body.Close()
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	switch {
+	case resp.StatusCode >= 500:
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("%s responded %d in %s. the origin is reachable but failing", origin, resp.StatusCode, elapsed)
+	default:
+		res.Status = CheckOK
+		res.Detail = fmt.Sprintf("%s responded %d in %s", origin, resp.StatusCode, elapsed)
+	}
+	return res, resp
+}
+
+func checkOriginTLS(resp *http.Response) CheckResult {
+	res := CheckResult{Name: "tls", Status: CheckOK}
+	if resp == nil {
+		res.Status = CheckWarn
+		res.Detail = "skipped, origin unreachable"
+		return res
+	}
+	if resp.TLS == nil {
+		res.Detail = "origin uses plain http, nothing to verify"
+		return res
+	}
+
+	cert := leafCertificate(resp.TLS)
+	if cert == nil {
+		res.Status = CheckWarn
+		res.Detail = "origin presented no certificate"
+		return res
+	}
+	left := time.Until(cert.NotAfter)
+	if left < certExpiryMargin {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("origin certificate for %s expires in %s (%s). renew it on the origin",
+			cert.Subject.CommonName, left.Round(time.Hour), cert.NotAfter.Format(time.RFC3339))
+		return res
+	}
+	res.Detail = fmt.Sprintf("origin certificate valid until %s", cert.NotAfter.Format(time.RFC3339))
+	return res
+}
+
+func leafCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+func checkClock(resp *http.Response) CheckResult {
+	res := CheckResult{Name: "clock", Status: CheckOK}
+	now := time.Now()
+
+	if now.Year() < 2024 {
+		res.Status = CheckFail
+		res.Detail = fmt.Sprintf("system time is %s. fix the clock (e.g. enable NTP), cache expiry depends on it", now.Format(time.RFC3339))
+		return res
+	}
+	if resp == nil || resp.Header.Get("Date") == "" {
+		res.Detail = fmt.Sprintf("system time is %s, no origin Date header to compare against", now.Format(time.RFC3339))
+		return res
+	}
+
+	originTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("couldn't parse origin Date header %q", resp.Header.Get("Date"))
+		return res
+	}
+	skew := now.Sub(originTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("clock differs from the origin by %s. sync the clock (e.g. enable NTP) on this host or the origin", skew.Round(time.Second))
+		return res
+	}
+	res.Detail = fmt.Sprintf("clock within %s of the origin", skew.Round(time.Second))
+	return res
+}
+
+func checkListenerTLS(l ListenerConfig) CheckResult {
+	res := CheckResult{Name: "listener tls", Status: CheckOK}
+	pair, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		res.Status = CheckFail
+		res.Detail = fmt.Sprintf("couldn't load the certificate of %s (%v). check its cert_file and key_file", l.Addr, err)
+		return res
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		res.Status = CheckFail
+		res.Detail = fmt.Sprintf("couldn't parse the certificate of %s (%v). check its cert_file", l.Addr, err)
+		return res
+	}
+	left := time.Until(cert.NotAfter)
+	if left <= 0 {
+		res.Status = CheckFail
+		res.Detail = fmt.Sprintf("certificate of %s expired on %s. renew %s", l.Addr, cert.NotAfter.Format(time.RFC3339), l.CertFile)
+		return res
+	}
+	if left < certExpiryMargin {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("certificate of %s for %s expires in %s (%s). renew %s",
+			l.Addr, cert.Subject.CommonName, left.Round(time.Hour), cert.NotAfter.Format(time.RFC3339), l.CertFile)
+		return res
+	}
+	res.Detail = fmt.Sprintf("certificate of %s valid until %s", l.Addr, cert.NotAfter.Format(time.RFC3339))
+	return res
+}
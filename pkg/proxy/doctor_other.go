@@ -0,0 +1,7 @@
+//go:build !unix
+
+package proxy
+
+func checkOpenFiles() CheckResult {
+	return CheckResult{Name: "ulimit", Status: CheckOK, Detail: "not applicable on this platform"}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate valid for validFor, and its
+// key, to dir.
+func writeCert(t *testing.T, dir string, validFor time.Duration) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCheckListenerTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		validFor time.Duration
+		missing  bool
+		want     CheckStatus
+	}{
+		{name: "valid", validFor: 90 * 24 * time.Hour, want: CheckOK},
+		{name: "near expiry", validFor: 3 * 24 * time.Hour, want: CheckWarn},
+		{name: "expired", validFor: -time.Minute, want: CheckFail},
+		{name: "missing files", missing: true, want: CheckFail},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l := ListenerConfig{Addr: ":8443", CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+			if !tc.missing {
+				l.CertFile, l.KeyFile = writeCert(t, dir, tc.validFor)
+			}
+			if res := checkListenerTLS(l); res.Status != tc.want {
+				t.Errorf("got %s (%s), want %s", res.Status, res.Detail, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunChecksWithoutOrigin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Origin = ""
+	var found bool
+	for _, res := range RunChecks(&cfg) {
+		if res.Name == "origin" {
+			found = true
+			if res.Status != CheckFail {
+				t.Errorf("got %s for the origin, want %s", res.Status, CheckFail)
+			}
+		}
+	}
+	if !found {
+		t.Error("no origin check")
+	}
+}
+
+// The origin checks trust what the proxy trusts.
+func TestRunChecksUpstreamCA(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		caFile string
+		want   CheckStatus
+	}{
+		{name: "with ca_file", caFile: caFile, want: CheckOK},
+		{name: "without", want: CheckFail},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Origin = origin.URL
+			cfg.Upstream.TLS.CAFile = tc.caFile
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+			for _, res := range RunChecks(&cfg) {
+				if res.Name == "origin" && res.Status != tc.want {
+					t.Errorf("got %s (%s), want %s", res.Status, res.Detail, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func checkOpenFiles() CheckResult {
+	res := CheckResult{Name: "ulimit"}
+
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("couldn't read open files limit: %v", err)
+		return res
+	}
+	if lim.Cur < minOpenFiles {
+		res.Status = CheckWarn
+		res.Detail = fmt.Sprintf("open files limit is %d, every client and origin connection needs one. raise it with `ulimit -n %d` or LimitNOFILE= in the systemd unit",
+			lim.Cur, minOpenFiles*16)
+		return res
+	}
+	res.Status = CheckOK
+	res.Detail = fmt.Sprintf("open files limit is %d", lim.Cur)
+	return res
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrorPagesConfig renders the responses to requests the origin couldn't
+// answer from Go templates: HTML for clients asking for text/html, JSON for
+// those asking for application/json, and the error_bodies text for the
+// others or when no template is set for the type. Each template is given
+// inline or read from a file, and executed with errorPage. The JSON
+// template has a json function quoting a value for it, e.g.
+// {"error": {{json .Message}}}.
+type ErrorPagesConfig struct {
+	HTML     string `json:"html"`
+	HTMLFile string `json:"html_file"`
+	JSON     string `json:"json"`
+	JSONFile string `json:"json_file"`
+
+	html *htmltemplate.Template
+	json *texttemplate.Template
+}
+
+// errorPage is what the error templates are executed with.
+type errorPage struct {
+	Status     int
+	StatusText string
+	// Kind is bad_gateway, timeout, circuit_open, internal, overloaded or
+	// offline, and Message the error_bodies text for it.
+	Kind    string
+	Message string
+	Method  string
+	Host    string
+	Path    string
+	// RequestID is the request's ID, for clients to quote when reporting
+	// the error. Empty when request IDs are off.
+	RequestID string
+}
+
+func (c *ErrorPagesConfig) validate() error {
+	html, err := readTemplate(c.HTML, c.HTMLFile)
+	if err != nil {
+		return fmt.Errorf("error_pages: html: %v", err)
+	}
+	if html != "" {
+		if c.html, err = htmltemplate.New("html").Parse(html); err != nil {
+			return fmt.Errorf("error_pages: html: %v", err)
+		}
+	}
+	js, err := readTemplate(c.JSON, c.JSONFile)
+	if err != nil {
+		return fmt.Errorf("error_pages: json: %v", err)
+	}
+	if js != "" {
+		funcs := texttemplate.FuncMap{"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		}}
+		if c.json, err = texttemplate.New("json").Funcs(funcs).Parse(js); err != nil {
+			return fmt.Errorf("error_pages: json: %v", err)
+		}
+	}
+	return nil
+}
+
+func readTemplate(inline, file string) (string, error) {
+	if file == "" {
+		return inline, nil
+	}
+	if inline != "" {
+		return "", fmt.Errorf("set the template or its file, not both")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read template file. error: %v", err)
+	}
+	return string(b), nil
+}
+
+// render returns the page for r and its content type, ok false when the
+// plain text body should be sent instead.
+func (c *ErrorPagesConfig) render(r *http.Request, page errorPage) (body []byte, contentType string, ok bool) {
+	var buf bytes.Buffer
+	var err error
+	switch accepted(r, c.html != nil, c.json != nil) {
+	case "text/html":
+		err = c.html.Execute(&buf, page)
+		contentType = "text/html; charset=utf-8"
+	case "application/json":
+		err = c.json.Execute(&buf, page)
+		contentType = "application/json"
+	default:
+		return nil, "", false
+	}
+	if err != nil {
+		return nil, "", false
+	}
+	return buf.Bytes(), contentType, true
+}
+
+// accepted returns the one of text/html, when html, and application/json,
+// when json, that r's Accept prefers. Only types named, or as type/*,
+// count: "*/*" alone gets neither.
+func accepted(r *http.Request, html, json bool) string {
+	best, bestQ := "", 0.0
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			q := 1.0
+			if qs, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				q, _ = strconv.ParseFloat(qs, 64)
+			}
+			var typ string
+			switch {
+			case html && (name == "text/html" || name == "text/*"):
+				typ = "text/html"
+			case json && (name == "application/json" || name == "application/*"):
+				typ = "application/json"
+			default:
+				continue
+			}
+			if q > bestQ {
+				best, bestQ = typ, q
+			}
+		}
+	}
+	return best
+}
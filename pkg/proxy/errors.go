@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+)
+
+// upstreamError classifies why a request couldn't be answered by the origin.
+type upstreamError int
+
+// errorHeader tells clients which upstreamError failed their request, by
+// name, so they can tell a down origin from a slow or overloaded one.
+const errorHeader = "X-Cache-Error"
+
+const (
+	// upstreamBadGateway is a connection or protocol failure talking to the
+	// origin.
+	upstreamBadGateway upstreamError = iota
+	// upstreamTimeout is the origin not answering in time.
+	upstreamTimeout
+	// upstreamCircuitOpen is the origin being skipped while it's down.
+	upstreamCircuitOpen
+	// upstreamInternal is the proxy failing before reaching the origin.
+	upstreamInternal
+	// upstreamOverloaded is the request shed because too many are in
+	// flight to the origin already.
+	upstreamOverloaded
+	// upstreamOffline is a miss in offline mode, where the origin is never
+	// asked.
+	upstreamOffline
+
+	numUpstreamErrors
+)
+
+var upstreamErrorNames = [numUpstreamErrors]string{
+	upstreamBadGateway:  "bad_gateway",
+	upstreamTimeout:     "timeout",
+	upstreamCircuitOpen: "circuit_open",
+	upstreamInternal:    "internal",
+	upstreamOverloaded:  "overloaded",
+	upstreamOffline:     "offline",
+}
+
+var upstreamErrorStatus = [numUpstreamErrors]int{
+	upstreamBadGateway:  http.StatusBadGateway,
+	upstreamTimeout:     http.StatusGatewayTimeout,
+	upstreamCircuitOpen: http.StatusServiceUnavailable,
+	upstreamInternal:    http.StatusInternalServerError,
+	upstreamOverloaded:  http.StatusServiceUnavailable,
+	upstreamOffline:     http.StatusGatewayTimeout,
+}
+
+var defaultErrorBodies = [numUpstreamErrors]string{
+	upstreamBadGateway:  "bad gateway: couldn't get a valid response from the origin",
+	upstreamTimeout:     "gateway timeout: the origin didn't respond in time",
+	upstreamCircuitOpen: "service unavailable: the origin is down, try again later",
+	upstreamInternal:    "internal error forwarding request",
+	upstreamOverloaded:  "service unavailable: too many requests to the origin, try again later",
+	upstreamOffline:     "gateway timeout: offline, and the response isn't cached",
+}
+
+func (e upstreamError) String() string {
+	return upstreamErrorNames[e]
+}
+
+func (e upstreamError) status() int {
+	return upstreamErrorStatus[e]
+}
+
+func classifyUpstreamError(err error) upstreamError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout() {
+		return upstreamTimeout
+	}
+	return upstreamBadGateway
+}
+
+// errorBody returns the response body for kind, as set in the config's
+// error_bodies or the default.
+func (c *Config) errorBody(kind upstreamError) string {
+	if body, ok := c.ErrorBodies[kind.String()]; ok {
+		return body
+	}
+	return defaultErrorBodies[kind]
+}
+
+// upstreamFailed answers r, which the origin couldn't serve, with an error
+// page, and accounts for the failure by kind.
+func (cps *Server) upstreamFailed(w http.ResponseWriter, r *http.Request, key string, kind upstreamError, err error) {
+	cps.countUpstreamError(kind)
+	slog.Error("origin request failed", "key", key, "kind", kind.String(), "status", kind.status(), "request_id", cps.requestIDOf(r), "err", err)
+	cps.writeUpstreamError(w, r, kind)
+}
+
+// writeUpstreamError answers r with the error page for kind.
+func (cps *Server) writeUpstreamError(w http.ResponseWriter, r *http.Request, kind upstreamError) {
+	w.Header().Set(errorHeader, kind.String())
+	page := errorPage{
+		Status:     kind.status(),
+		StatusText: http.StatusText(kind.status()),
+		Kind:       kind.String(),
+		Message:    cps.config().errorBody(kind),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		RequestID:  cps.requestIDOf(r),
+	}
+	body, contentType, ok := cps.config().ErrorPages.render(r, page)
+	if !ok {
+		http.Error(w, page.Message, page.Status)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(page.Status)
+	w.Write(body)
+}
+
+func (cps *Server) countUpstreamError(kind upstreamError) {
+	cps.counters.upstreamErrors[kind].Add(1)
+	if kind == upstreamBadGateway || kind == upstreamTimeout {
+		cps.degrade.recordOrigin(true)
+	}
+}
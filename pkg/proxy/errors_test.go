@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamFailed(t *testing.T) {
+	for _, tc := range []struct {
+		kind       upstreamError
+		wantStatus int
+		wantCode   string
+	}{
+		{kind: upstreamBadGateway, wantStatus: http.StatusBadGateway, wantCode: "bad_gateway"},
+		{kind: upstreamTimeout, wantStatus: http.StatusGatewayTimeout, wantCode: "timeout"},
+		{kind: upstreamCircuitOpen, wantStatus: http.StatusServiceUnavailable, wantCode: "circuit_open"},
+		{kind: upstreamInternal, wantStatus: http.StatusInternalServerError, wantCode: "internal"},
+		{kind: upstreamOverloaded, wantStatus: http.StatusServiceUnavailable, wantCode: "overloaded"},
+		{kind: upstreamOffline, wantStatus: http.StatusGatewayTimeout, wantCode: "offline"},
+	} {
+		t.Run(tc.wantCode, func(t *testing.T) {
+			cps := newTestServer(t, "http://127.0.0.1:1", func(cfg *Config) {
+				cfg.ErrorPages.JSON = `{"code": {{json .Kind}}, "status": {{.Status}}, "message": {{json .Message}}}`
+			})
+
+			rec := httptest.NewRecorder()
+			cps.upstreamFailed(rec, httptest.NewRequest(http.MethodGet, "/a", nil), "GET-/a", tc.kind, errors.New("failed"))
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if got := rec.Header().Get(errorHeader); got != tc.wantCode {
+				t.Errorf("got %s %q, want %q", errorHeader, got, tc.wantCode)
+			}
+			if got, want := strings.TrimSpace(rec.Body.String()), defaultErrorBodies[tc.kind]; got != want {
+				t.Errorf("got body %q, want %q", got, want)
+			}
+			if n := cps.counters.upstreamErrors[tc.kind].Load(); n != 1 {
+				t.Errorf("counted %d %s errors, want 1", n, tc.wantCode)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/a", nil)
+			r.Header.Set("Accept", "application/json")
+			rec = httptest.NewRecorder()
+			cps.upstreamFailed(rec, r, "GET-/a", tc.kind, errors.New("failed"))
+			if rec.Code != tc.wantStatus {
+				t.Errorf("json: got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("json: got Content-Type %q", ct)
+			}
+			var body struct {
+				Code    string `json:"code"`
+				Status  int    `json:"status"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("json: couldn't decode %q: %v", rec.Body.String(), err)
+			}
+			if body.Code != tc.wantCode || body.Status != tc.wantStatus || body.Message != defaultErrorBodies[tc.kind] {
+				t.Errorf("json: got %+v", body)
+			}
+		})
+	}
+}
+
+func TestErrorBodies(t *testing.T) {
+	cps := newTestServer(t, "http://127.0.0.1:1", func(cfg *Config) {
+		cfg.ErrorBodies = map[string]string{"internal": "try again"}
+	})
+	rec := httptest.NewRecorder()
+	cps.writeUpstreamError(rec, httptest.NewRequest(http.MethodGet, "/a", nil), upstreamInternal)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", rec.Code)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != "try again" {
+		t.Errorf("got body %q, want the error_bodies one", got)
+	}
+}
+
+func TestClassifyUpstreamError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want upstreamError
+	}{
+		{name: "deadline", err: context.DeadlineExceeded, want: upstreamTimeout},
+		{name: "wrapped deadline", err: fmt.Errorf("get: %w", os.ErrDeadlineExceeded), want: upstreamTimeout},
+		{name: "refused", err: errors.New("connection refused"), want: upstreamBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyUpstreamError(tc.err); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// fixtureTTL is how long recorded responses stay fresh: for good, until
+// recorded again.
+const fixtureTTL = offlineMaxStale
+
+// openFixtures opens the fixture dir of cfg: for recording into, or read
+// only for replaying from.
+func openFixtures(cfg *Config, ttl time.Duration) (cache.Store, error) {
+	dir, readOnly := cfg.Record, false
+	if cfg.Replay != "" {
+		dir, readOnly = cfg.Replay, true
+	}
+	store, err := cache.OpenDiskStore(dir, ttl, offlineMaxStale, cache.DiskOptions{
+		Verify:   cache.VerifyOnRead,
+		ReadOnly: readOnly,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open fixtures. error: %v", err)
+	}
+	return store, nil
+}
+
+func (c *Config) validateFixtures() error {
+	if c.Record == "" && c.Replay == "" {
+		return nil
+	}
+	switch {
+	case c.Record != "" && c.Replay != "":
+		return fmt.Errorf("set only one of record and replay")
+	case c.Record != "" && c.Offline:
+		return fmt.Errorf("record needs the origin, it can't be offline")
+	case c.CacheDir != "" || c.sharedCache() || c.MemoryCacheBytes > 0 || c.CacheSnapshot != "":
+		return fmt.Errorf("record and replay keep the cache in their own dir, without cache_dir, cache_s3, cache_memcached, memory_cache_bytes or cache_snapshot")
+	}
+	return nil
+}
+
+// offline tells whether the origins are never asked, in offline mode or
+// when replaying.
+func (c *Config) offline() bool {
+	return c.Offline || c.Replay != ""
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	adminv1 "github.com/assaidy/caching-proxy/pkg/adminapi/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultWatchInterval = 5 * time.Second
+	minWatchInterval     = time.Second
+)
+
+// grpcAdmin serves the admin API over gRPC on GRPCAddr, see package
+// adminv1.
+type grpcAdmin struct {
+	adminv1.UnimplementedAdminServiceServer
+	cps    *Server
+	server *grpc.Server
+	// access is the admin_auth group of each method.
+	access map[string]*AdminAccess
+	// done ends the WatchStats streams, which would hold up a graceful
+	// stop otherwise.
+	done chan struct{}
+}
+
+func (cps *Server) newGRPCAdmin() *grpcAdmin {
+	auth := &cps.config().AdminAuth
+	g := &grpcAdmin{
+		cps: cps,
+		access: map[string]*AdminAccess{
+			adminv1.AdminService_GetStats_FullMethodName:     &auth.Read,
+			adminv1.AdminService_WatchStats_FullMethodName:   &auth.Read,
+			adminv1.AdminService_ListEntries_FullMethodName:  &auth.Read,
+			adminv1.AdminService_Purge_FullMethodName:        &auth.Purge,
+			adminv1.AdminService_ReloadConfig_FullMethodName: &auth.Reload,
+		},
+		done: make(chan struct{}),
+	}
+	g.server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := g.authorize(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := g.authorize(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	adminv1.RegisterAdminServiceServer(g.server, g)
+	return g
+}
+
+// authorize checks the caller of method against the method's admin_auth
+// group, the same way the REST endpoints do.
+func (g *grpcAdmin) authorize(ctx context.Context, method string) error {
+	a, ok := g.access[method]
+	if !ok {
+		return status.Error(codes.PermissionDenied, "no admin_auth group covers "+method)
+	}
+	r := &http.Request{Header: http.Header{}}
+	if p, ok := grpcpeer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		r.Header.Add("Authorization", v)
+	}
+	switch code, msg := a.deny(r); code {
+	case 0:
+		return nil
+	case http.StatusUnauthorized:
+		return status.Error(codes.Unauthenticated, msg)
+	default:
+		return status.Error(codes.PermissionDenied, msg)
+	}
+}
+
+func (g *grpcAdmin) serve(ln net.Listener) error {
+	return g.server.Serve(ln)
+}
+
+// shutdown ends the streams and lets the other calls finish until ctx is
+// done.
+func (g *grpcAdmin) shutdown(ctx context.Context) {
+	close(g.done)
+	stopped := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		g.server.Stop()
+	}
+}
+
+func (g *grpcAdmin) GetStats(ctx context.Context, req *adminv1.GetStatsRequest) (*adminv1.Stats, error) {
+	return statsProto(g.cps.stats()), nil
+}
+
+func (g *grpcAdmin) WatchStats(req *adminv1.WatchStatsRequest, stream grpc.ServerStreamingServer[adminv1.Stats]) error {
+	interval := defaultWatchInterval
+	if req.Interval != nil {
+		if err := req.Interval.CheckValid(); err != nil {
+			return status.Error(codes.InvalidArgument, "invalid interval: "+err.Error())
+		}
+		interval = req.Interval.AsDuration()
+		if interval < minWatchInterval {
+			return status.Errorf(codes.InvalidArgument, "interval can't be under %s", minWatchInterval)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(statsProto(g.cps.stats())); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-g.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *grpcAdmin) ListEntries(ctx context.Context, req *adminv1.ListEntriesRequest) (*adminv1.ListEntriesResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	match := func(string) bool { return true }
+	if req.Glob != "" {
+		re, err := globToRegexp(req.Glob)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid glob: "+err.Error())
+		}
+		match = re.MatchString
+	}
+
+	var entries []*adminv1.Entry
+	for _, meta := range g.cps.Cache.Entries() {
+		if !match(meta.Key) {
+			continue
+		}
+		entries = append(entries, &adminv1.Entry{
+			Key:        meta.Key,
+			StatusCode: int32(meta.StatusCode),
+			Etag:       meta.ETag,
+			StoredAt:   timestamppb.New(meta.StoredAt),
+			ExpiresAt:  timestamppb.New(meta.ExpiresAt),
+			Size:       int64(meta.Size),
+			Hits:       meta.Hits,
+			Tags:       meta.Tags,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if req.Order == adminv1.ListEntriesRequest_ORDER_HITS && entries[i].Hits != entries[j].Hits {
+			return entries[i].Hits > entries[j].Hits
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	resp := &adminv1.ListEntriesResponse{Total: int32(len(entries))}
+	if req.Limit > 0 && len(entries) > int(req.Limit) {
+		entries = entries[:req.Limit]
+	}
+	resp.Entries = entries
+	return resp, nil
+}
+
+func (g *grpcAdmin) Purge(ctx context.Context, req *adminv1.PurgeRequest) (*adminv1.PurgeResponse, error) {
+	inv := invalidation{Soft: req.Soft}
+	switch t := req.Target.(type) {
+	case *adminv1.PurgeRequest_Key:
+		inv.Key = t.Key
+	case *adminv1.PurgeRequest_Prefix:
+		inv.Prefix = t.Prefix
+	case *adminv1.PurgeRequest_Glob:
+		re, err := globToRegexp(t.Glob)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid glob: "+err.Error())
+		}
+		inv.Regex = re.String()
+	case *adminv1.PurgeRequest_Regex:
+		if _, err := regexp.Compile(t.Regex); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid regex: "+err.Error())
+		}
+		inv.Regex = t.Regex
+	case *adminv1.PurgeRequest_Tags:
+		inv.Tags = t.Tags.GetValues()
+	}
+	if inv.Key == "" && inv.Prefix == "" && inv.Regex == "" && len(inv.Tags) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "key, prefix, glob, regex or tags is required")
+	}
+
+	n := g.cps.invalidate(inv)
+	slog.Info("purge", "key", inv.Key, "prefix", inv.Prefix, "regex", inv.Regex, "tags", inv.Tags, "soft", inv.Soft, "entries", n, "via", "grpc")
+	return &adminv1.PurgeResponse{Purged: int32(n)}, nil
+}
+
+func (g *grpcAdmin) ReloadConfig(ctx context.Context, req *adminv1.ReloadConfigRequest) (*adminv1.ReloadConfigResponse, error) {
+	load := g.cps.config().LoadConfig
+	if load == nil {
+		return nil, status.Error(codes.Unimplemented, "config reload isn't available")
+	}
+	slog.Info("reloading config, asked over gRPC")
+	cfg, err := load()
+	if err == nil {
+		err = g.cps.Reload(cfg)
+	}
+	if err != nil {
+		slog.Error("config reload failed, keeping the current config", "err", err)
+		return nil, status.Error(codes.FailedPrecondition, "config reload failed, keeping the current config: "+err.Error())
+	}
+	return &adminv1.ReloadConfigResponse{}, nil
+}
+
+func statsProto(st statsResponse) *adminv1.Stats {
+	pb := &adminv1.Stats{
+		Uptime:               durationpb.New(time.Duration(st.UptimeSeconds) * time.Second),
+		Hits:                 st.Hits,
+		StaleHits:            st.StaleHits,
+		Misses:               st.Misses,
+		Bypassed:             st.Bypassed,
+		RateLimited:          st.RateLimited,
+		Refreshed:            st.Refreshed,
+		Revalidated:          st.Revalidated,
+		HitRatio:             st.HitRatio,
+		UpstreamErrors:       st.UpstreamErrors,
+		UpstreamErrorsByKind: st.UpstreamErrorsByKind,
+		Upstream_5Xx:         st.Upstream5xx,
+		OriginRetries:        st.OriginRetries,
+		HedgedRequests:       st.HedgedRequests,
+		PeerFetches:          st.PeerFetches,
+		ShadowedRequests:     st.Shadowed,
+		ShadowDropped:        st.ShadowDropped,
+		Entries:              int64(st.Entries),
+		Bytes:                st.Bytes,
+		Evictions:            st.Evictions,
+		Origins:              make(map[string]*adminv1.OriginStats, len(st.Origins)),
+		DegradationLevel:     int32(st.DegradationLevel),
+		KeyScheme:            int32(st.KeyScheme),
+	}
+	for name, o := range st.Origins {
+		ops := &adminv1.OriginStats{Breaker: &adminv1.BreakerStats{State: string(o.Breaker.State), Opened: o.Breaker.Opened}}
+		if o.Breaker.OpenedAt != nil {
+			ops.Breaker.OpenedAt = timestamppb.New(*o.Breaker.OpenedAt)
+		}
+		for _, b := range o.Backends {
+			ops.Backends = append(ops.Backends, &adminv1.BackendStats{Url: b.URL, Healthy: b.Healthy, Active: b.Active})
+		}
+		pb.Origins[name] = ops
+	}
+	for _, step := range st.DegradationSteps {
+		pb.DegradationSteps = append(pb.DegradationSteps, string(step))
+	}
+	return pb
+}
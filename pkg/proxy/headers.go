@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// HeaderRules edit a message's headers. Remove deletes headers, a trailing
+// '*' matching every header with that prefix, Set replaces headers and Add
+// appends values, in that order. Replace then rewrites values matching a
+// pattern, e.g. the origin's host in Location. {host} in Set, Add and
+// Replace values stands for the request's Host.
+type HeaderRules struct {
+	Remove  []string          `json:"remove"`
+	Set     map[string]string `json:"set"`
+	Add     map[string]string `json:"add"`
+	Replace []HeaderReplace   `json:"replace"`
+}
+
+// HeaderReplace replaces what Pattern matches in Header's values with With,
+// where $1 and up are the pattern's groups.
+type HeaderReplace struct {
+	Header  string `json:"header"`
+	Pattern string `json:"pattern"`
+	With    string `json:"with"`
+
+	re *regexp.Regexp
+}
+
+func (c *HeaderRules) validate() error {
+	for i := range c.Replace {
+		rep := &c.Replace[i]
+		if rep.Header == "" {
+			return fmt.Errorf("replace %d: header is required", i)
+		}
+		re, err := regexp.Compile(rep.Pattern)
+		if err != nil {
+			return fmt.Errorf("replace %s: invalid pattern: %v", rep.Header, err)
+		}
+		rep.re = re
+	}
+	return nil
+}
+
+// apply edits h for a request to host. Nil rules leave h as it is.
+func (c *HeaderRules) apply(h http.Header, host string) {
+	if c == nil {
+		return
+	}
+	for _, name := range c.Remove {
+		prefix, ok := strings.CutSuffix(name, "*")
+		if !ok {
+			h.Del(name)
+			continue
+		}
+		for k := range h {
+			if len(k) >= len(prefix) && strings.EqualFold(k[:len(prefix)], prefix) {
+				delete(h, k)
+			}
+		}
+	}
+	for name, v := range c.Set {
+		h.Set(name, expandHost(v, host))
+	}
+	for name, v := range c.Add {
+		h.Add(name, expandHost(v, host))
+	}
+	for _, rep := range c.Replace {
+		vv := h.Values(rep.Header)
+		for i, v := range vv {
+			vv[i] = rep.re.ReplaceAllString(v, expandHost(rep.With, host))
+		}
+	}
+}
+
+// editRequestHeaders applies the proxy wide and route's request rules to
+// h, the headers of a request to the origin made for a client asking host.
+func (c *Config) editRequestHeaders(h http.Header, route *RouteConfig, host string) {
+	c.RequestHeaders.apply(h, host)
+	if route != nil {
+		route.RequestHeaders.apply(h, host)
+	}
+}
+
+func expandHost(v, host string) string {
+	return strings.ReplaceAll(v, "{host}", host)
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HedgeConfig sends GET and HEAD requests a second time, to another
+// backend when there is one, if the origin hasn't answered after a delay,
+// and uses whichever answer comes first. The delay is Delay, or with
+// Percentile that percentile of the origin's recent latencies, e.g. 0.95,
+// Delay standing in until enough are known.
+type HedgeConfig struct {
+	Delay      Duration `json:"delay"`
+	Percentile float64  `json:"percentile"`
+}
+
+func (c *HedgeConfig) validate() error {
+	if c.Delay < 0 {
+		return fmt.Errorf("hedge: delay must not be negative")
+	}
+	if c.Percentile < 0 || c.Percentile >= 1 {
+		return fmt.Errorf("hedge: percentile must be between 0 and 1")
+	}
+	return nil
+}
+
+const (
+	// latencyWindowSize is how many of an origin's latest latencies the
+	// hedge percentile is taken over, and minHedgeSamples how many it
+	// needs.
+	latencyWindowSize = 256
+	minHedgeSamples   = 20
+)
+
+// latencyWindow keeps an origin's latest latencies.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencyWindowSize]time.Duration
+	n, next int
+}
+
+func (w *latencyWindow) record(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+	w.n = min(w.n+1, latencyWindowSize)
+}
+
+// percentile returns the p percentile, false with too few samples.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if w.n < minHedgeSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := slices.Clone(w.samples[:w.n])
+	w.mu.Unlock()
+	slices.Sort(sorted)
+	return sorted[int(p*float64(len(sorted)-1))], true
+}
+
+// hedgeDelay returns how long to wait on o before hedging, zero to not.
+func (cps *Server) hedgeDelay(o *origin) time.Duration {
+	cfg := cps.config().Hedge
+	if cfg.Percentile > 0 {
+		if d, ok := o.latencies.percentile(cfg.Percentile); ok {
+			return d
+		}
+	}
+	return time.Duration(cfg.Delay)
+}
+
+type hedgeAttempt struct {
+	b      *backend
+	resp   *http.Response
+	body   []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+func (a *hedgeAttempt) good() bool {
+	return a.err == nil && a.resp.StatusCode < 500
+}
+
+// fetchHedged is fetchOnce, sending req again after the hedge delay when
+// b hasn't answered by then. The first good answer is returned with the
+// backend that gave it, and the other request cancelled. Hedged requests
+// are only sent for GET and HEAD.
+func (cps *Server) fetchHedged(ctx context.Context, o *origin, req *http.Request, b *backend, path string) (*http.Response, []byte, *backend, error) {
+	delay := cps.hedgeDelay(o)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		delay = 0
+	}
+	start := time.Now()
+	if delay == 0 {
+		resp, body, err := cps.fetchOnce(req, b, path)
+		if err == nil {
+			o.latencies.record(time.Since(start))
+		}
+		return resp, body, b, err
+	}
+
+	results := make(chan *hedgeAttempt, 2)
+	launch := func(b *backend) *hedgeAttempt {
+		actx, cancel := context.WithCancel(ctx)
+		a := &hedgeAttempt{b: b, cancel: cancel}
+		go func() {
+			a.resp, a.body, a.err = cps.fetchOnce(req.Clone(actx), b, path)
+			results <- a
+		}()
+		return a
+	}
+	attempts := []*hedgeAttempt{launch(b)}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for pending := 1; ; {
+		select {
+		case <-timer.C:
+			other := o.pick([]*backend{b})
+			if other == nil {
+				other = b
+			}
+			cps.counters.hedges.Add(1)
+			attempts = append(attempts, launch(other))
+			pending++
+		case a := <-results:
+			pending--
+			if !a.good() && pending > 0 {
+				// the other one may still do better
+				if !errors.Is(a.err, context.Canceled) {
+					o.report(a.b, false)
+				}
+				if a.err == nil && a.body == nil {
+					// a streamed 5xx, its body is still open
+					a.resp.Body.Close()
+				}
+				a.cancel()
+				continue
+			}
+			if a.err == nil {
+				o.latencies.record(time.Since(start))
+			}
+			// a streamed body is still being relayed, it ends with ctx
+			if a.err != nil || a.body != nil {
+				a.cancel()
+			}
+			for _, other := range attempts {
+				if other != a {
+					other.cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					// a streamed loser's body is still open
+					if lost := <-results; lost.err == nil && lost.body == nil {
+						lost.resp.Body.Close()
+					}
+				}()
+			}
+			return a.resp, a.body, a.b, a.err
+		}
+	}
+}
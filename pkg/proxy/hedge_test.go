@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A streamed 5xx losing to the hedged request has its body closed right
+// away, not once the winner is in.
+func TestHedgeClosesStreamedLoser(t *testing.T) {
+	closed := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(closed)
+	}))
+	defer slow.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer other.Close()
+
+	cps := newTestServer(t, "", func(cfg *Config) {
+		cfg.Origins = []string{slow.URL, other.URL}
+		cfg.Hedge.Delay = Duration(10 * time.Millisecond)
+	})
+	o := cps.onlyOrigin(t)
+	var b *backend
+	for _, ob := range o.backends {
+		if ob.url == slow.URL {
+			b = ob
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, slow.URL+"/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, body, _, err := cps.fetchHedged(context.Background(), o, req, b, "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got %d %q, want 200 ok", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, the losing stream was held open until the winner answered", elapsed)
+	}
+}
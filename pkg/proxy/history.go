@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// HistoryConfig enables keeping past versions of cached responses, which
+// allowlisted clients can ask for with an X-Proxy-As-Of header.
+type HistoryConfig struct {
+	// Versions is how many versions are kept per key. Zero disables history.
+	Versions int      `json:"versions"`
+	MaxAge   Duration `json:"max_age"`
+	// Allow lists the client IPs or CIDRs allowed to time travel.
+	Allow []string `json:"allow"`
+
+	allowNets []*net.IPNet
+}
+
+func (hc *HistoryConfig) validate() error {
+	if hc.Versions < 0 {
+		return fmt.Errorf("history: versions must not be negative")
+	}
+	if hc.MaxAge == 0 {
+		hc.MaxAge = Duration(7 * 24 * time.Hour)
+	}
+	nets, err := parseCIDRs(hc.Allow)
+	if err != nil {
+		return fmt.Errorf("history: %v", err)
+	}
+	hc.allowNets = nets
+	return nil
+}
+
+// parseCIDRs parses a list of CIDRs, taking plain IPs as single hosts.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipAllowed(nets []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type version struct {
+	storedAt time.Time
+	entry    *cache.Entry
+	hash     string
+}
+
+// history keeps the last few distinct versions of every key, oldest first.
+type history struct {
+	cfg      HistoryConfig
+	versions map[string][]version
+	mu       sync.Mutex
+}
+
+func newHistory(cfg HistoryConfig) *history {
+	return &history{cfg: cfg, versions: make(map[string][]version)}
+}
+
+func (h *history) enabled() bool {
+	return h.cfg.Versions > 0
+}
+
+// record adds entry as the newest version of key, unless it's identical to
+// the current newest one.
+func (h *history) record(key string, entry *cache.Entry) {
+	if !h.enabled() {
+		return
+	}
+	hash := cache.HashBody(entry.Body)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	vs := h.versions[key]
+	if n := len(vs); n > 0 && vs[n-1].hash == hash && vs[n-1].entry.StatusCode == entry.StatusCode {
+		return
+	}
+	vs = append(vs, version{storedAt: time.Now(), entry: entry, hash: hash})
+	if len(vs) > h.cfg.Versions {
+		vs = vs[len(vs)-h.cfg.Versions:]
+	}
+	h.versions[key] = vs
+}
+
+// asOf returns the version of key that was current at t.
+func (h *history) asOf(key string, t time.Time) (version, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	vs := h.versions[key]
+	i := sort.Search(len(vs), func(i int) bool { return vs[i].storedAt.After(t) })
+	if i == 0 {
+		return version{}, false
+	}
+	return vs[i-1], true
+}
+
+func (h *history) Cleanup() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Duration(h.cfg.MaxAge))
+	for k, vs := range h.versions {
+		i := sort.Search(len(vs), func(i int) bool { return !vs[i].storedAt.Before(cutoff) })
+		if i == len(vs) {
+			delete(h.versions, k)
+		} else {
+			h.versions[k] = vs[i:]
+		}
+	}
+}
+
+// parseAsOf accepts RFC 3339, HTTP dates and unix seconds.
+func parseAsOf(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
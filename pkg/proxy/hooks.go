@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// Hooks intercept requests at points of their way through the proxy. Any
+// of them may be nil. Several Hooks run in the order they're configured in.
+type Hooks struct {
+	// OnRequest runs first, before the request is routed, and may change
+	// r. Returning false ends the request, the hook having answered it
+	// through w.
+	OnRequest func(w http.ResponseWriter, r *http.Request) bool
+	// OnCacheHit runs when entry is served from the cache under key, fresh
+	// or stale. entry is shared with the cache and must not be changed.
+	OnCacheHit func(r *http.Request, key string, entry *cache.Entry)
+	// OnCacheMiss runs when key isn't cached, before going to the origin.
+	OnCacheMiss func(r *http.Request, key string)
+	// OnResponse runs on every origin response, before it's stored and
+	// written to the client, and may change entry.
+	OnResponse func(r *http.Request, entry *cache.Entry)
+	// OnStore runs before entry is stored under key. Returning false keeps
+	// it out of the cache; it's still sent to the client.
+	OnStore func(r *http.Request, key string, entry *cache.Entry) bool
+}
+
+type hookChain []Hooks
+
+func (hc hookChain) onRequest(w http.ResponseWriter, r *http.Request) bool {
+	for _, h := range hc {
+		if h.OnRequest != nil && !h.OnRequest(w, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hc hookChain) onCacheHit(r *http.Request, key string, entry *cache.Entry) {
+	for _, h := range hc {
+		if h.OnCacheHit != nil {
+			h.OnCacheHit(r, key, entry)
+		}
+	}
+}
+
+func (hc hookChain) onCacheMiss(r *http.Request, key string) {
+	for _, h := range hc {
+		if h.OnCacheMiss != nil {
+			h.OnCacheMiss(r, key)
+		}
+	}
+}
+
+func (hc hookChain) onResponse(r *http.Request, entry *cache.Entry) {
+	for _, h := range hc {
+		if h.OnResponse != nil {
+			h.OnResponse(r, entry)
+		}
+	}
+}
+
+func (hc hookChain) onStore(r *http.Request, key string, entry *cache.Entry) bool {
+	for _, h := range hc {
+		if h.OnStore != nil && !h.OnStore(r, key, entry) {
+			return false
+		}
+	}
+	return true
+}
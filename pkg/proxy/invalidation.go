@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// InvalidationConfig spreads purges over every proxy of a deployment.
+// Purges made through any proxy's admin API are published on Channel of
+// the Redis server at Redis, a redis://[user:password@]host[:port] URL,
+// and every proxy subscribed applies them to its own cache. Purges
+// published while a proxy is disconnected don't reach it; its copies
+// still expire with their TTL.
+type InvalidationConfig struct {
+	Redis   string `json:"redis"`
+	Channel string `json:"channel"`
+}
+
+func (c *InvalidationConfig) validate() error {
+	if c.Redis == "" {
+		return nil
+	}
+	if err := validateRedisURL(c.Redis); err != nil {
+		return fmt.Errorf("invalidation: %v", err)
+	}
+	if c.Channel == "" {
+		c.Channel = "caching-proxy:invalidate"
+	}
+	return nil
+}
+
+const (
+	invalidationMinBackoff = time.Second
+	invalidationMaxBackoff = 30 * time.Second
+)
+
+// invalidation is one purge, as the admin API was asked for it. Exactly one
+// of Key, Prefix, Path, Regex and Tags is set.
+type invalidation struct {
+	// From is the proxy that was asked, which has applied it already.
+	From   string `json:"from"`
+	Key    string `json:"key,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	// Path is matched in the cache namespace of Host.
+	Path  string   `json:"path,omitempty"`
+	Host  string   `json:"host,omitempty"`
+	Regex string   `json:"regex,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Soft  bool     `json:"soft,omitempty"`
+}
+
+// invalidate purges what inv says from the cache and tells the other
+// proxies to do the same, returning how many entries were purged here.
+func (cps *Server) invalidate(inv invalidation) int {
+	n := cps.applyInvalidation(inv)
+	cps.bus.publish(inv)
+	cps.webhooks.purged(inv, n)
+	return n
+}
+
+func (cps *Server) applyInvalidation(inv invalidation) int {
+	switch {
+	case inv.Key != "":
+		if inv.Soft && cps.Cache.Expire(inv.Key) || !inv.Soft && cps.Cache.Delete(inv.Key) {
+			return 1
+		}
+		return 0
+	case len(inv.Tags) > 0:
+		n := 0
+		for key := range cps.tags.lookup(inv.Tags, cps.Cache.Meta) {
+			if inv.Soft && cps.Cache.Expire(key) || !inv.Soft && cps.Cache.Delete(key) {
+				n++
+			}
+		}
+		return n
+	case inv.Regex != "":
+		re, err := regexp.Compile(inv.Regex)
+		if err != nil {
+			slog.Warn("invalidation: bad pattern", "regex", inv.Regex, "err", err)
+			return 0
+		}
+		return cps.purge(re.MatchString, inv.Soft)
+	case inv.Path != "":
+		inPath := pathMatcher(inv.Path)
+		inHost := namespaceMatcher(cps.config().host(inv.Host))
+		return cps.purge(func(key string) bool { return inPath(key) && inHost(key) }, inv.Soft)
+	case inv.Prefix != "":
+		return cps.purge(pathMatcher(inv.Prefix+"*"), inv.Soft)
+	}
+	return 0
+}
+
+// invalidationBus carries invalidations between proxies over Redis
+// pub/sub. A nil bus, without Redis configured, drops them.
+type invalidationBus struct {
+	cfg InvalidationConfig
+	// id tells this proxy's own invalidations apart when they come back.
+	id  string
+	pub *redisConn
+	mu  sync.Mutex
+}
+
+func newInvalidationBus(cfg InvalidationConfig) *invalidationBus {
+	if cfg.Redis == "" {
+		return nil
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	return &invalidationBus{cfg: cfg, id: hex.EncodeToString(id[:])}
+}
+
+// publish sends inv to the other proxies, reconnecting once if the
+// connection went bad since the last purge.
+func (b *invalidationBus) publish(inv invalidation) {
+	if b == nil {
+		return
+	}
+	inv.From = b.id
+	data, _ := json.Marshal(inv)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), redisDialTimeout)
+			b.pub, err = dialRedis(ctx, b.cfg.Redis)
+			cancel()
+			if err != nil {
+				b.pub = nil
+				continue
+			}
+		}
+		if _, err = b.pub.do("PUBLISH", b.cfg.Channel, string(data)); err == nil {
+			return
+		}
+		b.pub.Close()
+		b.pub = nil
+	}
+	slog.Error("invalidation: couldn't publish purge, other proxies keep their copies", "err", err)
+}
+
+// run applies the other proxies' invalidations until ctx is done,
+// resubscribing whenever the connection drops.
+func (b *invalidationBus) run(ctx context.Context, wg *sync.WaitGroup, apply func(invalidation)) {
+	if b == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		backoff := invalidationMinBackoff
+		for ctx.Err() == nil {
+			err := b.subscribe(ctx, apply, func() { backoff = invalidationMinBackoff })
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Warn("invalidation: lost the subscription, retrying", "retry_in", backoff, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff = min(2*backoff, invalidationMaxBackoff)
+		}
+		b.mu.Lock()
+		if b.pub != nil {
+			b.pub.Close()
+			b.pub = nil
+		}
+		b.mu.Unlock()
+	}()
+}
+
+func (b *invalidationBus) subscribe(ctx context.Context, apply func(invalidation), subscribed func()) error {
+	conn, err := dialRedis(ctx, b.cfg.Redis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := conn.do("SUBSCRIBE", b.cfg.Channel); err != nil {
+		return err
+	}
+	slog.Info("invalidation: subscribed", "channel", b.cfg.Channel)
+	subscribed()
+	for {
+		reply, err := conn.receive()
+		if err != nil {
+			return err
+		}
+		// ["message", channel, payload]
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		payload, _ := msg[2].(string)
+		var inv invalidation
+		if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+			slog.Warn("invalidation: ignoring malformed message", "err", err)
+			continue
+		}
+		if inv.From != b.id {
+			apply(inv)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Cache keys are in the format of keyScheme. They look like
+// "GET-/path?query": the method whose entry answers the request, GET for
+// both GET and HEAD and POST for a route caching POSTs, then the path and
+// the query the KeyConfig keeps, its parameters sorted. "|name=value"
+// follows for every variant, in this order: the KeyConfig version as "v=",
+// its headers and cookies as "h.name=value" and "c.name=value", a body
+// hash as "body=", the user partition as "user=", then the variants the
+// route varies on, e.g. "GET-/path|lang=fr", and "canary=1" for a route's
+// canary. Keys of a virtual host carry its namespace too,
+// "GET-/path|host=example.com". The path is escaped as in a URL, so a '?'
+// or '|' in it reads "%3F" or "%7C", and values are query escaped.
+//
+// Requests of other methods aren't cached and have no key.
+
+// keyScheme is the version of the key format above, reported in the
+// stats for tools reading keys. Bump it when the format changes; 2 started
+// escaping the path.
+const keyScheme = 2
+
+const (
+	versionVariant = "v"
+	hostVariant    = "host"
+	bodyVariant    = "body"
+	headerVariant  = "h."
+	cookieVariant  = "c."
+	userVariant    = "user"
+	canaryVariant  = "canary"
+)
+
+// partitionCookiePrefix starts a PartitionBy naming a cookie.
+const partitionCookiePrefix = "cookie:"
+
+// KeyConfig picks the parts of a request its cache key is made of, on top
+// of the method and path.
+type KeyConfig struct {
+	// IgnoreQuery leaves the query string out of the key. Otherwise it's
+	// part of it with its parameters sorted, only QueryParams when they're
+	// set, and without IgnoreQueryParams, e.g. "utm_source".
+	IgnoreQuery       bool     `json:"ignore_query"`
+	QueryParams       []string `json:"query_params"`
+	IgnoreQueryParams []string `json:"ignore_query_params"`
+	// Headers and Cookies are request headers and cookies whose values are
+	// part of the key. They're sent on to the origin, unlike the other
+	// headers and cookies of cached requests.
+	Headers []string `json:"headers"`
+	Cookies []string `json:"cookies"`
+	// Body adds a hash of the request body.
+	Body bool `json:"body"`
+	// PartitionBy gives every user a cache of their own, keyed by a hash of
+	// this request header, e.g. "Authorization" or "X-User-ID", or of a
+	// cookie given as "cookie:name". Requests carrying it aren't bypassed
+	// for it and it's sent on to the origin. Requests without it share one
+	// anonymous partition.
+	PartitionBy string `json:"partition_by"`
+	// Version is added to every key when set. Changing it starts the
+	// routes over with an empty cache, e.g. after changing what their key
+	// is made of, the entries of the old keys expiring unused.
+	Version string `json:"version"`
+}
+
+func (kc *KeyConfig) validate() error {
+	if kc.IgnoreQuery && (len(kc.QueryParams) > 0 || len(kc.IgnoreQueryParams) > 0) {
+		return fmt.Errorf("key: ignore_query leaves no query_params to pick")
+	}
+	for i, h := range kc.Headers {
+		kc.Headers[i] = http.CanonicalHeaderKey(h)
+	}
+	if name, ok := strings.CutPrefix(kc.PartitionBy, partitionCookiePrefix); ok {
+		if name == "" {
+			return fmt.Errorf("key: partition_by names no cookie")
+		}
+	} else {
+		kc.PartitionBy = http.CanonicalHeaderKey(kc.PartitionBy)
+	}
+	return nil
+}
+
+// partitionHeader and partitionCookie return what the user partition is
+// derived from, "" for neither.
+func (kc *KeyConfig) partitionHeader() string {
+	if strings.HasPrefix(kc.PartitionBy, partitionCookiePrefix) {
+		return ""
+	}
+	return kc.PartitionBy
+}
+
+func (kc *KeyConfig) partitionCookie() string {
+	if name, ok := strings.CutPrefix(kc.PartitionBy, partitionCookiePrefix); ok {
+		return name
+	}
+	return ""
+}
+
+// partition returns the hash naming r's user partition, "" for the
+// anonymous one.
+func (kc *KeyConfig) partition(r *http.Request) string {
+	var v string
+	if h := kc.partitionHeader(); h != "" {
+		v = r.Header.Get(h)
+	} else if name := kc.partitionCookie(); name != "" {
+		if c, err := r.Cookie(name); err == nil {
+			v = c.Value
+		}
+	}
+	if v == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:16])
+}
+
+// keyConfig returns the key rules for route.
+func (c *Config) keyConfig(route *RouteConfig) *KeyConfig {
+	if route != nil && route.Key != nil {
+		return route.Key
+	}
+	return &c.Key
+}
+
+// query returns the part of q that goes into the key, encoded.
+func (kc *KeyConfig) query(q url.Values) string {
+	if kc.IgnoreQuery {
+		return ""
+	}
+	for name := range q {
+		if len(kc.QueryParams) > 0 && !slices.Contains(kc.QueryParams, name) || slices.Contains(kc.IgnoreQueryParams, name) {
+			delete(q, name)
+		}
+	}
+	return q.Encode()
+}
+
+// key returns the key of r for path, before the host namespace and
+// variants. The body is hashed with Body or withBody, normalized.
+func (kc *KeyConfig) key(r *http.Request, path string, withBody bool) (string, error) {
+	key := cacheKey(keyMethod(r.Method), path, kc.query(r.URL.Query()))
+	if kc.Version != "" {
+		key = withVariant(key, versionVariant, url.QueryEscape(kc.Version))
+	}
+	for _, h := range kc.Headers {
+		key = withVariant(key, headerVariant+strings.ToLower(h), url.QueryEscape(r.Header.Get(h)))
+	}
+	for _, name := range kc.Cookies {
+		value := ""
+		if c, err := r.Cookie(name); err == nil {
+			value = c.Value
+		}
+		key = withVariant(key, cookieVariant+name, url.QueryEscape(value))
+	}
+	if kc.Body || withBody {
+		body, err := bufferBody(r)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(normalizeBody(r.Header, body))
+		key = withVariant(key, bodyVariant, hex.EncodeToString(sum[:]))
+	}
+	if user := kc.partition(r); user != "" {
+		key = withVariant(key, userVariant, user)
+	}
+	return key, nil
+}
+
+// forward copies the headers and cookies of src the key is made of to the
+// origin request headers dst.
+func (kc *KeyConfig) forward(dst, src http.Header) {
+	headers, names := kc.Headers, kc.Cookies
+	if h := kc.partitionHeader(); h != "" {
+		headers = append(slices.Clip(headers), h)
+	} else if name := kc.partitionCookie(); name != "" {
+		names = append(slices.Clip(names), name)
+	}
+	for _, h := range headers {
+		if v := src.Values(h); len(v) > 0 {
+			dst[h] = v
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	r := http.Request{Header: src}
+	var cookies []string
+	for _, name := range names {
+		if c, err := r.Cookie(name); err == nil {
+			cookies = append(cookies, c.String())
+		}
+	}
+	if len(cookies) > 0 {
+		dst.Set("Cookie", strings.Join(cookies, "; "))
+	}
+}
+
+// keyMethod is the method whose entries answer method. HEAD is served from
+// the GET entry, with the body left out.
+func keyMethod(method string) string {
+	if method == http.MethodHead {
+		return http.MethodGet
+	}
+	return method
+}
+
+// cacheKey returns the key of path and the encoded query. The path is
+// escaped, so a '?' or '|' in it can't pass for the query or a variant,
+// like "/a%7Chost=b" for the host variant of another site.
+func cacheKey(method, path, query string) string {
+	key := fmt.Sprintf("%s-%s", method, (&url.URL{Path: path}).EscapedPath())
+	if query != "" {
+		key += "?" + query
+	}
+	return key
+}
+
+func withVariant(key, name, value string) string {
+	return key + "|" + name + "=" + value
+}
+
+// keyTarget returns the path and query a cache key was built from, as an
+// escaped request URI.
+func keyTarget(key string) string {
+	_, rest, _ := strings.Cut(key, "-")
+	target, _, _ := strings.Cut(rest, "|")
+	return target
+}
+
+// keyPath returns the path a cache key was built from, unescaped.
+func keyPath(key string) string {
+	escaped, _, _ := strings.Cut(keyTarget(key), "?")
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return escaped
+	}
+	return path
+}
+
+// keyVariant returns the value of the named variant in key.
+func keyVariant(key, name string) (string, bool) {
+	_, variants, _ := strings.Cut(key, "|")
+	for _, v := range strings.Split(variants, "|") {
+		if value, ok := strings.CutPrefix(v, name+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
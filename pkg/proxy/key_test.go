@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyPath(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		target   string
+		wantKey  string
+		wantPath string
+	}{
+		{name: "plain", target: "/a/b?y=2&x=1", wantKey: "GET-/a/b?x=1&y=2", wantPath: "/a/b"},
+		{name: "escaped question mark", target: "/a%3Fb?x=1", wantKey: "GET-/a%3Fb?x=1", wantPath: "/a?b"},
+		{name: "escaped pipe", target: "/foo%7Chost=victim.example", wantKey: "GET-/foo%7Chost=victim.example", wantPath: "/foo|host=victim.example"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			key, err := (&KeyConfig{}).key(r, r.URL.Path, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tc.wantKey {
+				t.Errorf("got key %q, want %q", key, tc.wantKey)
+			}
+			if got, want := keyTarget(key), tc.wantKey[len("GET-"):]; got != want {
+				t.Errorf("got target %q, want %q", got, want)
+			}
+			if got := keyPath(key); got != tc.wantPath {
+				t.Errorf("got path %q, want %q", got, tc.wantPath)
+			}
+		})
+	}
+}
+
+// A path spelling out another site's host variant must not get that
+// site's key.
+func TestKeyHostNamespace(t *testing.T) {
+	kc := &KeyConfig{}
+	r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	victim, err := kc.key(r, r.URL.Path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim = withVariant(victim, hostVariant, "victim.example")
+
+	r = httptest.NewRequest(http.MethodGet, "/foo%7Chost=victim.example", nil)
+	forged, err := kc.key(r, r.URL.Path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forged == victim {
+		t.Fatalf("the default site's %q got vhost victim.example's key", r.URL.Path)
+	}
+	if _, ok := keyVariant(forged, hostVariant); ok {
+		t.Errorf("key %q has a host variant", forged)
+	}
+}
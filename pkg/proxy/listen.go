@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Listen addresses are a host:port, unix:/path/to.sock for a Unix domain
+// socket, or systemd for a socket systemd passed by socket activation.
+// With several sockets, systemd:name picks the one whose
+// FileDescriptorName is name.
+const (
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd"
+)
+
+// systemdFirstFD is the first file descriptor systemd passes, after stdin,
+// stdout and stderr.
+const systemdFirstFD = 3
+
+func validateListenAddr(addr string) error {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		if strings.TrimPrefix(addr, unixPrefix) == "" {
+			return fmt.Errorf("%q has no socket path", addr)
+		}
+	case addr == systemdPrefix || strings.HasPrefix(addr, systemdPrefix+":"):
+	default:
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// listen opens a listener on addr, see validateListenAddr for the forms it
+// takes.
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		path := strings.TrimPrefix(addr, unixPrefix)
+		// a socket left behind by a proxy that didn't exit cleanly
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	case addr == systemdPrefix:
+		return systemdListener("")
+	case strings.HasPrefix(addr, systemdPrefix+":"):
+		return systemdListener(strings.TrimPrefix(addr, systemdPrefix+":"))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// systemdListener returns the socket systemd passed named name, or the
+// first one when name is empty, as described in sd_listen_fds(3).
+func systemdListener(name string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if n < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+	i := 0
+	if name != "" {
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		if i = slices.Index(names, name); i < 0 || i >= n {
+			return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+		}
+	}
+	f := os.NewFile(uintptr(systemdFirstFD+i), "systemd:"+name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't use the socket passed by systemd. error: %v", err)
+	}
+	return ln, nil
+}
+
+// What a listener serves.
+const (
+	serveProxy   = "proxy"
+	serveAdmin   = "admin"
+	serveMetrics = "metrics"
+)
+
+// ListenerConfig is one address the proxy listens on. Serve lists what's
+// served there, out of "proxy", "admin" for the /_cache/ API and "metrics"
+// for /metrics, and is "proxy" alone when empty. With CertFile and KeyFile
+// it's served over HTTPS, HTTP/2 included for clients that negotiate it.
+// H2C serves HTTP/2 without TLS too, to clients that know to use it. With
+// ProxyProtocol every connection must start with a PROXY protocol header,
+// see proxyProtoListener.
+type ListenerConfig struct {
+	Addr          string   `json:"addr"`
+	Serve         []string `json:"serve"`
+	CertFile      string   `json:"cert_file"`
+	KeyFile       string   `json:"key_file"`
+	H2C           bool     `json:"h2c"`
+	ProxyProtocol bool     `json:"proxy_protocol"`
+}
+
+func (c *ListenerConfig) validate() error {
+	if err := validateListenAddr(c.Addr); err != nil {
+		return fmt.Errorf("listeners: %v", err)
+	}
+	if len(c.Serve) == 0 {
+		c.Serve = []string{serveProxy}
+	}
+	for _, s := range c.Serve {
+		if s != serveProxy && s != serveAdmin && s != serveMetrics {
+			return fmt.Errorf("listeners: %s: serve must list %q, %q or %q", c.Addr, serveProxy, serveAdmin, serveMetrics)
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("listeners: %s: set both cert_file and key_file, or neither", c.Addr)
+	}
+	if c.H2C && c.CertFile != "" {
+		return fmt.Errorf("listeners: %s: h2c is HTTP/2 without TLS, TLS listeners serve HTTP/2 already", c.Addr)
+	}
+	return nil
+}
+
+// listeners returns the configured Listeners, or without any those Port,
+// AdminAddr and MetricsAddr stand for.
+func (c *Config) listeners() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	main := ListenerConfig{Addr: c.Port, Serve: []string{serveProxy}, H2C: c.H2C, ProxyProtocol: c.ProxyProtocol}
+	var ls []ListenerConfig
+	if c.AdminAddr == "" {
+		main.Serve = append(main.Serve, serveAdmin)
+	} else {
+		ls = append(ls, ListenerConfig{Addr: c.AdminAddr, Serve: []string{serveAdmin}})
+	}
+	if c.MetricsAddr != "" {
+		ls = append(ls, ListenerConfig{Addr: c.MetricsAddr, Serve: []string{serveMetrics}})
+	}
+	return append([]ListenerConfig{main}, ls...)
+}
+
+// adminIsPublic tells whether a listener serves the admin API next to the
+// proxied traffic.
+func (c *Config) adminIsPublic() bool {
+	for _, l := range c.listeners() {
+		if slices.Contains(l.Serve, serveProxy) && slices.Contains(l.Serve, serveAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerFor returns the handler for a listener serving serve.
+func (cps *Server) handlerFor(serve []string) http.Handler {
+	var admin, metrics http.Handler
+	if slices.Contains(serve, serveAdmin) {
+		admin = cps.adminHandler()
+	}
+	if slices.Contains(serve, serveMetrics) {
+		metrics = cps.metrics.handler()
+	}
+	if !slices.Contains(serve, serveProxy) {
+		mux := http.NewServeMux()
+		if metrics != nil {
+			mux.Handle("GET /metrics", metrics)
+		}
+		if admin != nil {
+			mux.Handle("/", admin)
+		}
+		return mux
+	}
+	// not going through a ServeMux, it would redirect "//a" to "/a" before
+	// the route's trailing slash policy gets a say.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case metrics != nil && r.Method == http.MethodGet && r.URL.Path == "/metrics":
+			metrics.ServeHTTP(w, r)
+		case admin != nil && isAdminRequest(r):
+			admin.ServeHTTP(w, r)
+		default:
+			cps.handleRequests(w, r)
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("log_level must be debug, info, warn or error")
+	}
+	return level, nil
+}
+
+// SetupLogging makes the default slog logger, and with it the log package,
+// write to stderr at level in format.
+func SetupLogging(level, format string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case logFormatText:
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case logFormatJSON:
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("log_format must be %q or %q", logFormatText, logFormatJSON)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
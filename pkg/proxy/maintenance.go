@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaintenanceConfig answers requests for Paths, exact or a prefix ending
+// with '*', all requests when empty, with a 503, Retry-After and Body
+// instead of going to the cache or the origin; every other path is served
+// as usual. Body is read from BodyFile when set, as ContentType. Enabled is
+// where the proxy starts, the admin API switches it at runtime.
+type MaintenanceConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Paths       []string `json:"paths"`
+	RetryAfter  Duration `json:"retry_after"`
+	Body        string   `json:"body"`
+	BodyFile    string   `json:"body_file"`
+	ContentType string   `json:"content_type"`
+}
+
+func (c *MaintenanceConfig) validate() error {
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("maintenance: retry_after must not be negative")
+	}
+	if c.RetryAfter == 0 {
+		c.RetryAfter = Duration(5 * time.Minute)
+	}
+	if c.BodyFile != "" {
+		body, err := os.ReadFile(c.BodyFile)
+		if err != nil {
+			return fmt.Errorf("maintenance: couldn't read body_file. error: %v", err)
+		}
+		c.Body = string(body)
+	}
+	if c.Body == "" {
+		c.Body = "down for maintenance, try again later\n"
+		if c.ContentType == "" {
+			c.ContentType = "text/plain; charset=utf-8"
+		}
+	}
+	if c.ContentType == "" {
+		c.ContentType = "text/html; charset=utf-8"
+	}
+	return nil
+}
+
+// maintenanceState is maintenance mode as the admin API last set it.
+type maintenanceState struct {
+	Enabled bool     `json:"enabled"`
+	Paths   []string `json:"paths"`
+}
+
+// maintenance returns whether maintenance mode is on and for which paths,
+// as the admin API set it or else as configured.
+func (cps *Server) maintenance() maintenanceState {
+	if st := cps.maintenanceOverride.Load(); st != nil {
+		return *st
+	}
+	cfg := cps.config().Maintenance
+	return maintenanceState{Enabled: cfg.Enabled, Paths: cfg.Paths}
+}
+
+func (st maintenanceState) covers(path string) bool {
+	if !st.Enabled {
+		return false
+	}
+	if len(st.Paths) == 0 {
+		return true
+	}
+	path = collapseSlashes(path)
+	for _, p := range st.Paths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(path, prefix) || p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (cps *Server) serveMaintenance(w http.ResponseWriter) {
+	cfg := cps.config().Maintenance
+	w.Header().Set("Content-Type", cfg.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(cfg.RetryAfter).Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(cfg.Body))
+}
+
+// handleMaintenance reports maintenance mode (GET /_cache/maintenance),
+// switches it (PUT with {"enabled": true, "paths": ["/api/*"]}) or hands it
+// back to the config (DELETE). A switch made here outlives config reloads.
+func (cps *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		var st maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		cps.maintenanceOverride.Store(&st)
+		slog.Info("maintenance mode switched", "enabled", st.Enabled, "paths", st.Paths)
+	case http.MethodDelete:
+		cps.maintenanceOverride.Store(nil)
+		slog.Info("maintenance mode back to the config", "enabled", cps.config().Maintenance.Enabled)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"maintenance": cps.maintenance(),
+		"from_config": cps.maintenanceOverride.Load() == nil,
+	})
+}
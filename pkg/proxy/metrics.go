@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metrics struct {
+	registry       *prometheus.Registry
+	originLatency  prometheus.Histogram
+	requestLatency prometheus.Histogram
+	objectSize     prometheus.Histogram
+}
+
+// newMetrics registers the proxy's Prometheus metrics. Counters and gauges
+// are read from the stats the server keeps anyway, so both views agree.
+func newMetrics(cps *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		originLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "caching_proxy_origin_latency_seconds",
+			Help:    "Time taken by the origin to send a full response.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		requestLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "caching_proxy_request_latency_seconds",
+			Help:    "Time taken to answer a client request, hits included.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		objectSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "caching_proxy_object_size_bytes",
+			Help:    "Size of response bodies fetched from the origin.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+		}),
+	}
+
+	counter := func(name, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, f)
+	}
+	gauge := func(name, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+	}
+	m.registry.MustRegister(
+		m.originLatency,
+		m.requestLatency,
+		m.objectSize,
+		counter("caching_proxy_cache_hits_total", "Requests answered from a fresh cache entry.",
+			func() float64 { return float64(cps.counters.hits.Load()) }),
+		counter("caching_proxy_cache_stale_hits_total", "Requests answered from an expired cache entry.",
+			func() float64 { return float64(cps.counters.staleHits.Load()) }),
+		counter("caching_proxy_cache_misses_total", "Requests forwarded to the origin.",
+			func() float64 { return float64(cps.counters.misses.Load()) }),
+		counter("caching_proxy_cache_bypassed_total", "Requests forwarded to the origin without a cache lookup.",
+			func() float64 { return float64(cps.counters.bypassed.Load()) }),
+		counter("caching_proxy_cache_refreshes_total", "Entries refetched ahead of expiring, or for a client's X-Cache-Refresh.",
+			func() float64 { return float64(cps.counters.refreshes.Load()) }),
+		counter("caching_proxy_cache_revalidations_total", "Expired entries the origin answered a 304 for, kept for another TTL.",
+			func() float64 { return float64(cps.counters.revalidated.Load()) }),
+		counter("caching_proxy_rate_limited_total", "Requests refused with a 429 for exceeding a rate limit.",
+			func() float64 { return float64(cps.counters.rateLimited.Load()) }),
+		counter("caching_proxy_origin_5xx_total", "Origin responses with a 5xx status.",
+			func() float64 { return float64(cps.counters.upstream5xx.Load()) }),
+		counter("caching_proxy_origin_retries_total", "Origin requests sent again after a transient failure.",
+			func() float64 { return float64(cps.counters.retries.Load()) }),
+		counter("caching_proxy_origin_hedged_requests_total", "Second origin requests sent because the first was slow.",
+			func() float64 { return float64(cps.counters.hedges.Load()) }),
+		counter("caching_proxy_shadow_requests_total", "Requests mirrored to the shadow origin.",
+			func() float64 { return float64(cps.counters.shadowed.Load()) }),
+		counter("caching_proxy_shadow_dropped_total", "Mirrors not sent for too many already in flight.",
+			func() float64 { return float64(cps.counters.shadowDropped.Load()) }),
+		counter("caching_proxy_peer_fetches_total", "Cache misses answered by the peer owning the key.",
+			func() float64 { return float64(cps.counters.peerFetches.Load()) }),
+		counter("caching_proxy_cache_evictions_total", "Entries dropped from the cache after expiring.",
+			func() float64 { return float64(cps.Cache.Stats().Evictions) }),
+		gauge("caching_proxy_cache_entries", "Entries currently in the cache.",
+			func() float64 { return float64(cps.Cache.Stats().Entries) }),
+		gauge("caching_proxy_cache_bytes", "Bytes of distinct bodies currently in the cache.",
+			func() float64 { return float64(cps.Cache.Stats().Bytes) }),
+		gauge("caching_proxy_degradation_level", "Number of degradation ladder steps in effect.",
+			func() float64 { return float64(cps.degrade.Level()) }),
+	)
+	for kind := range numUpstreamErrors {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "caching_proxy_origin_errors_total",
+			Help:        "Requests that failed without an origin response, by kind.",
+			ConstLabels: prometheus.Labels{"kind": kind.String()},
+		}, func() float64 { return float64(cps.counters.upstreamErrors[kind].Load()) }))
+	}
+	m.registry.MustRegister(originCollector{cps})
+	return m
+}
+
+var (
+	breakerOpenDesc = prometheus.NewDesc("caching_proxy_breaker_open",
+		"1 while the origin's circuit is open or half-open, 0 when closed.", []string{"origin"}, nil)
+	backendHealthyDesc = prometheus.NewDesc("caching_proxy_backend_healthy",
+		"1 while the origin backend is in rotation, 0 while it's ejected.", []string{"origin", "backend"}, nil)
+)
+
+// originCollector exports the state of the origins in use at each scrape,
+// those a reload brought in included.
+type originCollector struct {
+	cps *Server
+}
+
+func (c originCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerOpenDesc
+	ch <- backendHealthyDesc
+}
+
+func (c originCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, o := range c.cps.live.Load().origins {
+		open := 1.0
+		if o.breaker.stats().State == breakerClosed {
+			open = 0
+		}
+		ch <- prometheus.MustNewConstMetric(breakerOpenDesc, prometheus.GaugeValue, open, name)
+		for _, b := range o.backends {
+			healthy := 0.0
+			if b.healthy.Load() {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue, healthy, name, b.url)
+		}
+	}
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
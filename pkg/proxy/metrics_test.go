@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The origin gauges follow the origins a reload swaps in.
+func TestMetricsAfterReload(t *testing.T) {
+	const before, after = "http://127.0.0.1:1", "http://127.0.0.1:2"
+	cps := newTestServer(t, before, nil)
+	cfg := DefaultConfig()
+	cfg.Origin = after
+	if err := cps.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	cps.metrics.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`caching_proxy_breaker_open{origin="` + after + `"} 0`,
+		`caching_proxy_backend_healthy{backend="` + after + `",origin="` + after + `"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("no %s in the metrics", want)
+		}
+	}
+	if strings.Contains(body, `origin="`+before+`"`) {
+		t.Errorf("the metrics still report %s", before)
+	}
+}
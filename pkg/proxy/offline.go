@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// offlineMaxStale keeps entries for good in offline mode, where nothing
+// could replace them once they're gone.
+const offlineMaxStale = 100 * 365 * 24 * time.Hour
+
+// serveOffline answers r from the cache alone, expired entries included,
+// and with a 504 when key isn't cached. It returns the cache result.
+func (cps *Server) serveOffline(w http.ResponseWriter, r *http.Request, key string) string {
+	cps.mu.RLock()
+	defer cps.mu.RUnlock()
+	if val, ok := cps.Cache.Get(key); ok {
+		cps.counters.hits.Add(1)
+		cps.hooks.onCacheHit(r, key, val)
+		cps.writeCached(w, r, val, "HIT")
+		return "HIT"
+	}
+	if val, ok := cps.Cache.GetStale(key); ok {
+		cps.counters.staleHits.Add(1)
+		cps.hooks.onCacheHit(r, key, val)
+		cps.writeCached(w, r, val, "STALE")
+		return "STALE"
+	}
+	cps.counters.misses.Add(1)
+	cps.countUpstreamError(upstreamOffline)
+	cps.config().CacheStatus.set(w.Header(), "MISS")
+	cps.writeUpstreamError(w, r, upstreamOffline)
+	return "OFFLINE"
+}
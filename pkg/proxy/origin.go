@@ -0,0 +1,406 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+)
+
+// HealthCheckConfig probes every backend of origins with more than one
+// backend, taking failing ones out of rotation until they recover.
+type HealthCheckConfig struct {
+	// Path is requested on each backend, any status below 500 counts as
+	// healthy. Leaving it empty disables active checks; backends are then
+	// only ejected when requests to them fail.
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	// A backend is ejected after UnhealthyAfter failed checks in a row, and
+	// back after HealthyAfter successful ones.
+	UnhealthyAfter int `json:"unhealthy_after"`
+	HealthyAfter   int `json:"healthy_after"`
+}
+
+func (c *HealthCheckConfig) validate() error {
+	if c.Path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("health_check: path must start with '/'")
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(10 * time.Second)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(2 * time.Second)
+	}
+	if c.UnhealthyAfter <= 0 {
+		c.UnhealthyAfter = 3
+	}
+	if c.HealthyAfter <= 0 {
+		c.HealthyAfter = 2
+	}
+	return nil
+}
+
+func validateOriginURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("origin %q must be an http or https URL", raw)
+	}
+	return nil
+}
+
+// validateOrigins checks the origin settings shared by the top-level config,
+// hosts and routes: a single origin, or a list of backends to balance over.
+func validateOrigins(single string, list []string, balance *string) error {
+	if single != "" && len(list) > 0 {
+		return fmt.Errorf("set either origin or origins, not both")
+	}
+	for _, u := range list {
+		if err := validateOriginURL(u); err != nil {
+			return err
+		}
+	}
+	switch *balance {
+	case "":
+		*balance = balanceRoundRobin
+	case balanceRoundRobin, balanceLeastConn:
+	default:
+		return fmt.Errorf("balance must be %q or %q", balanceRoundRobin, balanceLeastConn)
+	}
+	return nil
+}
+
+// originSpec is one distinct set of backends in the config.
+type originSpec struct {
+	urls    []string
+	balance string
+}
+
+func newOriginSpec(single string, list []string, balance string) originSpec {
+	if len(list) == 0 {
+		list = []string{single}
+	}
+	return originSpec{urls: list, balance: balance}
+}
+
+// name identifies the origin in stats and metrics.
+func (s originSpec) name() string {
+	return strings.Join(s.urls, ",")
+}
+
+func (c *Config) defaultOrigin() originSpec {
+	return newOriginSpec(c.Origin, c.Origins, c.Balance)
+}
+
+// originSpecs lists every origin in the config once, the default one first.
+// Routes and hosts listing the same backends share one origin.
+func (c *Config) originSpecs() []originSpec {
+	specs := []originSpec{c.defaultOrigin()}
+	seen := map[string]bool{specs[0].name(): true}
+	add := func(single string, list []string, balance string) {
+		if single == "" && len(list) == 0 {
+			return
+		}
+		spec := newOriginSpec(single, list, balance)
+		if !seen[spec.name()] {
+			seen[spec.name()] = true
+			specs = append(specs, spec)
+		}
+	}
+	addRoute := func(rc RouteConfig) {
+		add(rc.Origin, rc.Origins, rc.Balance)
+		if rc.Canary != nil {
+			add(rc.Canary.Origin, nil, "")
+		}
+	}
+	for _, rc := range c.Routes {
+		addRoute(rc)
+	}
+	for _, h := range c.Hosts {
+		add(h.Origin, h.Origins, h.Balance)
+		for _, rc := range h.Routes {
+			addRoute(rc)
+		}
+	}
+	return specs
+}
+
+// passiveRetryAfter is how long a backend ejected for failing requests
+// waits for another chance when no active health check would bring it back.
+const passiveRetryAfter = 30 * time.Second
+
+// backend is one server of an origin.
+type backend struct {
+	url       string
+	healthy   atomic.Bool
+	active    atomic.Int64
+	ejectedAt atomic.Int64
+
+	mu        sync.Mutex
+	successes int
+	failures  int
+}
+
+// origin is where requests are forwarded to: one or more backends balanced
+// over, sharing a circuit breaker.
+type origin struct {
+	name     string
+	balance  string
+	backends []*backend
+	next     atomic.Uint64
+	breaker  *breaker
+	check    HealthCheckConfig
+	inflight semaphore
+	// latencies time the origin's answers, for hedging.
+	latencies latencyWindow
+	// stopChecks ends the health checks, once the origin is reloaded away.
+	stopChecks context.CancelFunc
+	webhooks   *webhooks
+}
+
+func newOrigins(cfg *Config, wh *webhooks) map[string]*origin {
+	origins := make(map[string]*origin)
+	for _, spec := range cfg.originSpecs() {
+		o := &origin{
+			name:     spec.name(),
+			balance:  spec.balance,
+			breaker:  newBreaker(cfg.Breaker),
+			inflight: newSemaphore(cfg.Concurrency.MaxInflightPerOrigin),
+			check:    cfg.HealthCheck,
+			webhooks: wh,
+		}
+		o.breaker.onOpen = func(reason string) {
+			wh.send(eventCircuitOpen, map[string]any{"origin": o.name, "reason": reason})
+		}
+		for _, u := range spec.urls {
+			b := &backend{url: u}
+			b.healthy.Store(true)
+			o.backends = append(o.backends, b)
+		}
+		origins[o.name] = o
+	}
+	return origins
+}
+
+// originFor returns the origin requests on route of site host are
+// forwarded to. Either may be nil.
+func (cps *Server) originFor(host *HostConfig, route *RouteConfig) *origin {
+	live := cps.live.Load()
+	switch {
+	case route != nil && (route.Origin != "" || len(route.Origins) > 0):
+		return live.origins[newOriginSpec(route.Origin, route.Origins, route.Balance).name()]
+	case host != nil:
+		return live.origins[newOriginSpec(host.Origin, host.Origins, host.Balance).name()]
+	}
+	return live.origins[live.config.defaultOrigin().name()]
+}
+
+// pick returns the backend for the next request, skipping unhealthy ones
+// and those in tried. With no healthy backend left it falls back to any
+// untried one, or nil when all have been tried.
+func (o *origin) pick(tried []*backend) *backend {
+	var candidates []*backend
+	for _, healthyOnly := range []bool{true, false} {
+		for _, b := range o.backends {
+			if (!healthyOnly || o.usable(b)) && !containsBackend(tried, b) {
+				candidates = append(candidates, b)
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if o.balance == balanceLeastConn {
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best
+	}
+	return candidates[o.next.Add(1)%uint64(len(candidates))]
+}
+
+func (o *origin) usable(b *backend) bool {
+	if b.healthy.Load() {
+		return true
+	}
+	return o.check.Path == "" && time.Since(time.Unix(0, b.ejectedAt.Load())) >= passiveRetryAfter
+}
+
+func containsBackend(list []*backend, b *backend) bool {
+	for _, c := range list {
+		if c == b {
+			return true
+		}
+	}
+	return false
+}
+
+// report updates b's health with the outcome of a check or of a request.
+func (o *origin) report(b *backend, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	unhealthyAfter, healthyAfter := o.check.UnhealthyAfter, o.check.HealthyAfter
+	if o.check.Path == "" {
+		// nothing probes an ejected backend, usable lets a request through
+		// to it now and then instead
+		unhealthyAfter, healthyAfter = 3, 1
+	}
+	if ok {
+		b.failures = 0
+		b.successes++
+		if !b.healthy.Load() && b.successes >= healthyAfter {
+			b.healthy.Store(true)
+			slog.Info("origin: backend healthy again", "origin", o.name, "backend", b.url)
+		}
+		return
+	}
+	b.successes = 0
+	b.failures++
+	if !b.healthy.Load() {
+		b.ejectedAt.Store(time.Now().UnixNano())
+	} else if b.failures >= unhealthyAfter {
+		b.healthy.Store(false)
+		b.ejectedAt.Store(time.Now().UnixNano())
+		slog.Warn("origin: ejecting unhealthy backend", "origin", o.name, "backend", b.url)
+		o.webhooks.send(eventOriginDown, map[string]any{"origin": o.name, "backend": b.url})
+	}
+}
+
+// prober runs health checks, on the backends and on the addresses of
+// their hosts.
+type prober struct {
+	client *http.Client
+	// pinned doesn't reuse connections, which might be to other addresses.
+	pinned *http.Client
+	res    *resolver
+}
+
+func newProber(client *http.Client, res *resolver) *prober {
+	var t *http.Transport
+	switch rt := client.Transport.(type) {
+	case *http.Transport:
+		t = rt.Clone()
+	case h2cTransport:
+		t = rt.Transport.Clone()
+	}
+	t.DisableKeepAlives = true
+	return &prober{client: client, pinned: &http.Client{Transport: t}, res: res}
+}
+
+// runHealthChecks probes o's backends until ctx is done. The health of
+// origins with a single backend isn't tracked, there'd be nothing to fail
+// over to, but with DNS refreshed its addresses are still probed.
+func (o *origin) runHealthChecks(ctx context.Context, wg *sync.WaitGroup, p *prober) {
+	if o.check.Path == "" || len(o.backends) < 2 && p.res.cfg.Refresh == 0 {
+		return
+	}
+	ctx, o.stopChecks = context.WithCancel(ctx)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Duration(o.check.Interval))
+		defer ticker.Stop()
+
+		for {
+			for _, b := range o.backends {
+				if ok := o.probe(ctx, p, b); len(o.backends) > 1 {
+					o.report(b, ok)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// probe checks every address of b's host on its own when it has several,
+// b being up while any of them is.
+func (o *origin) probe(ctx context.Context, p *prober, b *backend) bool {
+	u, err := url.Parse(b.url)
+	if err != nil {
+		return false
+	}
+	var ips []string
+	if host := u.Hostname(); p.res.caching() && net.ParseIP(host) == nil {
+		ips, _ = p.res.lookup(ctx, host)
+	}
+	if len(ips) < 2 {
+		return o.probeOnce(ctx, p.client, b)
+	}
+	up := false
+	for _, ip := range ips {
+		if o.probeOnce(context.WithValue(ctx, dialIPKey{}, ip), p.pinned, b) {
+			p.res.setDown(ip, 0)
+			up = true
+			continue
+		}
+		// until a later check finds it back
+		p.res.setDown(ip, 2*time.Duration(o.check.Interval))
+		slog.Debug("origin: address failed its health check", "origin", o.name, "backend", b.url, "addr", ip)
+	}
+	return up
+}
+
+func (o *origin) probeOnce(ctx context.Context, client *http.Client, b *backend) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(o.check.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url+o.check.Path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// OriginStats is an origin's state as reported by the stats endpoint.
+type OriginStats struct {
+	Breaker  BreakerStats   `json:"breaker"`
+	Backends []BackendStats `json:"backends"`
+}
+
+type BackendStats struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	// Active is the number of requests to the backend in flight.
+	Active int64 `json:"active"`
+}
+
+func (o *origin) stats() OriginStats {
+	st := OriginStats{Breaker: o.breaker.stats()}
+	for _, b := range o.backends {
+		st.Backends = append(st.Backends, BackendStats{URL: b.url, Healthy: b.healthy.Load(), Active: b.active.Load()})
+	}
+	return st
+}
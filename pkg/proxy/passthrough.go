@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// isWebSocket tells whether r asks to upgrade to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// wantsEventStream tells whether r is a Server-Sent Events subscription.
+func wantsEventStream(r *http.Request) bool {
+	return headerHasToken(r.Header, "Accept", "text/event-stream")
+}
+
+// isStreamingResponse tells whether resp is a stream to be relayed as it
+// arrives rather than buffered and cached: Server-Sent Events, or a body
+// without a length the origin asks not to be buffered.
+func isStreamingResponse(resp *http.Response) bool {
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength < 0 && strings.EqualFold(resp.Header.Get("X-Accel-Buffering"), "no")
+}
+
+// headerHasToken reports whether the comma separated header name lists
+// token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// passthrough hands r to one of o's backends without buffering: WebSocket
+// upgrades are tunneled both ways until either side closes and streamed
+// responses are flushed to the client write by write. Nothing is cached.
+func (cps *Server) passthrough(w http.ResponseWriter, r *http.Request, o *origin, route *RouteConfig, path string) {
+	if ok, _ := o.breaker.allow(); !ok {
+		cps.upstreamFailed(w, r, "", upstreamCircuitOpen, errors.New("circuit open"))
+		return
+	}
+	b := o.pick(nil)
+	target, err := url.Parse(b.url)
+	if err != nil {
+		o.breaker.cancel()
+		cps.upstreamFailed(w, r, "", upstreamInternal, err)
+		return
+	}
+
+	// the connection outlives the server's read and write timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	b.active.Add(1)
+	defer b.active.Add(-1)
+	failed := false
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = target.Path + path
+			pr.Out.URL.RawPath = ""
+			pr.SetXForwarded()
+			cps.config().addVia(pr.Out.Header, r.ProtoMajor, r.ProtoMinor)
+			cps.config().editRequestHeaders(pr.Out.Header, route, r.Host)
+		},
+		Transport:     cps.client.Transport,
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			cps.config().addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				cps.config().CacheStatus.set(resp.Header, "TUNNEL")
+			} else {
+				cps.config().CacheStatus.set(resp.Header, "STREAM")
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			failed = true
+			cps.upstreamFailed(w, r, "", classifyUpstreamError(err), err)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	o.report(b, !failed)
+	o.breaker.record(failed)
+}
+
+// streamResponse relays the streaming resp fetched through the cache path,
+// flushing after every read, and closes its body.
+func (cps *Server) streamResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	copyHeaders(w.Header(), resp.Header)
+	cps.config().addVia(w.Header(), resp.ProtoMajor, resp.ProtoMinor)
+	cps.config().CacheStatus.set(w.Header(), "STREAM")
+	w.WriteHeader(resp.StatusCode)
+	rc.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			rc.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				slog.Warn("origin stream ended early", "err", err)
+			}
+			return
+		}
+	}
+}
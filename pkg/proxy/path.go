@@ -0,0 +1,46 @@
+package proxy
+
+import "strings"
+
+const (
+	slashKeep  = ""
+	slashStrip = "strip"
+	slashAdd   = "add"
+)
+
+// collapseSlashes turns runs of '/' into a single one, so "//a///b" is "/a/b".
+func collapseSlashes(path string) string {
+	if !strings.Contains(path, "//") {
+		return path
+	}
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// canonicalPath applies a route's trailing slash policy. Duplicate slashes
+// are collapsed unless the policy is slashKeep.
+func canonicalPath(path, policy string) string {
+	if policy == slashKeep {
+		return path
+	}
+	path = collapseSlashes(path)
+	if path == "/" || path == "" {
+		return "/"
+	}
+	switch policy {
+	case slashStrip:
+		return strings.TrimSuffix(path, "/")
+	case slashAdd:
+		if !strings.HasSuffix(path, "/") {
+			return path + "/"
+		}
+	}
+	return path
+}
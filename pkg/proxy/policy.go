@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// defaultCacheStatuses are the statuses RFC 9111 allows caching without
+// explicit freshness, server errors and partial content aside.
+var defaultCacheStatuses = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414}
+
+func (c *Config) validateCacheable() error {
+	if c.CacheMethods == nil {
+		c.CacheMethods = []string{http.MethodGet, http.MethodHead}
+	}
+	for _, m := range c.CacheMethods {
+		if m != http.MethodGet && m != http.MethodHead {
+			return fmt.Errorf("cache_methods: can't cache %q, only GET and HEAD", m)
+		}
+	}
+	if c.CacheStatuses == nil {
+		c.CacheStatuses = defaultCacheStatuses
+	}
+	for _, code := range c.CacheStatuses {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("cache_statuses: invalid status %d", code)
+		}
+		if code >= 500 {
+			return fmt.Errorf("cache_statuses: server errors like %d are never cached", code)
+		}
+	}
+	return nil
+}
+
+// storable reports whether entry, fetched for route, may be put in the
+// cache.
+func (cps *Server) storable(route *RouteConfig, entry *cache.Entry) bool {
+	if entry.StatusCode >= 500 || !slices.Contains(cps.config().CacheStatuses, entry.StatusCode) {
+		return false
+	}
+	// a cookie set for one client must never be replayed to another
+	if entry.Headers.Get("Set-Cookie") != "" && (route == nil || !route.CacheSetCookie) {
+		return false
+	}
+	limit := cps.config().MaxObjectBytes
+	if route != nil && route.MaxObjectBytes > 0 {
+		limit = route.MaxObjectBytes
+	}
+	return limit == 0 || int64(len(entry.Body)) <= limit
+}
+
+// BypassConfig sends requests carrying credentials straight to the origin,
+// with their headers, and keeps their responses out of the cache, so one
+// user's response is never served to another.
+type BypassConfig struct {
+	// Authorization bypasses requests with an Authorization header.
+	Authorization bool `json:"authorization"`
+	// Cookies lists the cookie names that bypass, "*" for any cookie. A name
+	// ending in '*' matches as a prefix.
+	Cookies []string `json:"cookies"`
+	// SafeCookies never bypass, even when Cookies would match them, e.g.
+	// analytics cookies like "_ga*".
+	SafeCookies []string `json:"safe_cookies"`
+}
+
+func (c *BypassConfig) validate() error {
+	if c.Cookies == nil {
+		c.Cookies = []string{"*"}
+	}
+	for _, name := range append(c.Cookies, c.SafeCookies...) {
+		if name == "" {
+			return fmt.Errorf("bypass: empty cookie name")
+		}
+	}
+	return nil
+}
+
+func matchName(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassReason returns why r must bypass the cache on route, or "" when it
+// may be served from it. Routes with AllowCredentials are known to serve
+// the same content to everyone and never bypass for credentials, nor do
+// the headers and cookies the cache key is made of.
+func (c *Config) bypassReason(r *http.Request, route *RouteConfig) string {
+	if cachesPost(route, r) {
+		body, err := bufferBody(r)
+		if err != nil {
+			return "unreadable body"
+		}
+		if isGraphQLMutation(r.Header, body) {
+			return "graphql mutation"
+		}
+	} else if !slices.Contains(c.CacheMethods, r.Method) {
+		return "method"
+	}
+	if route != nil && route.NoCache {
+		return "no_cache route"
+	}
+	if route != nil && route.AllowCredentials {
+		return ""
+	}
+	key := c.keyConfig(route)
+	if c.Bypass.Authorization && r.Header.Get("Authorization") != "" && !slices.Contains(key.Headers, "Authorization") &&
+		key.partitionHeader() != "Authorization" {
+		return "authorization"
+	}
+	for _, cookie := range r.Cookies() {
+		if matchName(c.Bypass.Cookies, cookie.Name) && !matchName(c.Bypass.SafeCookies, cookie.Name) && !slices.Contains(key.Cookies, cookie.Name) &&
+			key.partitionCookie() != cookie.Name {
+			return "cookie " + cookie.Name
+		}
+	}
+	return ""
+}
+
+// cachesPost tells whether r is a POST that's cached on route.
+func cachesPost(route *RouteConfig, r *http.Request) bool {
+	return route != nil && route.CachePost && r.Method == http.MethodPost
+}
+
+// forwardHeaders copies the client's end-to-end request headers to the
+// origin request. Only bypassed requests forward them, cached responses
+// must not depend on headers the cache key doesn't vary on.
+func forwardHeaders(dst, src http.Header) {
+	for k, vv := range src {
+		if isHopHeader(k) {
+			continue
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
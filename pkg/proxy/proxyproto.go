@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoTimeout bounds how long a connection may take to send its
+// PROXY protocol header.
+const proxyProtoTimeout = 5 * time.Second
+
+// proxyV1MaxLen is the longest v1 header, "PROXY TCP6 " with both
+// addresses and ports.
+const proxyV1MaxLen = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener reads the HAProxy PROXY protocol header, v1 or v2,
+// that a TCP load balancer sends first on every connection, so the
+// connections' RemoteAddr is the client's rather than the load
+// balancer's. Connections without a header are closed: behind such a
+// load balancer every connection has one, and guessing would let clients
+// pick their own address.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn reads its header on the first RemoteAddr or Read, in the
+// connection's own goroutine, which http.Server does before setting its
+// own deadlines.
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			slog.Debug("closing connection without a valid PROXY protocol header", "remote", c.Conn.RemoteAddr(), "err", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr is the client's address from the header, or the load
+// balancer's for health checks and other connections it makes itself.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header, returning the source address
+// it carries, or nil for UNKNOWN and LOCAL connections.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyV1(r)
+	default:
+		return nil, fmt.Errorf("no PROXY protocol header")
+	}
+}
+
+// readProxyV1 reads "PROXY TCP4|TCP6 src dst sport dport\r\n" or
+// "PROXY UNKNOWN ...\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) <= proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("PROXY v1 header too long or not ended by CRLF")
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", s)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", s)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header: the signature, version and
+// command, address family, length and the addresses.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+	switch cmd := hdr[12] & 0xf; cmd {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown PROXY v2 command %d", cmd)
+	}
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets and unspecified, there's no IP to use
+		return nil, nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return nil, fmt.Errorf("PROXY v2 addresses too short")
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(addrs[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipLen:])),
+	}, nil
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+const (
+	rangeMissFetch = "fetch"
+	rangeMissPass  = "pass"
+)
+
+// serveRange answers the Range request r from the complete cached val, with
+// a 206 for satisfiable ranges and a 416 otherwise.
+func serveRange(w http.ResponseWriter, r *http.Request, val *cache.Entry) {
+	modtime, _ := http.ParseTime(val.Headers.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(val.Body))
+}
+
+// copyRangeHeaders passes the client's range on to the origin.
+func copyRangeHeaders(dst, src http.Header) {
+	for _, h := range []string{"Range", "If-Range"} {
+		if v := src.Get(h); v != "" {
+			dst.Set(h, v)
+		}
+	}
+}
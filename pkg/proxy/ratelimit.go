@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig allows each client Rate requests per second on average,
+// in bursts of up to Burst. A zero Rate disables the limit.
+type RateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.Rate < 0 || c.Burst < 0 {
+		return fmt.Errorf("rate_limit: rate and burst must not be negative")
+	}
+	if c.Rate > 0 && c.Burst == 0 {
+		c.Burst = max(1, int(math.Ceil(c.Rate)))
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket per client.
+type rateLimiter struct {
+	cfg     RateLimitConfig
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when cfg doesn't limit anything.
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	if cfg.Rate == 0 {
+		return nil
+	}
+	return &rateLimiter{cfg: cfg, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from client's bucket. When it's empty it returns how
+// long until the next token.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(float64(l.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.cfg.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets clients whose bucket has filled up again, they'd get a full
+// one anyway.
+func (l *rateLimiter) sweep(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	full := time.Duration(float64(l.cfg.Burst) / l.cfg.Rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimits holds the proxy wide limiter and those of routes with their
+// own rate_limit. A request has to pass both.
+type rateLimits struct {
+	global *rateLimiter
+	routes map[*RouteConfig]*rateLimiter
+}
+
+func newRateLimits(cfg *Config) *rateLimits {
+	rl := &rateLimits{
+		global: newRateLimiter(cfg.RateLimit),
+		routes: make(map[*RouteConfig]*rateLimiter),
+	}
+	add := func(routes []RouteConfig) {
+		for i := range routes {
+			if rc := &routes[i]; rc.RateLimit != nil {
+				rl.routes[rc] = newRateLimiter(*rc.RateLimit)
+			}
+		}
+	}
+	add(cfg.Routes)
+	for i := range cfg.Hosts {
+		add(cfg.Hosts[i].Routes)
+	}
+	return rl
+}
+
+func (rl *rateLimits) allow(route *RouteConfig, client string) (bool, time.Duration) {
+	now := time.Now()
+	if ok, wait := rl.routes[route].allow(client, now); !ok {
+		return false, wait
+	}
+	return rl.global.allow(client, now)
+}
+
+const rateLimitSweepEvery = time.Minute
+
+// sweep drops idle clients, it runs every rateLimitSweepEvery.
+func (rl *rateLimits) sweep(now time.Time) {
+	rl.global.sweep(now)
+	for _, l := range rl.routes {
+		l.sweep(now)
+	}
+}
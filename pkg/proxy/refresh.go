@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// variantHeaders are the request headers that rebuild each key variant.
+// The variant values are already normalized, normalizing them again is a
+// no-op.
+var variantHeaders = map[string]string{
+	"lang":   "Accept-Language",
+	"mobile": "Sec-CH-UA-Mobile",
+	"dpr":    "Sec-CH-DPR",
+}
+
+// refreshKey carries the key a refresh-ahead request is for.
+type refreshKey struct{}
+
+// isRefresh tells whether r is a refresh-ahead request, which skips the
+// cache lookup to replace the entry with a fresh copy.
+func isRefresh(r *http.Request) bool {
+	return r.Context().Value(refreshKey{}) != nil
+}
+
+// runRefreshAhead refetches the RefreshTop most hit entries once they're
+// within RefreshAhead of expiring, so popular resources don't miss.
+func (cps *Server) runRefreshAhead(ctx context.Context, wg *sync.WaitGroup) {
+	ahead := time.Duration(cps.config().RefreshAhead)
+	if ahead == 0 || cps.config().KeyFunc != nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(max(ahead/2, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cps.refreshHot(ctx, ahead)
+			}
+		}
+	}()
+}
+
+func (cps *Server) refreshHot(ctx context.Context, ahead time.Duration) {
+	now := time.Now()
+	var hot []cache.EntryMeta
+	for _, meta := range cps.Cache.Entries() {
+		left := meta.ExpiresAt.Sub(now)
+		_, hasBody := keyVariant(meta.Key, bodyVariant)
+		// a user's credentials aren't kept to refresh their entries with
+		_, hasUser := keyVariant(meta.Key, userVariant)
+		if meta.Hits > 0 && left > 0 && left <= ahead && strings.HasPrefix(meta.Key, http.MethodGet+"-") && !hasBody && !hasUser {
+			hot = append(hot, meta)
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool { return hot[i].Hits > hot[j].Hits })
+	if len(hot) > cps.config().RefreshTop {
+		hot = hot[:cps.config().RefreshTop]
+	}
+	for _, meta := range hot {
+		if ctx.Err() != nil {
+			return
+		}
+		cps.refresh(ctx, meta.Key)
+	}
+}
+
+// refresh runs a request rebuilt from key through the proxy, bypassing the
+// lookup so the origin's response replaces the entry.
+func (cps *Server) refresh(ctx context.Context, key string) {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, refreshKey{}, key), http.MethodGet, keyTarget(key), nil)
+	if err != nil {
+		return
+	}
+	if _, variants, ok := strings.Cut(key, "|"); ok {
+		for _, v := range strings.Split(variants, "|") {
+			name, value, _ := strings.Cut(v, "=")
+			switch {
+			case name == hostVariant:
+				req.Host = value
+			case strings.HasPrefix(name, headerVariant):
+				value, _ = url.QueryUnescape(value)
+				req.Header.Set(strings.TrimPrefix(name, headerVariant), value)
+			case strings.HasPrefix(name, cookieVariant):
+				value, _ = url.QueryUnescape(value)
+				req.AddCookie(&http.Cookie{Name: strings.TrimPrefix(name, cookieVariant), Value: value})
+			case variantHeaders[name] != "":
+				req.Header.Set(variantHeaders[name], value)
+			}
+		}
+	}
+	cps.handleRequests(&discardRecorder{header: make(http.Header)}, req)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+)
+
+// restartOnly are the Config fields New reads once, for listeners, the
+// cache backend and other long lived parts. Reload keeps them as they are.
+var restartOnly = []string{
+	"Port", "ProxyProtocol", "H2C", "Listeners", "AdminAddr", "MetricsAddr", "GRPCAddr", "AdminToken", "AdminAuth",
+	"ShutdownTimeout", "Timeouts", "Upstream", "Concurrency",
+	"LogLevel", "LogFormat", "AccessLog",
+	"CacheDir", "CacheS3", "CacheMemcached", "MemoryCacheBytes", "CacheSnapshot", "IntegrityCheck", "CacheKeyFile",
+	"Degradation", "History", "Sampling", "Cluster", "Invalidation", "Webhooks",
+	"RefreshAhead", "RefreshTop", "Offline", "Record", "Replay",
+}
+
+// embedderOnly are the Config fields only embedders set, in code rather
+// than in the config file. Reload carries them over from the current config.
+var embedderOnly = []string{"Hooks", "KeyFunc", "LoadConfig"}
+
+// Reload serves the requests that come after with cfg: its routes, hosts,
+// TTLs, key and bypass rules, origins and rate limits. Requests in flight
+// finish with the config they started with. The restartOnly settings keep
+// their current values, a warning lists the ones cfg would change. When cfg
+// doesn't validate, the error is returned and nothing changes.
+func (cps *Server) Reload(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	old := cps.live.Load()
+	if changed := keepRestartOnly(&cfg, old.config); len(changed) > 0 {
+		slog.Warn("config reload: settings that need a restart keep their current value", "settings", changed)
+		// checks spanning fields, like sample_rate needing sampling
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("with the settings that need a restart unchanged: %v", err)
+		}
+	}
+	keepEmbedderOnly(&cfg, old.config)
+
+	origins := newOrigins(&cfg, cps.webhooks)
+	sameBreaker := cfg.Breaker == old.config.Breaker
+	for name, o := range origins {
+		// a reused origin keeps its backends' health and its breaker state
+		if prev, ok := old.origins[name]; ok && sameBreaker && prev.check == o.check {
+			origins[name] = prev
+			continue
+		}
+		if !cfg.offline() {
+			o.runHealthChecks(cps.bgCtx, &cps.bg, cps.prober)
+		}
+	}
+	for name, prev := range old.origins {
+		if origins[name] != prev && prev.stopChecks != nil {
+			prev.stopChecks()
+		}
+	}
+
+	cps.live.Store(&liveConfig{
+		config:  &cfg,
+		origins: origins,
+		limits:  newRateLimits(&cfg),
+	})
+	slog.Info("config reloaded", "routes", len(cfg.Routes), "hosts", len(cfg.Hosts), "origins", len(origins))
+	return nil
+}
+
+// keepRestartOnly sets cfg's restartOnly fields back to old's, returning the
+// names of those that differed.
+func keepRestartOnly(cfg, old *Config) []string {
+	var changed []string
+	nv, ov := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(old).Elem()
+	for _, name := range restartOnly {
+		f, prev := nv.FieldByName(name), ov.FieldByName(name)
+		if !reflect.DeepEqual(f.Interface(), prev.Interface()) {
+			changed = append(changed, name)
+			f.Set(prev)
+		}
+	}
+	return changed
+}
+
+// keepEmbedderOnly sets cfg's embedderOnly fields to old's.
+func keepEmbedderOnly(cfg, old *Config) {
+	nv, ov := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(old).Elem()
+	for _, name := range embedderOnly {
+		nv.FieldByName(name).Set(ov.FieldByName(name))
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestReloadKeepsEmbedderFields(t *testing.T) {
+	keyFunc := func(r *http.Request) string { return "key" }
+	cps := newTestServer(t, "http://127.0.0.1:1", func(cfg *Config) {
+		cfg.KeyFunc = keyFunc
+		cfg.Hooks = []Hooks{{}}
+		cfg.LoadConfig = func() (Config, error) { return DefaultConfig(), nil }
+	})
+
+	cfg := DefaultConfig()
+	cfg.Origin = "http://127.0.0.1:1"
+	if err := cps.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := cps.config()
+	if got.KeyFunc == nil || got.KeyFunc(nil) != "key" {
+		t.Error("KeyFunc was dropped")
+	}
+	if len(got.Hooks) != 1 {
+		t.Errorf("got %d hooks, want 1", len(got.Hooks))
+	}
+	if got.LoadConfig == nil {
+		t.Error("LoadConfig was dropped")
+	}
+}
+
+// Fields left out of the config file that no flag can set either, like
+// funcs, are set in code and must survive a reload.
+func TestEmbedderOnlyFields(t *testing.T) {
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Tag.Get("json") != "-" || f.Type.Kind() == reflect.String || f.Type.Kind() == reflect.Bool {
+			continue
+		}
+		if !slices.Contains(embedderOnly, f.Name) {
+			t.Errorf("%s isn't in embedderOnly", f.Name)
+		}
+	}
+	for _, name := range embedderOnly {
+		if _, ok := typ.FieldByName(name); !ok {
+			t.Errorf("embedderOnly names %s, which Config doesn't have", name)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+const defaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the longest request ID taken from a client.
+const maxRequestIDLen = 128
+
+// requestID returns the ID of r under the header name: the one the client,
+// or a proxy in front, sent when it's usable, a new one otherwise.
+func requestID(r *http.Request, name string) string {
+	if id := r.Header.Get(name); validRequestID(id) {
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID tells whether id is short and printable ASCII, so it's
+// safe to log and send on as it is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDOf returns the ID handleRequests gave r, empty when request IDs
+// are off.
+func (cps *Server) requestIDOf(r *http.Request) string {
+	if name := cps.config().RequestIDHeader; name != "" {
+		return r.Header.Get(name)
+	}
+	return ""
+}
+
+func validateRequestIDHeader(name string) error {
+	if name != "" && !httpguts.ValidHeaderFieldName(name) {
+		return fmt.Errorf("request_id_header: invalid header name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryConfig retries origin requests that failed in a way that's likely
+// transient. Only idempotent requests whose body can be sent again are
+// retried.
+type RetryConfig struct {
+	// Attempts is how many times a request is retried, zero disables
+	// retries.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait before the first retry. It doubles for every
+	// retry after that, up to MaxBackoff, with up to half of it jittered.
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"max_backoff"`
+	// On lists what's retried: the error kinds "bad_gateway" and "timeout",
+	// origin statuses like "503", or whole classes like "5xx".
+	On []string `json:"on"`
+	// StaleOnError answers with the expired cache entry, if there's still
+	// one within the degradation max_stale, when the origin keeps failing.
+	StaleOnError bool `json:"stale_on_error"`
+
+	kinds    [numUpstreamErrors]bool
+	statuses map[int]bool
+}
+
+var defaultRetryOn = []string{"bad_gateway", "502", "503", "504"}
+
+func (c *RetryConfig) validate() error {
+	if c.Attempts < 0 || c.Backoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("retry: attempts, backoff and max_backoff must not be negative")
+	}
+	if c.On == nil {
+		c.On = defaultRetryOn
+	}
+	c.kinds = [numUpstreamErrors]bool{}
+	c.statuses = make(map[int]bool)
+	for _, on := range c.On {
+		switch on {
+		case upstreamBadGateway.String():
+			c.kinds[upstreamBadGateway] = true
+		case upstreamTimeout.String():
+			c.kinds[upstreamTimeout] = true
+		case "5xx":
+			for code := 500; code < 600; code++ {
+				c.statuses[code] = true
+			}
+		default:
+			code, err := strconv.Atoi(on)
+			if err != nil || code < 100 || code > 599 {
+				return fmt.Errorf("retry: can't retry on %q", on)
+			}
+			c.statuses[code] = true
+		}
+	}
+	return nil
+}
+
+func (c *RetryConfig) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return c.kinds[classifyUpstreamError(err)]
+	}
+	return c.statuses[resp.StatusCode]
+}
+
+func (c *RetryConfig) backoff(retry int) time.Duration {
+	d := time.Duration(c.Backoff) << (retry - 1)
+	if c.MaxBackoff > 0 && (d > time.Duration(c.MaxBackoff) || d <= 0) {
+		d = time.Duration(c.MaxBackoff)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + mathrand.N(d/2+1)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// fetch sends req for path to one of o's backends and reads the response,
+// retrying as the retry config allows. Streaming responses are returned
+// with their body unread. A backend that can't be reached is
+// failed over to another right away, without using up a retry. It gives up
+// waiting between attempts once ctx is done.
+func (cps *Server) fetch(ctx context.Context, o *origin, req *http.Request, path string) (*http.Response, []byte, error) {
+	cfg := &cps.config().Retry
+	replayable := isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	var tried []*backend
+	for retry := 0; ; {
+		b := o.pick(tried)
+		if b == nil {
+			// every backend failed over to, start over for the retry
+			tried = tried[:0]
+			b = o.pick(nil)
+		}
+
+		resp, body, b, err := cps.fetchHedged(ctx, o, req, b, path)
+		tried = append(tried, b)
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			return nil, nil, err
+		}
+		o.report(b, err == nil && resp.StatusCode < 500)
+		if !replayable || err == nil && isStreamingResponse(resp) {
+			return resp, body, err
+		}
+		if err != nil && classifyUpstreamError(err) == upstreamBadGateway && o.pick(tried) != nil {
+			slog.Debug("failing over to another backend", "origin", o.name, "backend", b.url, "err", err)
+			if err := rewind(req); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if retry == cfg.Attempts || !cfg.retryable(resp, err) {
+			return resp, body, err
+		}
+
+		retry++
+		if err != nil {
+			slog.Debug("retrying origin request", "url", b.url+path, "retry", retry, "err", err)
+		} else {
+			slog.Debug("retrying origin request", "url", b.url+path, "retry", retry, "status", resp.StatusCode)
+		}
+		select {
+		case <-time.After(cfg.backoff(retry)):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if err := rewind(req); err != nil {
+			return nil, nil, err
+		}
+		cps.counters.retries.Add(1)
+	}
+}
+
+// rewind resets req's body so it can be sent again.
+func rewind(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+func (cps *Server) fetchOnce(req *http.Request, b *backend, path string) (*http.Response, []byte, error) {
+	u, err := url.Parse(b.url + path)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.RawQuery = req.URL.RawQuery
+	req.URL = u
+	req.Host = ""
+
+	b.active.Add(1)
+	defer b.active.Add(-1)
+	resp, err := cps.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isStreamingResponse(resp) {
+		// relayed by the caller as it arrives, which closes the body
+		return resp, nil, nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// serveStaleOnError answers with key's expired entry when the retry config
+// allows it and there is one.
+func (cps *Server) serveStaleOnError(w http.ResponseWriter, r *http.Request, key string) bool {
+	if !cps.config().Retry.StaleOnError {
+		return false
+	}
+	return cps.serveStale(w, r, key)
+}
+
+// serveStale answers with key's expired entry, if it's still kept.
+func (cps *Server) serveStale(w http.ResponseWriter, r *http.Request, key string) bool {
+	cps.mu.RLock()
+	defer cps.mu.RUnlock()
+	val, ok := cps.Cache.GetStale(key)
+	if !ok {
+		return false
+	}
+	cps.counters.staleHits.Add(1)
+	cps.hooks.onCacheHit(r, key, val)
+	cps.writeCached(w, r, val, "STALE")
+	return true
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/s3"
+)
+
+// SamplingConfig archives a sample of origin responses to S3 for auditing.
+// Which routes are sampled, and how often, is set per route with
+// sample_rate.
+type SamplingConfig struct {
+	S3 *s3.Config `json:"s3"`
+}
+
+const (
+	sampleQueueSize    = 256
+	sampleDrainTimeout = 10 * time.Second
+)
+
+type sample struct {
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+}
+
+// sampler uploads samples in the background. When uploads can't keep up
+// samples are dropped rather than slowing down requests.
+type sampler struct {
+	s3    *s3.Client
+	queue chan *sample
+}
+
+func newSampler(cfg SamplingConfig) (*sampler, error) {
+	if cfg.S3 == nil {
+		return &sampler{}, nil
+	}
+	client, err := s3.New(*cfg.S3)
+	if err != nil {
+		return nil, err
+	}
+	return &sampler{s3: client, queue: make(chan *sample, sampleQueueSize)}, nil
+}
+
+func (s *sampler) maybeSample(rate float64, r *http.Request, status int, header http.Header, body []byte) {
+	if s.s3 == nil || rate <= 0 || mathrand.Float64() >= rate {
+		return
+	}
+	// header is cloned as the response goes on being rewritten while the
+	// sample waits in the queue
+	smp := &sample{
+		Time:       time.Now().UTC(),
+		Method:     r.Method,
+		URL:        r.URL.RequestURI(),
+		StatusCode: status,
+		Headers:    header.Clone(),
+		Body:       body,
+	}
+	select {
+	case s.queue <- smp:
+	default:
+		slog.Warn("sampling: queue full, dropping sample", "url", smp.URL)
+	}
+}
+
+// run uploads queued samples until ctx is done, then gives what's left in
+// the queue up to sampleDrainTimeout to be uploaded.
+func (s *sampler) run(ctx context.Context, wg *sync.WaitGroup) {
+	if s.s3 == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case smp := <-s.queue:
+				s.upload(ctx, smp)
+			case <-ctx.Done():
+				s.drain()
+				return
+			}
+		}
+	}()
+}
+
+func (s *sampler) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), sampleDrainTimeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		select {
+		case smp := <-s.queue:
+			s.upload(ctx, smp)
+		default:
+			return
+		}
+	}
+}
+
+func (s *sampler) upload(ctx context.Context, smp *sample) {
+	data, err := json.Marshal(smp)
+	if err != nil {
+		slog.Error("sampling: couldn't encode sample", "err", err)
+		return
+	}
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	// date prefixes keep listing a day's samples cheap
+	key := smp.Time.Format("2006/01/02/150405.000000000") + "-" + hex.EncodeToString(suffix[:]) + ".json"
+	if err := s.s3.Put(ctx, key, data, http.Header{"Content-Type": {"application/json"}}); err != nil {
+		slog.Error("sampling: couldn't upload sample", "err", err)
+	}
+}
@@ -0,0 +1,990 @@
+// Package proxy is the caching reverse proxy, for running on its own with
+// Run or embedding in another service through Handler:
+//
+//	cfg := proxy.DefaultConfig()
+//	cfg.Origin = "https://api.example.com"
+//	p, err := proxy.New(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	defer p.Close()
+//	mux.Handle("/api/", p.Handler())
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Server is a caching reverse proxy. It serves client requests from its
+// cache, fetching them from the origins on a miss.
+type Server struct {
+	Port     string
+	Origin   string
+	Cache    cache.Store
+	live     atomic.Pointer[liveConfig]
+	degrade  *degrader
+	history  *history
+	sampler  *sampler
+	tags     *tagIndex
+	counters *proxyStats
+	metrics  *metrics
+	access   *accessLog
+	recent   *recentRequests
+	client   *http.Client
+	prober   *prober
+	inflight semaphore
+	hooks    hookChain
+	cluster  *cluster
+	bus      *invalidationBus
+	webhooks *webhooks
+	// shadows are the mirrors in flight.
+	shadows atomic.Int64
+	// maintenanceOverride is maintenance mode as switched by the admin
+	// API, nil to follow the config.
+	maintenanceOverride atomic.Pointer[maintenanceState]
+	upgrader            upgrader
+	// gzipWriters are reused for compressing responses, a pool per level
+	// as a writer keeps the one it was made with.
+	gzipWriters [gzip.BestCompression + 2]sync.Pool
+	mu          sync.RWMutex
+
+	// stop ends the background work running under bgCtx, which bg waits
+	// for.
+	bgCtx context.Context
+	stop  context.CancelFunc
+	bg    sync.WaitGroup
+}
+
+// liveConfig is the config requests are served with, and what's built from
+// it. Reload swaps it as a whole.
+type liveConfig struct {
+	config  *Config
+	origins map[string]*origin
+	limits  *rateLimits
+}
+
+func (cps *Server) config() *Config {
+	return cps.live.Load().config
+}
+
+// New returns a Server for cfg, which is validated first. Start with
+// DefaultConfig for the defaults the command line flags have. The server's
+// background work, like cache cleanup and health checks, runs until Close.
+func New(cfg Config) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cacheTTL := time.Duration(cfg.CacheTTL)
+	maxStale := time.Duration(cfg.Degradation.MaxStale)
+	if cfg.offline() {
+		maxStale = offlineMaxStale
+	}
+
+	var store cache.Store
+	var err error
+	if cfg.Record != "" || cfg.Replay != "" {
+		store, err = openFixtures(&cfg, cacheTTL)
+	} else if cfg.CacheDir != "" {
+		var key []byte
+		if key, err = cache.LoadKey(cfg.CacheKeyFile); err != nil {
+			return nil, err
+		}
+		store, err = cache.OpenDiskStore(cfg.CacheDir, cacheTTL, maxStale, cache.DiskOptions{
+			Verify: cfg.IntegrityCheck,
+			Key:    key,
+		})
+	} else if cfg.CacheS3 != nil {
+		store, err = cache.OpenS3Store(*cfg.CacheS3, cacheTTL, maxStale)
+	} else if len(cfg.CacheMemcached) > 0 {
+		store, err = cache.NewMemcachedStore(cfg.CacheMemcached, cacheTTL, maxStale)
+	} else {
+		store, err = cache.NewMemoryStore(cacheTTL, maxStale)
+	}
+	if err == nil && cfg.MemoryCacheBytes > 0 && (cfg.CacheDir != "" || cfg.sharedCache()) {
+		store = cache.NewTieredStore(store, cfg.MemoryCacheBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set a cache for the server. error: %v", err)
+	}
+
+	sampler, err := newSampler(cfg.Sampling)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up response sampling. error: %v", err)
+	}
+	access, err := openAccessLog(cfg.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+	res := newResolver(cfg.Upstream.DNS, &net.Dialer{Timeout: time.Duration(cfg.Timeouts.OriginDial)})
+	client, err := newUpstreamClient(cfg.Upstream, cfg.Timeouts, res)
+	if err != nil {
+		return nil, err
+	}
+	degrade := newDegrader(cfg.Degradation, cfg.CacheDir)
+	history := newHistory(cfg.History)
+
+	loadSnapshot(store, cfg.CacheSnapshot)
+	// entries loaded from disk or the snapshot carry their tags too
+	tags := newTagIndex()
+	for _, meta := range store.Entries() {
+		tags.add(meta.Key, meta.Tags)
+	}
+
+	cps := &Server{
+		Port:     cfg.Port,
+		Origin:   cfg.Origin,
+		Cache:    store,
+		degrade:  degrade,
+		history:  history,
+		sampler:  sampler,
+		tags:     tags,
+		counters: newProxyStats(),
+		access:   access,
+		recent:   &recentRequests{},
+		client:   client,
+		prober:   newProber(client, res),
+		inflight: newSemaphore(cfg.Concurrency.MaxInflight),
+		hooks:    cfg.Hooks,
+		cluster:  newCluster(cfg.Cluster),
+		bus:      newInvalidationBus(cfg.Invalidation),
+		webhooks: newWebhooks(cfg.Webhooks),
+	}
+	cps.upgrader.replaced = make(chan struct{})
+	cps.live.Store(&liveConfig{
+		config:  &cfg,
+		origins: newOrigins(&cfg, cps.webhooks),
+		limits:  newRateLimits(&cfg),
+	})
+	cps.metrics = newMetrics(cps)
+
+	ctx, stop := context.WithCancel(context.Background())
+	cps.bgCtx, cps.stop = ctx, stop
+	scheduleCleanup(ctx, &cps.bg, store, cacheTTL)
+	scheduleCleanup(ctx, &cps.bg, cleanerFunc(func() { cps.tags.sweep(cps.Cache.Meta) }), cacheTTL)
+	if history.enabled() {
+		scheduleCleanup(ctx, &cps.bg, history, time.Hour)
+	}
+	degrade.run(ctx, &cps.bg)
+	if !cfg.offline() {
+		for _, o := range cps.live.Load().origins {
+			o.runHealthChecks(ctx, &cps.bg, cps.prober)
+		}
+		cps.runRefreshAhead(ctx, &cps.bg)
+	}
+	res.run(ctx, &cps.bg, client.CloseIdleConnections)
+	sampler.run(ctx, &cps.bg)
+	cps.webhooks.run(ctx, &cps.bg)
+	cps.webhooks.watchDisk(ctx, &cps.bg, cfg.CacheDir, cfg.Degradation.MinFreeDiskBytes, time.Duration(cfg.Degradation.Interval))
+	scheduleCleanup(ctx, &cps.bg, cleanerFunc(func() { cps.live.Load().limits.sweep(time.Now()) }), rateLimitSweepEvery)
+	cps.bus.run(ctx, &cps.bg, func(inv invalidation) {
+		n := cps.applyInvalidation(inv)
+		slog.Info("purge from another proxy", "from", inv.From, "entries", n)
+	})
+	return cps, nil
+}
+
+// hopHeaders only apply to a single connection and are never forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func isHopHeader(name string) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyHeaders(dis, src http.Header) {
+	for k, vv := range src {
+		switch {
+		case isHopHeader(k):
+		case k == "Vary":
+			addVary(dis, vv...)
+		default:
+			for _, v := range vv {
+				dis.Add(k, v)
+			}
+		}
+	}
+}
+
+// setDebugHeaders tells how old val is and how long it stays fresh, in
+// seconds. The TTL goes negative once val is stale.
+func setDebugHeaders(h http.Header, val *cache.Entry) {
+	if val.StoredAt.IsZero() {
+		return
+	}
+	now := time.Now()
+	h.Set("X-Cache-Age", strconv.Itoa(int(now.Sub(val.StoredAt).Seconds())))
+	h.Set("X-Cache-TTL-Remaining", strconv.Itoa(int(val.ExpiresAt.Sub(now).Seconds())))
+}
+
+// timeoutResponseGrace is how long past the request timeout the write
+// deadline is, to leave time for the 504.
+const timeoutResponseGrace = time.Second
+
+// statusClientClosed is logged for requests whose client went away before
+// the origin answered, as nginx does.
+const statusClientClosed = 499
+
+// statusWriter remembers the status code and body bytes written, for the
+// request's span and log line. debug is set when the response carries the
+// X-Cache-* debug headers. The header rules, and the CORS headers for a
+// request from an allowed corsOrigin, are applied as the headers are
+// written, for the request to host.
+type statusWriter struct {
+	http.ResponseWriter
+	status     int
+	bytes      int
+	debug      bool
+	rules      []*HeaderRules
+	host       string
+	cors       *CORSConfig
+	corsOrigin string
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+		if sw.corsOrigin != "" {
+			sw.cors.setHeaders(sw.Header(), sw.corsOrigin)
+		}
+		for _, rules := range sw.rules {
+			rules.apply(sw.Header(), sw.host)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// writeCached answers r with val, gzipped when the client accepts it and
+// the compression config allows.
+func (cps *Server) writeCached(w http.ResponseWriter, r *http.Request, val *cache.Entry, result string) {
+	if strings.EqualFold(val.Headers.Get("Content-Encoding"), encodingGzip) {
+		addVary(w.Header(), "Accept-Encoding")
+		if !acceptsEncoding(r, encodingGzip) {
+			plain, err := gunzipEntry(val)
+			if err != nil {
+				cps.upstreamFailed(w, r, "", upstreamBadGateway, fmt.Errorf("couldn't decompress response. error: %v", err))
+				return
+			}
+			val = plain
+		}
+	}
+	copyHeaders(w.Header(), val.Headers)
+	if id := cps.requestIDOf(r); id != "" {
+		// not the ID the origin echoed for the request that was cached
+		w.Header().Set(cps.config().RequestIDHeader, id)
+	}
+	// the origin's protocol isn't kept with the entry
+	cps.config().addVia(w.Header(), 1, 1)
+	cps.config().CacheStatus.set(w.Header(), result)
+	if !val.StoredAt.IsZero() {
+		w.Header().Set("Age", strconv.Itoa(int(currentAge(val, time.Now()).Seconds())))
+	}
+	if sw, ok := w.(*statusWriter); ok && sw.debug {
+		setDebugHeaders(w.Header(), val)
+	}
+	if r.Header.Get("Range") != "" && val.StatusCode == http.StatusOK {
+		serveRange(w, r, val)
+		return
+	}
+	if val.StatusCode == http.StatusOK && cps.config().Compression.compressible(val.Headers, len(val.Body)) {
+		addVary(w.Header(), "Accept-Encoding")
+		if acceptsEncoding(r, "gzip") {
+			cps.writeGzip(w, val.StatusCode, val.Body)
+			return
+		}
+	}
+	w.WriteHeader(val.StatusCode)
+	w.Write(val.Body)
+}
+
+func (cps *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer func() { cps.metrics.requestLatency.Observe(since(start)) }()
+
+	if d := time.Duration(cps.config().Timeouts.Request); d > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+		http.NewResponseController(w).SetWriteDeadline(start.Add(d + timeoutResponseGrace))
+	}
+	ctx, span := startRequestSpan(r)
+	sw := &statusWriter{
+		ResponseWriter: w,
+		debug:          cps.config().DebugHeaders || r.Header.Get("X-Cache-Debug") != "",
+		rules:          []*HeaderRules{&cps.config().ResponseHeaders},
+		host:           r.Host,
+		cors:           &cps.config().CORS,
+	}
+	sw.corsOrigin = sw.cors.allowed(r)
+	w = sw
+	reqIDHeader, reqID := cps.config().RequestIDHeader, ""
+	if reqIDHeader != "" {
+		reqID = requestID(r, reqIDHeader)
+		// passthrough, peers and shadows forward it with the client's headers
+		r.Header.Set(reqIDHeader, reqID)
+		w.Header().Set(reqIDHeader, reqID)
+		span.SetAttributes(attribute.String("http.request.id", reqID))
+	}
+	client := clientIP(r, cps.config().trustedNets)
+	var key, result string
+	var originLatency time.Duration
+	defer func() {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if result != "" {
+			span.SetAttributes(attribute.String("cache.result", result))
+		}
+		span.End()
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"cache", result,
+			"bytes", sw.bytes,
+			"duration", time.Since(start),
+		}
+		if originLatency > 0 {
+			attrs = append(attrs, "origin_latency", originLatency)
+		}
+		if key != "" {
+			attrs = append(attrs, "key", key)
+		}
+		if reqID != "" {
+			attrs = append(attrs, "request_id", reqID)
+		}
+		slog.Info("request", attrs...)
+
+		cps.access.log(&accessEntry{
+			r:         r,
+			client:    client,
+			time:      start,
+			status:    sw.status,
+			bytes:     sw.bytes,
+			cache:     result,
+			duration:  time.Since(start),
+			requestID: reqID,
+		})
+		cps.recent.add(recentRequest{
+			Time:       start,
+			Client:     client,
+			Method:     r.Method,
+			URI:        r.URL.RequestURI(),
+			Status:     sw.status,
+			Cache:      result,
+			Bytes:      sw.bytes,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Key:        key,
+			RequestID:  reqID,
+		})
+	}()
+
+	if !isInternal(r) && !cps.config().clientAllowed(client) {
+		result = "DENIED"
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// taken before anything forwards the client's headers
+	control := cps.config().RequestControls.take(r, client)
+	if sw.corsOrigin != "" && isPreflight(r) {
+		result = "CORS"
+		sw.cors.answerPreflight(w, r, sw.corsOrigin)
+		return
+	}
+	if cps.config().isLoop(r) {
+		result = "LOOP"
+		slog.Warn("forwarding loop", "path", r.URL.Path, "via", r.Header.Values("Via"))
+		http.Error(w, "forwarding loop detected", http.StatusLoopDetected)
+		return
+	}
+	if limit := cps.config().MaxRequestBody; limit > 0 && r.Body != nil {
+		if r.ContentLength > limit {
+			result = "TOO_LARGE"
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// chunked bodies are only caught while they're read
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	if !cps.hooks.onRequest(w, r) {
+		result = "HOOK"
+		return
+	}
+
+	path := r.URL.Path
+	host := cps.config().host(r.Host)
+	route := cps.config().hostRoute(host, path)
+	if route != nil {
+		sw.rules = append(sw.rules, route.ResponseHeaders)
+		path = canonicalPath(path, route.TrailingSlash)
+		if path != r.URL.Path && route.CanonicalRedirect {
+			loc := *r.URL
+			loc.Path = path
+			result = "REDIRECT"
+			http.Redirect(w, r, loc.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+	}
+	if cps.maintenance().covers(path) {
+		result = "MAINTENANCE"
+		cps.serveMaintenance(w)
+		return
+	}
+	var err error
+	keyRules := cps.config().keyConfig(route)
+	if cps.config().KeyFunc != nil {
+		key = cps.config().KeyFunc(r)
+	} else if key, err = keyRules.key(r, path, cachesPost(route, r)); err != nil {
+		if tooLarge(err) {
+			result = "TOO_LARGE"
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if host != nil {
+		key = withVariant(key, hostVariant, host.namespace())
+	}
+
+	vars := route.variants(r)
+	for _, v := range vars {
+		key = withVariant(key, v.name, v.value)
+	}
+	canary := route != nil && route.Canary.picked(r, client)
+	if canary && !route.Canary.SharedCache {
+		key = withVariant(key, canaryVariant, "1")
+	}
+	if sw.debug {
+		w.Header().Set("X-Cache-Key", key)
+	}
+	setVariantHeaders(w.Header(), vars)
+
+	if !isInternal(r) {
+		if ok, wait := cps.live.Load().limits.allow(route, client); !ok {
+			result = "LIMITED"
+			cps.counters.rateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if cps.config().offline() {
+		result = cps.serveOffline(w, r, key)
+		return
+	}
+
+	if isWebSocket(r) || wantsEventStream(r) {
+		result = "STREAM"
+		if isWebSocket(r) {
+			result = "TUNNEL"
+		}
+		cps.passthrough(w, r, cps.originFor(host, route), route, route.originPath(path))
+		if sw.status == 0 {
+			// the upgrade response went straight to the hijacked connection
+			sw.status = http.StatusSwitchingProtocols
+		}
+		return
+	}
+
+	cps.shadow(r, route.originPath(path))
+
+	if route != nil && route.Priority == priorityLow && cps.degrade.active(stepShedLowPriority) {
+		result = "SHED"
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "service degraded, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	if asOf := r.Header.Get("X-Proxy-As-Of"); asOf != "" && cps.history.enabled() {
+		result = "HISTORY"
+		cps.serveAsOf(w, r, key, asOf)
+		return
+	}
+
+	bypassReason := cps.config().bypassReason(r, route)
+	if bypassReason == "" && control == controlBypass {
+		bypassReason = bypassHeader
+	}
+	bypass := bypassReason != ""
+	passRange := false
+	// etag asks the origin whether the expired entry changed
+	var etag string
+	if bypass {
+		result = "BYPASS"
+		cps.counters.bypassed.Add(1)
+		slog.Debug("bypassing cache", "key", key, "reason", bypassReason)
+	} else if cps.config().Record != "" {
+		result = "RECORD"
+		cps.counters.misses.Add(1)
+	} else if isRefresh(r) || control == controlRefresh {
+		result = "REFRESH"
+		cps.counters.refreshes.Add(1)
+	} else {
+		_, lookup := tracer.Start(ctx, "cache.lookup", trace.WithAttributes(attribute.String("cache.key", key)))
+		cps.mu.RLock()
+		if val, ok := cps.Cache.Get(key); ok {
+			result = "HIT"
+			cps.counters.hits.Add(1)
+			lookup.End()
+			cps.hooks.onCacheHit(r, key, val)
+			cps.writeCached(w, r, val, "HIT")
+			cps.mu.RUnlock()
+			return
+		}
+		if cps.degrade.active(stepServeStale) {
+			if val, ok := cps.Cache.GetStale(key); ok {
+				result = "STALE"
+				cps.counters.staleHits.Add(1)
+				lookup.End()
+				cps.hooks.onCacheHit(r, key, val)
+				cps.writeCached(w, r, val, "STALE")
+				cps.mu.RUnlock()
+				return
+			}
+		}
+		cps.mu.RUnlock()
+		lookup.End()
+
+		result = "MISS"
+		cps.counters.misses.Add(1)
+		cps.hooks.onCacheMiss(r, key)
+		// the origin answers the range itself, leaving nothing to store
+		passRange = r.Header.Get("Range") != "" && cps.config().RangeMiss == rangeMissPass
+		if _, ok := cps.Cache.Meta(key); ok {
+			result = "EXPIRED"
+			if r.Method == http.MethodGet && !passRange {
+				etag = cps.revalidationETag(key)
+			}
+		}
+	}
+
+	if p := cps.cluster.owner(key); p != nil && (result == "MISS" || result == "EXPIRED") && !passRange && !canary && r.Method == http.MethodGet && !isPeerRequest(r) {
+		peerCtx, peerSpan := tracer.Start(ctx, "peer.fetch",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("peer", p.url)),
+		)
+		resp, body, err := cps.fetchFromPeer(peerCtx, r, p, path)
+		if err == nil {
+			peerSpan.End()
+			result = "PEER"
+			cps.counters.peerFetches.Add(1)
+			cps.respond(ctx, w, r, route, key, result, resp, body, true)
+			return
+		}
+		spanError(peerSpan, err)
+		peerSpan.End()
+		slog.Warn("peer fetch failed, going to the origin", "peer", p.url, "key", key, "err", err)
+	}
+
+	path = route.originPath(path)
+	origin := cps.originFor(host, route)
+	if canary {
+		origin = cps.canaryOrigin(route)
+	}
+	release, err := cps.acquireUpstream(r.Context(), origin)
+	if err != nil {
+		if !bypass && cps.serveStale(w, r, key) {
+			result = "STALE"
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			cps.upstreamFailed(w, r, key, upstreamTimeout, err)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		cps.upstreamFailed(w, r, key, upstreamOverloaded, err)
+		return
+	}
+	defer release()
+	if ok, wait := origin.breaker.allow(); !ok {
+		release()
+		if !bypass && cps.serveStale(w, r, key) {
+			result = "STALE"
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		cps.upstreamFailed(w, r, key, upstreamCircuitOpen, errors.New("circuit open"))
+		return
+	}
+
+	fetchCtx, fetch := tracer.Start(ctx, "origin.fetch", trace.WithSpanKind(trace.SpanKindClient))
+	if route != nil && route.FinishOnDisconnect && !bypass && !passRange {
+		fetchCtx = context.WithoutCancel(fetchCtx)
+	}
+	// fetch points it at the backend it picks
+	upstreamReq, err := http.NewRequestWithContext(fetchCtx, r.Method, origin.backends[0].url+path, r.Body)
+	if err != nil {
+		origin.breaker.cancel()
+		fetch.End()
+		cps.upstreamFailed(w, r, key, upstreamInternal, err)
+		return
+	}
+	upstreamReq.URL.RawQuery = r.URL.RawQuery
+	// -1 for a chunked body, which is sent on chunked
+	upstreamReq.ContentLength = r.ContentLength
+	if bypass {
+		forwardHeaders(upstreamReq.Header, r.Header)
+	} else {
+		cps.config().Compression.setUpstreamEncoding(upstreamReq.Header)
+		if cps.config().KeyFunc == nil {
+			keyRules.forward(upstreamReq.Header, r.Header)
+		}
+		if cachesPost(route, r) {
+			upstreamReq.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+		}
+	}
+	if passRange {
+		copyRangeHeaders(upstreamReq.Header, r.Header)
+	}
+	if etag != "" {
+		upstreamReq.Header.Set("If-None-Match", etag)
+	}
+	upstreamReq.Header["Via"] = r.Header.Values("Via")
+	cps.config().addVia(upstreamReq.Header, r.ProtoMajor, r.ProtoMinor)
+	// the origin must answer for the variant the response is stored under
+	for _, v := range vars {
+		for _, h := range v.headers {
+			upstreamReq.Header.Set(h, v.value)
+		}
+	}
+
+	if reqID != "" {
+		upstreamReq.Header.Set(reqIDHeader, reqID)
+	}
+	cps.config().editRequestHeaders(upstreamReq.Header, route, r.Host)
+	fetch.SetAttributes(semconv.URLFull(upstreamReq.URL.String()))
+	injectTrace(fetchCtx, upstreamReq.Header)
+
+	originStart := time.Now()
+	resp, body, err := cps.fetch(fetchCtx, origin, upstreamReq, path)
+	release()
+	if err != nil && errors.Is(fetchCtx.Err(), context.Canceled) {
+		// the client went away, which says nothing about the origin
+		origin.breaker.cancel()
+		spanError(fetch, err)
+		fetch.End()
+		result = "ABORTED"
+		w.WriteHeader(statusClientClosed)
+		return
+	}
+	origin.breaker.record(err != nil && !tooLarge(err) || err == nil && resp.StatusCode >= 500)
+	if err != nil {
+		spanError(fetch, err)
+		fetch.End()
+		if tooLarge(err) {
+			result = "TOO_LARGE"
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		kind := classifyUpstreamError(err)
+		if !bypass && cps.serveStaleOnError(w, r, key) {
+			result = "STALE"
+			cps.countUpstreamError(kind)
+			slog.Warn("origin request failed, served stale", "key", key, "kind", kind.String(), "request_id", reqID, "err", err)
+			return
+		}
+		cps.upstreamFailed(w, r, key, kind, err)
+		return
+	}
+	fetch.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	fetch.End()
+	originLatency = time.Since(originStart)
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		fresh, stored, ok := cps.revalidated(key, resp)
+		if !ok {
+			cps.upstreamFailed(w, r, key, upstreamBadGateway, errors.New("origin answered 304 for an entry no longer cached"))
+			return
+		}
+		result = "REVALIDATED"
+		cps.counters.revalidated.Add(1)
+		resp, body = fresh, stored
+	}
+	if isStreamingResponse(resp) {
+		result = "STREAM"
+		cps.streamResponse(w, resp)
+		return
+	}
+	cps.metrics.originLatency.Observe(originLatency.Seconds())
+	cps.metrics.objectSize.Observe(float64(len(body)))
+	cps.degrade.recordOrigin(resp.StatusCode >= 500)
+	if resp.StatusCode >= 500 {
+		cps.counters.upstream5xx.Add(1)
+	}
+	if route != nil {
+		cps.sampler.maybeSample(route.SampleRate, r, resp.StatusCode, resp.Header, body)
+	}
+	// A server error never replaces what we had; the last good copy is
+	// served instead when there is one.
+	if !bypass && resp.StatusCode >= 500 && cps.serveStaleOnError(w, r, key) {
+		result = "STALE"
+		return
+	}
+	body, fromHost := cps.config().BodyRewrite.rewriteBody(r, origin, resp, body)
+	// links to the Host a client sent are only for that client
+	cps.respond(ctx, w, r, route, key, result, resp, body, !bypass && !passRange && !fromHost)
+}
+
+// respond answers r with a response fetched for it, storing it under key
+// too when cacheable and the response allows.
+func (cps *Server) respond(ctx context.Context, w http.ResponseWriter, r *http.Request, route *RouteConfig, key, result string, resp *http.Response, body []byte, cacheable bool) {
+	entry := &cache.Entry{
+		StatusCode: resp.StatusCode,
+		Body:       body,
+		Headers:    resp.Header.Clone(),
+	}
+	if route != nil {
+		entry.TTL = time.Duration(route.TTL)
+	}
+	cps.hooks.onResponse(r, entry)
+	// fixtures keep every whole response as it came, until recorded again
+	record := cps.config().Record != "" && r.Method != http.MethodHead && resp.StatusCode != http.StatusPartialContent
+	if record {
+		entry.TTL = fixtureTTL
+	} else {
+		// an upstream cache already used up part of the freshness lifetime
+		entry.TTL = cps.config().jitter(entry.TTLOr(time.Duration(cps.config().CacheTTL))) - originAge(entry.Headers)
+	}
+	store := record || cacheable && r.Method != http.MethodHead && entry.TTL > 0 && cps.storable(route, entry) &&
+		!cps.degrade.active(stepNoStore) && cps.hooks.onStore(r, key, entry)
+	if store {
+		entry.StoredAt = time.Now()
+		entry.ExpiresAt = entry.StoredAt.Add(entry.TTL)
+	}
+	cps.writeCached(w, r, entry, result)
+
+	if store {
+		if entry.Headers.Get("Set-Cookie") != "" && !record {
+			stored := *entry
+			stored.Headers = entry.Headers.Clone()
+			stored.Headers.Del("Set-Cookie")
+			entry = &stored
+		}
+		_, write := tracer.Start(ctx, "cache.write")
+		cps.mu.Lock()
+		cps.Cache.Put(key, entry)
+		cps.mu.Unlock()
+		cps.tags.add(key, cache.ResponseTags(entry.Headers))
+		cps.history.record(key, entry)
+		write.End()
+	}
+}
+
+// serveAsOf answers with the version of key that was cached at the time in
+// the X-Proxy-As-Of header.
+func (cps *Server) serveAsOf(w http.ResponseWriter, r *http.Request, key, asOf string) {
+	if !ipAllowed(cps.config().History.allowNets, r.RemoteAddr) {
+		http.Error(w, "X-Proxy-As-Of is not allowed for this client", http.StatusForbidden)
+		return
+	}
+	t, err := parseAsOf(asOf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v, ok := cps.history.asOf(key, t)
+	if !ok {
+		http.Error(w, "no cached version that old", http.StatusNotFound)
+		return
+	}
+	slog.Debug("serving cached version", "key", key, "stored_at", v.storedAt)
+	w.Header().Set("X-Proxy-Version-Date", v.storedAt.UTC().Format(http.TimeFormat))
+	cps.writeCached(w, r, v.entry, "HISTORY")
+}
+
+// Handler returns the handler for proxied traffic. Unless the admin API
+// has an AdminAddr of its own, it's served under /_cache/ too.
+func (cps *Server) Handler() http.Handler {
+	if cps.config().AdminAddr != "" {
+		return cps.handlerFor([]string{serveProxy})
+	}
+	return cps.handlerFor([]string{serveProxy, serveAdmin})
+}
+
+// AdminHandler returns the /_cache/ admin API.
+func (cps *Server) AdminHandler() http.Handler {
+	return cps.adminHandler()
+}
+
+// Run serves on every listener until ctx is done or Upgrade replaced the
+// process, then stops accepting connections, lets in-flight requests finish
+// for up to the configured shutdown timeout and closes cps. A listener
+// failing shuts the others down too.
+func (cps *Server) Run(ctx context.Context) error {
+	configs := cps.config().listeners()
+	servers := make([]*http.Server, len(configs))
+	for i, l := range configs {
+		h := cps.handlerFor(l.Serve)
+		if l.H2C {
+			h = h2c.NewHandler(h, &http2.Server{IdleTimeout: time.Duration(cps.config().Timeouts.Idle)})
+		}
+		servers[i] = cps.config().Timeouts.newServer(l.Addr, h)
+	}
+
+	handoff, err := takeHandoff()
+	if err != nil {
+		cps.Close()
+		return err
+	}
+	addrs := make([]string, len(servers))
+	sockets := make([]net.Listener, len(servers))
+	listeners := make([]net.Listener, len(servers))
+	for i, srv := range servers {
+		ln, err := handoff.listen(srv.Addr)
+		if err != nil {
+			for _, ln := range listeners[:i] {
+				ln.Close()
+			}
+			cps.Close()
+			return fmt.Errorf("couldn't listen on %s. error: %v", srv.Addr, err)
+		}
+		addrs[i], sockets[i] = srv.Addr, ln
+		if configs[i].ProxyProtocol {
+			ln = proxyProtoListener{ln}
+		}
+		listeners[i] = ln
+	}
+	var admin *grpcAdmin
+	var adminLn net.Listener
+	if addr := cps.config().GRPCAddr; addr != "" {
+		adminLn, err = handoff.listen(addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			cps.Close()
+			return fmt.Errorf("couldn't listen on %s. error: %v", addr, err)
+		}
+		admin = cps.newGRPCAdmin()
+		addrs, sockets = append(addrs, addr), append(sockets, adminLn)
+	}
+	handoff.restore(cps.Cache)
+	cps.upgrader.track(addrs, sockets)
+
+	slog.Info("starting caching proxy server", "origin", cps.config().defaultOrigin().name())
+	errc := make(chan error, len(servers)+1)
+	for i, srv := range servers {
+		l := configs[i]
+		slog.Info("listening", "addr", l.Addr, "serve", l.Serve, "tls", l.CertFile != "", "h2c", l.H2C, "proxy_protocol", l.ProxyProtocol)
+		go func() {
+			var err error
+			if l.CertFile != "" {
+				err = srv.ServeTLS(listeners[i], l.CertFile, l.KeyFile)
+			} else {
+				err = srv.Serve(listeners[i])
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errc <- err
+			}
+		}()
+	}
+	if admin != nil {
+		slog.Info("listening", "addr", cps.config().GRPCAddr, "serve", "grpc admin")
+		go func() {
+			if err := admin.serve(adminLn); err != nil {
+				errc <- err
+			}
+		}()
+	}
+	handoff.serving()
+
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down", "timeout", time.Duration(cps.config().ShutdownTimeout))
+	case <-cps.upgrader.replaced:
+	case err = <-errc:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cps.config().ShutdownTimeout))
+	defer cancel()
+	for _, srv := range servers {
+		if serr := srv.Shutdown(shutdownCtx); serr != nil && err == nil {
+			err = fmt.Errorf("couldn't shut down gracefully. error: %v", serr)
+		}
+	}
+	if admin != nil {
+		admin.shutdown(shutdownCtx)
+	}
+	cps.Close()
+	return err
+}
+
+// Close stops the server's background work, waiting for it to wind down,
+// saves what the cache only keeps in memory and closes the access log.
+func (cps *Server) Close() error {
+	cps.stop()
+	cps.bg.Wait()
+	cps.flushCache()
+	return cps.access.Close()
+}
+
+type cleaner interface {
+	Cleanup()
+}
+
+type cleanerFunc func()
+
+func (f cleanerFunc) Cleanup() { f() }
+
+func scheduleCleanup(ctx context.Context, wg *sync.WaitGroup, s cleaner, every time.Duration) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.Cleanup()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
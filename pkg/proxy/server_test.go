@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a Server in front of origin, with its config
+// edited by edit first.
+func newTestServer(t *testing.T, origin string, edit func(*Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Origin = origin
+	if edit != nil {
+		edit(&cfg)
+	}
+	cps, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cps.Close() })
+	return cps
+}
+
+func (cps *Server) onlyOrigin(t *testing.T) *origin {
+	t.Helper()
+	origins := cps.live.Load().origins
+	if len(origins) != 1 {
+		t.Fatalf("got %d origins, want 1", len(origins))
+	}
+	for _, o := range origins {
+		return o
+	}
+	return nil
+}
+
+func TestClientDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		finish     bool
+		wantStatus int
+		wantCached bool
+	}{
+		{name: "cancels the fetch", finish: false, wantStatus: statusClientClosed, wantCached: false},
+		{name: "finish_on_disconnect caches", finish: true, wantStatus: http.StatusOK, wantCached: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			started := make(chan struct{})
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(200 * time.Millisecond):
+				case <-r.Context().Done():
+					return
+				}
+				w.Write([]byte("slow"))
+			}))
+			defer origin.Close()
+			cps := newTestServer(t, origin.URL, func(cfg *Config) {
+				cfg.Routes = []RouteConfig{{Path: "/slow", FinishOnDisconnect: tc.finish}}
+			})
+
+			// the request is the circuit's probe, which must be given up
+			// rather than left pending when the client goes away
+			b := cps.onlyOrigin(t).breaker
+			b.mu.Lock()
+			b.state = breakerHalfOpen
+			b.mu.Unlock()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			rec := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				cps.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx))
+			}()
+			<-started
+			cancel()
+			<-done
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if _, cached := cps.Cache.Get("GET-/slow"); cached != tc.wantCached {
+				t.Errorf("cached = %v, want %v", cached, tc.wantCached)
+			}
+			if ok, _ := b.allow(); !ok {
+				t.Error("the circuit still waits for the abandoned probe")
+			}
+		})
+	}
+}
+
+func TestBreakerCancel(t *testing.T) {
+	cfg := BreakerConfig{ErrorRate: 0.5, MinRequests: 1, CoolDown: Duration(time.Millisecond)}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	b := newBreaker(cfg)
+	b.record(true)
+	time.Sleep(2 * time.Millisecond)
+
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("no probe let through after the cool down")
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("a second request let through while probing")
+	}
+	b.cancel()
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("no probe let through after the first was cancelled")
+	}
+	b.record(false)
+	if st := b.stats(); st.State != breakerClosed {
+		t.Fatalf("got state %s after a good probe, want closed", st.State)
+	}
+}
+
+func TestCanonicalRedirect(t *testing.T) {
+	cps := newTestServer(t, "http://127.0.0.1:1", func(cfg *Config) {
+		cfg.Routes = []RouteConfig{{Path: "/a*", TrailingSlash: slashStrip, CanonicalRedirect: true}}
+	})
+	rec := httptest.NewRecorder()
+	cps.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a/?x=1", nil))
+
+	if rec.Code != http.StatusMovedPermanently {
+		t.Fatalf("got status %d, want 301", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/a?x=1" {
+		t.Errorf("got Location %q, want /a?x=1", loc)
+	}
+	if recent := cps.recent.list(); len(recent) != 1 || recent[0].Cache != "REDIRECT" {
+		t.Errorf("got recent requests %+v, want one REDIRECT", recent)
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ShadowConfig mirrors a Rate fraction of client requests to a second
+// Origin, e.g. a new backend being tried out with production traffic. The
+// mirror is sent in the background whether the cache answers the request
+// or not, and its answer is discarded. Only requests without a body are
+// mirrored, and when MaxInflight mirrors are already waiting on the
+// origin the next ones are dropped rather than queued.
+type ShadowConfig struct {
+	Origin      string  `json:"origin"`
+	Rate        float64 `json:"rate"`
+	MaxInflight int     `json:"max_inflight"`
+}
+
+// shadowHeader marks mirrored requests, so the shadow origin can tell them
+// from its own traffic.
+const shadowHeader = "X-Cache-Shadow"
+
+// shadowTimeout bounds a mirror, which no client waits on.
+const shadowTimeout = 30 * time.Second
+
+func (c *ShadowConfig) validate() error {
+	if c.Origin == "" {
+		return nil
+	}
+	if err := validateOriginURL(c.Origin); err != nil {
+		return fmt.Errorf("shadow: %v", err)
+	}
+	c.Origin = strings.TrimSuffix(c.Origin, "/")
+	if c.Rate < 0 || c.Rate > 1 {
+		return fmt.Errorf("shadow: rate must be between 0 and 1")
+	}
+	if c.MaxInflight < 0 {
+		return fmt.Errorf("shadow: max_inflight must not be negative")
+	}
+	if c.MaxInflight == 0 {
+		c.MaxInflight = 64
+	}
+	return nil
+}
+
+// shadow mirrors r, bound for path on the origin, to the shadow origin
+// if it's picked.
+func (cps *Server) shadow(r *http.Request, path string) {
+	cfg := cps.config().Shadow
+	if cfg.Origin == "" || mathrand.Float64() >= cfg.Rate || r.ContentLength != 0 || isRefresh(r) || isPeerRequest(r) {
+		return
+	}
+	if cps.shadows.Add(1) > int64(cfg.MaxInflight) {
+		cps.shadows.Add(-1)
+		cps.counters.shadowDropped.Add(1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), shadowTimeout)
+	req, err := http.NewRequestWithContext(ctx, r.Method, cfg.Origin+path, nil)
+	if err != nil {
+		cancel()
+		cps.shadows.Add(-1)
+		return
+	}
+	req.URL.RawQuery = r.URL.RawQuery
+	forwardHeaders(req.Header, r.Header)
+	req.Header.Set(shadowHeader, "1")
+	cps.config().addVia(req.Header, r.ProtoMajor, r.ProtoMinor)
+
+	cps.counters.shadowed.Add(1)
+	go func() {
+		defer cps.shadows.Add(-1)
+		defer cancel()
+		resp, err := cps.client.Do(req)
+		if err != nil {
+			slog.Debug("shadow request failed", "url", req.URL, "err", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// loadSnapshot fills store from the snapshot the last proxy to shut down
+// left at path, then removes it, so a crash later on doesn't bring back
+// entries purged since.
+func loadSnapshot(store cache.Store, path string) {
+	s, ok := store.(cache.Snapshotter)
+	if !ok || path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Warn("snapshot: couldn't open", "path", path, "err", err)
+		return
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	loaded, expired, err := s.LoadSnapshot(f)
+	if err != nil {
+		slog.Warn("snapshot: couldn't load all of it", "path", path, "loaded", loaded, "err", err)
+		return
+	}
+	slog.Info("snapshot: loaded", "path", path, "entries", loaded, "expired", expired)
+}
+
+// saveSnapshot writes the cache's snapshot to the configured path, unless
+// Upgrade handed the cache to another proxy, which saves it in turn.
+func (cps *Server) saveSnapshot() error {
+	s, ok := cps.Cache.(cache.Snapshotter)
+	path := cps.config().CacheSnapshot
+	if !ok || path == "" {
+		return nil
+	}
+	cps.upgrader.mu.Lock()
+	upgraded := cps.upgrader.done
+	cps.upgrader.mu.Unlock()
+	if upgraded {
+		return nil
+	}
+
+	// written next to path and renamed, so a crash never leaves half of one
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := s.SaveSnapshot(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("snapshot: saved", "path", path, "entries", n)
+	return nil
+}
+
+// flushCache writes back what the cache keeps in memory between writes,
+// like the disk cache's hit counts, and saves its snapshot.
+func (cps *Server) flushCache() {
+	if f, ok := cps.Cache.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			slog.Warn("couldn't write back cache hit counts", "err", err)
+		}
+	}
+	if err := cps.saveSnapshot(); err != nil {
+		slog.Warn("snapshot: couldn't save", "path", cps.config().CacheSnapshot, "err", err)
+	}
+}
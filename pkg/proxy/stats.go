@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// proxyStats counts what happened to requests since the server started.
+type proxyStats struct {
+	start          time.Time
+	hits           atomic.Int64
+	staleHits      atomic.Int64
+	misses         atomic.Int64
+	upstreamErrors [numUpstreamErrors]atomic.Int64
+	upstream5xx    atomic.Int64
+	retries        atomic.Int64
+	hedges         atomic.Int64
+	peerFetches    atomic.Int64
+	bypassed       atomic.Int64
+	rateLimited    atomic.Int64
+	refreshes      atomic.Int64
+	revalidated    atomic.Int64
+	shadowed       atomic.Int64
+	shadowDropped  atomic.Int64
+}
+
+func newProxyStats() *proxyStats {
+	return &proxyStats{start: time.Now()}
+}
+
+type statsResponse struct {
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	Hits          int64 `json:"hits"`
+	StaleHits     int64 `json:"stale_hits"`
+	Misses        int64 `json:"misses"`
+	Bypassed      int64 `json:"bypassed"`
+	RateLimited   int64 `json:"rate_limited"`
+	Refreshed     int64 `json:"refreshed"`
+	// Revalidated are the misses the origin answered with a 304, counted
+	// in Misses too.
+	Revalidated    int64   `json:"revalidated"`
+	HitRatio       float64 `json:"hit_ratio"`
+	UpstreamErrors int64   `json:"upstream_errors"`
+	// UpstreamErrorsByKind splits UpstreamErrors into bad_gateway, timeout,
+	// circuit_open, internal, overloaded and offline.
+	UpstreamErrorsByKind map[string]int64 `json:"upstream_errors_by_kind"`
+	Upstream5xx          int64            `json:"upstream_5xx"`
+	OriginRetries        int64            `json:"origin_retries"`
+	HedgedRequests       int64            `json:"hedged_requests"`
+	PeerFetches          int64            `json:"peer_fetches"`
+	// ShadowDropped are the mirrors not sent for too many in flight.
+	Shadowed      int64 `json:"shadowed_requests"`
+	ShadowDropped int64 `json:"shadow_dropped"`
+	cache.StoreStats
+
+	// Origins is keyed by origin URL.
+	Origins map[string]OriginStats `json:"origins"`
+
+	DegradationLevel int               `json:"degradation_level"`
+	DegradationSteps []DegradationStep `json:"degradation_steps"`
+
+	KeyScheme int `json:"key_scheme"`
+}
+
+func (cps *Server) stats() statsResponse {
+	st := statsResponse{
+		UptimeSeconds:        int64(time.Since(cps.counters.start).Seconds()),
+		KeyScheme:            keyScheme,
+		Hits:                 cps.counters.hits.Load(),
+		StaleHits:            cps.counters.staleHits.Load(),
+		Misses:               cps.counters.misses.Load(),
+		Bypassed:             cps.counters.bypassed.Load(),
+		RateLimited:          cps.counters.rateLimited.Load(),
+		Refreshed:            cps.counters.refreshes.Load(),
+		Revalidated:          cps.counters.revalidated.Load(),
+		UpstreamErrorsByKind: make(map[string]int64),
+		Upstream5xx:          cps.counters.upstream5xx.Load(),
+		OriginRetries:        cps.counters.retries.Load(),
+		HedgedRequests:       cps.counters.hedges.Load(),
+		PeerFetches:          cps.counters.peerFetches.Load(),
+		Shadowed:             cps.counters.shadowed.Load(),
+		ShadowDropped:        cps.counters.shadowDropped.Load(),
+		StoreStats:           cps.Cache.Stats(),
+		Origins:              make(map[string]OriginStats),
+		DegradationLevel:     cps.degrade.Level(),
+		DegradationSteps:     cps.degrade.activeSteps(),
+	}
+	for name, o := range cps.live.Load().origins {
+		st.Origins[name] = o.stats()
+	}
+	for kind := range numUpstreamErrors {
+		n := cps.counters.upstreamErrors[kind].Load()
+		st.UpstreamErrorsByKind[kind.String()] = n
+		st.UpstreamErrors += n
+	}
+	if total := st.Hits + st.StaleHits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits+st.StaleHits) / float64(total)
+	}
+	return st
+}
+
+func (cps *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cps.stats())
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// tagIndex maps cache tags to the keys carrying them. It's told of every
+// key stored with tags, and checks them against the cache when looked up
+// or swept, dropping those gone from it or stored since without the tag.
+type tagIndex struct {
+	keys map[string]map[string]struct{}
+	mu   sync.Mutex
+}
+
+// metaFunc describes a cache entry, like cache.Store's Meta.
+type metaFunc func(key string) (cache.EntryMeta, bool)
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{keys: make(map[string]map[string]struct{})}
+}
+
+func (ti *tagIndex) add(key string, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	for _, t := range tags {
+		set, ok := ti.keys[t]
+		if !ok {
+			set = make(map[string]struct{})
+			ti.keys[t] = set
+		}
+		set[key] = struct{}{}
+	}
+}
+
+// lookup returns every key that carries one of tags.
+func (ti *tagIndex) lookup(tags []string, meta metaFunc) map[string]struct{} {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	keys := make(map[string]struct{})
+	for _, t := range tags {
+		ti.prune(t, meta)
+		for k := range ti.keys[t] {
+			keys[k] = struct{}{}
+		}
+	}
+	return keys
+}
+
+// sweep drops every key that doesn't carry its tag anymore.
+func (ti *tagIndex) sweep(meta metaFunc) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	for t := range ti.keys {
+		ti.prune(t, meta)
+	}
+}
+
+// prune drops the keys of tag t that don't carry it anymore. ti.mu must be
+// held.
+func (ti *tagIndex) prune(t string, meta metaFunc) {
+	set := ti.keys[t]
+	for k := range set {
+		if m, ok := meta(k); !ok || !slices.Contains(m.Tags, t) {
+			delete(set, k)
+		}
+	}
+	if len(set) == 0 {
+		delete(ti.keys, t)
+	}
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+func TestPurgeTag(t *testing.T) {
+	cps := newTestServer(t, "http://127.0.0.1:1", nil)
+	put := func(key string, tags string) {
+		h := http.Header{}
+		if tags != "" {
+			h.Set("Cache-Tag", tags)
+		}
+		entry := &cache.Entry{StatusCode: http.StatusOK, Body: []byte(key), Headers: h}
+		cps.Cache.Put(key, entry)
+		cps.tags.add(key, cache.ResponseTags(h))
+	}
+	put("GET-/a", "product")
+	put("GET-/b", "product")
+	put("GET-/c", "product")
+
+	// soft purges leave the entries, and the tag, in place
+	for i := range 2 {
+		if n := cps.applyInvalidation(invalidation{Tags: []string{"product"}, Soft: true}); n != 3 {
+			t.Errorf("soft purge %d: purged %d entries, want 3", i+1, n)
+		}
+	}
+
+	// stored again without the tag, and deleted
+	put("GET-/b", "")
+	cps.Cache.Delete("GET-/c")
+	if n := cps.applyInvalidation(invalidation{Tags: []string{"product"}}); n != 1 {
+		t.Errorf("purged %d entries, want 1", n)
+	}
+	if _, ok := cps.Cache.GetStale("GET-/b"); !ok {
+		t.Error("purged GET-/b, which doesn't carry the tag anymore")
+	}
+
+	cps.tags.sweep(cps.Cache.Meta)
+	if len(cps.tags.keys) != 0 {
+		t.Errorf("the index still holds %v", cps.tags.keys)
+	}
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/cache"
+)
+
+// upgradeEnv passes an upgradeHandoff, as JSON, to the proxy started by
+// Upgrade.
+const upgradeEnv = "CACHING_PROXY_UPGRADE"
+
+// upgradeTimeout is how long Upgrade waits for the new proxy to serve
+// before giving up on it.
+const upgradeTimeout = time.Minute
+
+// upgradeHandoff is what a proxy hands the one replacing it: its listening
+// sockets, passed from fd 3 on in the order of Addrs, a pipe the new proxy
+// writes to once it serves, Ready, and one it reads the in-memory cache
+// from, State, as an export.
+type upgradeHandoff struct {
+	Addrs []string `json:"addrs"`
+	Ready int      `json:"ready"`
+	State int      `json:"state"`
+
+	listeners map[string]net.Listener
+}
+
+// upgrader keeps the sockets Run listens on for Upgrade.
+type upgrader struct {
+	mu      sync.Mutex
+	addrs   []string
+	sockets []net.Listener
+	// replaced is closed once a new proxy took over, for Run to shut down.
+	replaced chan struct{}
+	done     bool
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade replaces the proxy's process with a new one running the binary
+// now at the path it was started from, with the same arguments, without
+// refusing a connection: the new proxy is handed the listening sockets and
+// the in-memory cache, and once it serves Run stops accepting connections
+// and returns after the requests in flight finish. The disk cache is
+// shared through the cache dir. When the new proxy fails to start, this
+// one keeps serving and the error is returned.
+func (cps *Server) Upgrade() error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("upgrades aren't supported on windows")
+	}
+	u := &cps.upgrader
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.sockets == nil || u.done {
+		return fmt.Errorf("not serving")
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't find the binary to upgrade to. error: %v", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, ln := range u.sockets {
+		fl, ok := ln.(filer)
+		if !ok {
+			return fmt.Errorf("can't hand over the socket of %s", u.addrs[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("can't hand over the socket of %s. error: %v", u.addrs[i], err)
+		}
+		files = append(files, f)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	handoff := upgradeHandoff{Addrs: u.addrs, Ready: 3 + len(files), State: 4 + len(files)}
+	files = append(files, readyW, stateR)
+	env, _ := json.Marshal(handoff)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+string(env))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		stateW.Close()
+		return fmt.Errorf("couldn't start the new proxy. error: %v", err)
+	}
+	slog.Info("upgrade: started the new proxy", "pid", cmd.Process.Pid, "binary", path)
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	go func() {
+		defer stateW.Close()
+		if mem, ok := cps.Cache.(*cache.MemoryStore); ok {
+			if _, err := mem.Export(stateW); err != nil {
+				slog.Warn("upgrade: couldn't hand over the memory cache", "err", err)
+			}
+		}
+	}()
+	ready := make(chan bool, 1)
+	go func() {
+		var b [1]byte
+		n, _ := readyR.Read(b[:])
+		ready <- n == 1
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			err = <-exited
+			return fmt.Errorf("the new proxy exited before serving: %v", err)
+		}
+	case err := <-exited:
+		return fmt.Errorf("the new proxy exited before serving: %v", err)
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("the new proxy didn't serve within %s", upgradeTimeout)
+	}
+
+	// the socket file is the new proxy's now
+	for _, ln := range u.sockets {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	u.done = true
+	close(u.replaced)
+	slog.Info("upgrade: the new proxy is serving, shutting down", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// takeHandoff returns what the proxy that started this one handed over,
+// or nil when it wasn't started by Upgrade.
+func takeHandoff() (*upgradeHandoff, error) {
+	env, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil
+	}
+	// not for the proxies this one starts in turn
+	os.Unsetenv(upgradeEnv)
+	h := &upgradeHandoff{listeners: map[string]net.Listener{}}
+	if err := json.Unmarshal([]byte(env), h); err != nil {
+		return nil, fmt.Errorf("malformed %s: %v", upgradeEnv, err)
+	}
+	for i, addr := range h.Addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't use the socket handed over for %s. error: %v", addr, err)
+		}
+		h.listeners[addr] = ln
+	}
+	return h, nil
+}
+
+// listen returns the socket handed over for addr, or a new one.
+func (h *upgradeHandoff) listen(addr string) (net.Listener, error) {
+	if h != nil {
+		if ln, ok := h.listeners[addr]; ok {
+			delete(h.listeners, addr)
+			return ln, nil
+		}
+	}
+	return listen(addr)
+}
+
+// restore puts the in-memory cache handed over into store, and closes the
+// sockets handed over for addresses no longer listened on.
+func (h *upgradeHandoff) restore(store cache.Store) {
+	if h == nil {
+		return
+	}
+	for addr, ln := range h.listeners {
+		slog.Info("upgrade: no longer listening", "addr", addr)
+		ln.Close()
+	}
+	state := os.NewFile(uintptr(h.State), "upgrade state")
+	defer state.Close()
+	mem, ok := store.(*cache.MemoryStore)
+	if !ok {
+		io.Copy(io.Discard, state)
+		return
+	}
+	imported, expired, err := mem.Import(state)
+	if err != nil {
+		slog.Warn("upgrade: couldn't take over the whole memory cache", "imported", imported, "err", err)
+		return
+	}
+	slog.Info("upgrade: took over the memory cache", "entries", imported, "expired", expired)
+}
+
+// serving tells the proxy that started this one it can stop.
+func (h *upgradeHandoff) serving() {
+	if h == nil {
+		return
+	}
+	ready := os.NewFile(uintptr(h.Ready), "upgrade ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// track keeps the sockets Run listens on, raw, for Upgrade.
+func (u *upgrader) track(addrs []string, sockets []net.Listener) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addrs, u.sockets = slices.Clone(addrs), slices.Clone(sockets)
+}
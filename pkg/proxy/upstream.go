@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/http2"
+)
+
+// TimeoutConfig bounds how long the proxy waits on clients and on the
+// origin. Zero leaves a timeout off.
+type TimeoutConfig struct {
+	// Read covers reading a client's request, headers and body. Write runs
+	// from the end of the request headers to the end of the response, so it
+	// must leave room for OriginTotal.
+	Read  Duration `json:"read"`
+	Write Duration `json:"write"`
+	// Idle is how long a keep-alive connection waits for the next request.
+	Idle Duration `json:"idle"`
+	// Request bounds the whole of a proxied request, cache lookup, origin
+	// fetch and writing the response. The origin is given what's left of
+	// it, and a request running out gets a 504.
+	Request Duration `json:"request"`
+
+	// OriginDial covers connecting to the origin, OriginResponseHeader
+	// waiting for its response headers once the request is sent, and
+	// OriginTotal the whole exchange including reading the body.
+	OriginDial           Duration `json:"origin_dial"`
+	OriginResponseHeader Duration `json:"origin_response_header"`
+	OriginTotal          Duration `json:"origin_total"`
+}
+
+func (c *TimeoutConfig) validate() error {
+	for _, d := range []Duration{c.Read, c.Write, c.Idle, c.Request, c.OriginDial, c.OriginResponseHeader, c.OriginTotal} {
+		if d < 0 {
+			return fmt.Errorf("timeouts: must not be negative")
+		}
+	}
+	return nil
+}
+
+// newServer returns a server for addr with the client timeouts applied.
+func (c *TimeoutConfig) newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: time.Duration(c.Read),
+		ReadTimeout:       time.Duration(c.Read),
+		WriteTimeout:      time.Duration(c.Write),
+		IdleTimeout:       time.Duration(c.Idle),
+	}
+}
+
+// UpstreamConfig tunes the connection pool and TLS used to talk to the
+// origin.
+type UpstreamConfig struct {
+	// MaxIdleConnsPerHost is how many idle keep-alive connections are kept
+	// per origin host. Go's default of 2 makes busy proxies open and close a
+	// connection for nearly every request.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+	MaxIdleConns        int `json:"max_idle_conns"`
+	// MaxConnsPerHost caps connections per origin host, zero is no limit.
+	MaxConnsPerHost int      `json:"max_conns_per_host"`
+	IdleConnTimeout Duration `json:"idle_conn_timeout"`
+	// KeepAlive is the interval of TCP keep-alive probes on origin
+	// connections. DisableKeepAlives opens a new connection per request.
+	KeepAlive         Duration `json:"keep_alive"`
+	DisableKeepAlives bool     `json:"disable_keep_alives"`
+	// HTTP2 negotiates HTTP/2 with TLS origins that support it, HTTP/1.1
+	// is forced without it. H2C speaks HTTP/2 to http:// origins too,
+	// without TLS and assuming they support it; upgrades such as WebSockets
+	// still go over HTTP/1.1. H2C connections don't go through Proxy or the
+	// environment's proxy.
+	HTTP2 bool `json:"http2"`
+	H2C   bool `json:"h2c"`
+	// An HTTP/2 connection carries many requests at once, so one that died
+	// quietly fails them all. HTTP2PingInterval pings connections that have
+	// been silent that long, closing them when no answer comes in
+	// HTTP2PingTimeout, zero to not ping. HTTP2StrictMaxStreams queues
+	// requests past the origin's concurrent stream limit instead of opening
+	// another connection, MaxConnsPerHost then caps connections too.
+	HTTP2PingInterval     Duration `json:"http2_ping_interval"`
+	HTTP2PingTimeout      Duration `json:"http2_ping_timeout"`
+	HTTP2StrictMaxStreams bool     `json:"http2_strict_max_streams"`
+	// Proxy sends origin traffic through a forward proxy: an http:// or
+	// https:// one, TLS origins tunnelled with CONNECT, or a socks5:// one,
+	// with user:password@ when it needs them. NoProxy are the hosts,
+	// .domains and CIDRs reached directly, loopback ones always are.
+	// Without Proxy, the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+	// variables are used the same way.
+	Proxy   string   `json:"proxy"`
+	NoProxy []string `json:"no_proxy"`
+
+	TLS UpstreamTLSConfig `json:"tls"`
+	DNS DNSConfig         `json:"dns"`
+}
+
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string `json:"ca_file"`
+	// ServerName overrides the name the origin's certificate is checked
+	// against.
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// MinVersion is "1.2" or "1.3".
+	MinVersion string `json:"min_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *UpstreamConfig) validate() error {
+	if c.MaxIdleConnsPerHost < 0 || c.MaxIdleConns < 0 || c.MaxConnsPerHost < 0 {
+		return fmt.Errorf("upstream: connection limits must not be negative")
+	}
+	if c.IdleConnTimeout < 0 || c.KeepAlive < 0 {
+		return fmt.Errorf("upstream: idle_conn_timeout and keep_alive must not be negative")
+	}
+	if c.HTTP2PingInterval < 0 || c.HTTP2PingTimeout < 0 {
+		return fmt.Errorf("upstream: http2_ping_interval and http2_ping_timeout must not be negative")
+	}
+	if c.H2C && !c.HTTP2 {
+		return fmt.Errorf("upstream: h2c needs http2")
+	}
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("upstream: invalid proxy URL %q", c.Proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("upstream: proxy must be an http://, https:// or socks5:// URL")
+		}
+		if c.H2C {
+			return fmt.Errorf("upstream: h2c connections can't go through a proxy")
+		}
+	}
+	if _, ok := tlsVersions[c.TLS.MinVersion]; c.TLS.MinVersion != "" && !ok {
+		return fmt.Errorf("upstream: tls min_version must be 1.2 or 1.3")
+	}
+	return c.DNS.validate()
+}
+
+func (c *UpstreamTLSConfig) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if v, ok := tlsVersions[c.MinVersion]; ok {
+		cfg.MinVersion = v
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read upstream CA file. error: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA file %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// newUpstreamClient returns the client used to talk to the origin, with a
+// transport of its own rather than http.DefaultTransport's, looking origin
+// hosts up with res.
+func newUpstreamClient(cfg UpstreamConfig, timeouts TimeoutConfig, res *resolver) (*http.Client, error) {
+	tlsConfig, err := cfg.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(timeouts.OriginDial),
+		KeepAlive: time.Duration(cfg.KeepAlive),
+	}
+	dial := res.dialContext(dialer)
+	transport := &http.Transport{
+		Proxy:                 cfg.proxyFunc(),
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Duration(timeouts.OriginResponseHeader),
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout),
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+	}
+	var rt http.RoundTripper = transport
+	if !cfg.HTTP2 {
+		// a non-nil empty map is how net/http is told not to upgrade
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't configure HTTP/2 to the origin. error: %v", err)
+		}
+		cfg.configureHTTP2(h2)
+		if cfg.H2C {
+			h2c := &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dial(ctx, network, addr)
+				},
+			}
+			cfg.configureHTTP2(h2c)
+			rt = h2cTransport{Transport: transport, h2c: h2c}
+		}
+	}
+	return &http.Client{
+		Transport: rt,
+		Timeout:   time.Duration(timeouts.OriginTotal),
+	}, nil
+}
+
+// proxyFunc picks the forward proxy for a request to the origin, nil for
+// going directly.
+func (c *UpstreamConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if c.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL := (&httpproxy.Config{
+		HTTPProxy:  c.Proxy,
+		HTTPSProxy: c.Proxy,
+		NoProxy:    strings.Join(c.NoProxy, ","),
+	}).ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxyURL(r.URL)
+	}
+}
+
+func (c *UpstreamConfig) configureHTTP2(t *http2.Transport) {
+	t.ReadIdleTimeout = time.Duration(c.HTTP2PingInterval)
+	t.PingTimeout = time.Duration(c.HTTP2PingTimeout)
+	t.StrictMaxConcurrentStreams = c.HTTP2StrictMaxStreams
+}
+
+// h2cTransport sends requests to http:// origins over HTTP/2 without TLS,
+// the others, and upgrades which HTTP/2 can't carry, through Transport.
+type h2cTransport struct {
+	*http.Transport
+	h2c *http2.Transport
+}
+
+func (t h2cTransport) CloseIdleConnections() {
+	t.Transport.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+func (t h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && !httpguts.HeaderValuesContainsToken(req.Header["Connection"], "Upgrade") {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.Transport.RoundTrip(req)
+}
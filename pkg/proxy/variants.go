@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// variant is one dimension a route's cache entries vary on. The normalized
+// value goes into the cache key and is sent to the origin in headers, so the
+// stored response matches the key.
+type variant struct {
+	name    string
+	value   string
+	headers []string
+}
+
+// variants returns what a request to the route varies on, in a fixed order.
+func (rc *RouteConfig) variants(r *http.Request) []variant {
+	if rc == nil {
+		return nil
+	}
+	var vars []variant
+	if rc.Languages != nil {
+		vars = append(vars, variant{
+			name:    "lang",
+			value:   rc.Languages.negotiate(r.Header.Get("Accept-Language")),
+			headers: []string{"Accept-Language"},
+		})
+	}
+	if ch := rc.ClientHints; ch != nil {
+		if ch.Mobile {
+			vars = append(vars, variant{
+				name:    "mobile",
+				value:   normalizeMobile(r.Header.Get("Sec-CH-UA-Mobile")),
+				headers: []string{"Sec-CH-UA-Mobile"},
+			})
+		}
+		if len(ch.DPRBuckets) > 0 {
+			dpr := r.Header.Get("Sec-CH-DPR")
+			if dpr == "" {
+				dpr = r.Header.Get("DPR")
+			}
+			vars = append(vars, variant{
+				name:    "dpr",
+				value:   ch.dprBucket(dpr),
+				headers: []string{"Sec-CH-DPR", "DPR"},
+			})
+		}
+	}
+	return vars
+}
+
+// setVariantHeaders tells clients and downstream caches what the response
+// varies on, and asks browsers to send the client hints it depends on.
+func setVariantHeaders(h http.Header, vars []variant) {
+	var hints []string
+	for _, v := range vars {
+		addVary(h, v.headers...)
+		for _, name := range v.headers {
+			if strings.HasPrefix(name, "Sec-CH-") {
+				hints = append(hints, name)
+			}
+		}
+	}
+	if len(hints) > 0 {
+		h.Set("Accept-CH", strings.Join(hints, ", "))
+	}
+}
+
+// addVary adds names to the Vary header, skipping ones already listed.
+func addVary(h http.Header, names ...string) {
+	have := make(map[string]bool)
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			have[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	for _, v := range names {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || have[strings.ToLower(name)] {
+				continue
+			}
+			have[strings.ToLower(name)] = true
+			h.Add("Vary", name)
+		}
+	}
+}
+
+// LanguageConfig bounds the Accept-Language variants kept for a route: every
+// request is mapped to one of Supported, falling back to Default.
+type LanguageConfig struct {
+	Supported []string `json:"supported"`
+	Default   string   `json:"default"`
+}
+
+func (lc *LanguageConfig) validate() error {
+	if len(lc.Supported) == 0 {
+		return fmt.Errorf("languages: supported must list at least one locale")
+	}
+	if lc.Default == "" {
+		lc.Default = lc.Supported[0]
+	}
+	for _, l := range lc.Supported {
+		if strings.EqualFold(l, lc.Default) {
+			return nil
+		}
+	}
+	return fmt.Errorf("languages: default %q is not in supported", lc.Default)
+}
+
+type weightedLang struct {
+	tag string
+	q   float64
+}
+
+func parseAcceptLanguage(header string) []weightedLang {
+	var langs []weightedLang
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			langs = append(langs, weightedLang{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	return langs
+}
+
+// negotiate picks the supported locale best matching an Accept-Language
+// header. "en-GB" matches a supported "en", and "en" matches "en-US".
+func (lc *LanguageConfig) negotiate(header string) string {
+	for _, want := range parseAcceptLanguage(header) {
+		for _, have := range lc.Supported {
+			if strings.EqualFold(want.tag, have) {
+				return have
+			}
+		}
+		primary, _, _ := strings.Cut(want.tag, "-")
+		for _, have := range lc.Supported {
+			havePrimary, _, _ := strings.Cut(have, "-")
+			if strings.EqualFold(primary, havePrimary) {
+				return have
+			}
+		}
+	}
+	return lc.Default
+}
+
+// ClientHintsConfig makes a route vary on device capabilities. DPR values
+// are rounded up to the nearest bucket, so cardinality stays at
+// len(DPRBuckets) no matter what clients send.
+type ClientHintsConfig struct {
+	Mobile     bool      `json:"mobile"`
+	DPRBuckets []float64 `json:"dpr_buckets"`
+}
+
+func (ch *ClientHintsConfig) validate() error {
+	if !ch.Mobile && len(ch.DPRBuckets) == 0 {
+		return fmt.Errorf("client_hints: enable mobile or give dpr_buckets")
+	}
+	for _, b := range ch.DPRBuckets {
+		if b <= 0 {
+			return fmt.Errorf("client_hints: dpr_buckets must be positive")
+		}
+	}
+	sort.Float64s(ch.DPRBuckets)
+	return nil
+}
+
+// normalizeMobile maps Sec-CH-UA-Mobile to its two structured header values.
+func normalizeMobile(v string) string {
+	if strings.TrimSpace(v) == "?1" {
+		return "?1"
+	}
+	return "?0"
+}
+
+// dprBucket returns the smallest bucket at least as large as dpr, the largest
+// bucket for anything above, and the smallest when dpr is missing or bogus.
+func (ch *ClientHintsConfig) dprBucket(dpr string) string {
+	v, err := strconv.ParseFloat(strings.TrimSpace(dpr), 64)
+	bucket := ch.DPRBuckets[0]
+	if err == nil && v > 0 {
+		bucket = ch.DPRBuckets[len(ch.DPRBuckets)-1]
+		for _, b := range ch.DPRBuckets {
+			if v <= b {
+				bucket = b
+				break
+			}
+		}
+	}
+	return strconv.FormatFloat(bucket, 'f', -1, 64)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostConfig is a site served by the proxy, picked by the request's Host
+// header. Each site gets its own cache namespace, so the same path on two
+// sites never shares an entry.
+type HostConfig struct {
+	// Names are the host names the site answers to, e.g. "example.com" or
+	// "*.example.com" for any subdomain. The first one names the cache
+	// namespace, so aliases share entries.
+	Names []string `json:"names"`
+	// Origin, or Origins balanced as Balance says, serve the site.
+	Origin  string   `json:"origin"`
+	Origins []string `json:"origins"`
+	Balance string   `json:"balance"`
+	// Routes apply to the site's requests instead of the top-level routes.
+	Routes []RouteConfig `json:"routes"`
+}
+
+func (c *Config) validateHost(h *HostConfig, i int) error {
+	if len(h.Names) == 0 {
+		return fmt.Errorf("host %d: names is required", i)
+	}
+	for j, name := range h.Names {
+		name = strings.ToLower(name)
+		if name == "" || strings.ContainsAny(name, ":/ ") {
+			return fmt.Errorf("host %d: invalid name %q", i, name)
+		}
+		h.Names[j] = name
+	}
+	if h.Origin == "" && len(h.Origins) == 0 {
+		return fmt.Errorf("host %s: origin or origins is required", h.Names[0])
+	}
+	if h.Origin != "" {
+		if err := validateOriginURL(h.Origin); err != nil {
+			return fmt.Errorf("host %s: %v", h.Names[0], err)
+		}
+	}
+	if err := validateOrigins(h.Origin, h.Origins, &h.Balance); err != nil {
+		return fmt.Errorf("host %s: %v", h.Names[0], err)
+	}
+	for j := range h.Routes {
+		if err := c.validateRoute(&h.Routes[j], j); err != nil {
+			return fmt.Errorf("host %s: %v", h.Names[0], err)
+		}
+	}
+	return nil
+}
+
+func (h *HostConfig) matches(host string) bool {
+	for _, name := range h.Names {
+		if suffix, ok := strings.CutPrefix(name, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == name {
+			return true
+		}
+	}
+	return false
+}
+
+// namespace is the cache namespace of the site's keys.
+func (h *HostConfig) namespace() string {
+	return h.Names[0]
+}
+
+// host returns the site the Host header hostPort belongs to, or nil for
+// requests served by the top-level config.
+func (c *Config) host(hostPort string) *HostConfig {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := range c.Hosts {
+		if c.Hosts[i].matches(host) {
+			return &c.Hosts[i]
+		}
+	}
+	return nil
+}
+
+// hostRoute returns the route matching path on site h, which is nil for the
+// top-level config.
+func (c *Config) hostRoute(h *HostConfig, path string) *RouteConfig {
+	if h == nil {
+		return c.route(path)
+	}
+	return matchRoute(h.Routes, path)
+}
+
+// namespaceMatcher matches keys in the cache namespace of site h, those of
+// the top-level config when h is nil.
+func namespaceMatcher(h *HostConfig) func(key string) bool {
+	ns := ""
+	if h != nil {
+		ns = h.namespace()
+	}
+	return func(key string) bool {
+		keyNS, _ := keyVariant(key, hostVariant)
+		return keyNS == ns
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Every message the proxy forwards gets a Via entry naming it, requests to
+// the origin and responses to clients alike (RFC 9110, section 7.6.3). A
+// request already carrying its entry came back around: a forwarding loop.
+
+const defaultViaName = "caching-proxy"
+
+func validateViaName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t,()") {
+		return fmt.Errorf("via_name must be a single token, like %q", defaultViaName)
+	}
+	return nil
+}
+
+// viaProtocol is the Via received-protocol for HTTP major.minor.
+func viaProtocol(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major)
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
+
+// addVia appends the proxy's entry for a message received over HTTP
+// major.minor to the Via of h.
+func (c *Config) addVia(h http.Header, major, minor int) {
+	entry := viaProtocol(major, minor) + " " + c.ViaName
+	if prev := h.Values("Via"); len(prev) > 0 {
+		entry = strings.Join(prev, ", ") + ", " + entry
+	}
+	h.Set("Via", entry)
+}
+
+// isLoop tells whether r already went through this proxy.
+func (c *Config) isLoop(r *http.Request) bool {
+	for _, v := range r.Header.Values("Via") {
+		for _, hop := range strings.Split(v, ",") {
+			if fields := strings.Fields(hop); len(fields) >= 2 && fields[1] == c.ViaName {
+				return true
+			}
+		}
+	}
+	return false
+}
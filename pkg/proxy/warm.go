@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const (
+	defaultWarmConcurrency = 8
+	// MaxWarmConcurrency caps the URLs warmed at once.
+	MaxWarmConcurrency = 64
+)
+
+type warmRequest struct {
+	URLs        []string `json:"urls"`
+	Concurrency int      `json:"concurrency"`
+}
+
+// WarmResult is how fetching one URL went when warming the cache.
+type WarmResult struct {
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Cache  string `json:"cache,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// discardRecorder is a ResponseWriter that only keeps the status and
+// headers, for running requests through the proxy without a client.
+type discardRecorder struct {
+	header http.Header
+	status int
+}
+
+func (d *discardRecorder) Header() http.Header { return d.header }
+
+func (d *discardRecorder) WriteHeader(code int) {
+	if d.status == 0 {
+		d.status = code
+	}
+}
+
+func (d *discardRecorder) Write(b []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// handleWarm fetches a batch of URLs through the proxy so they end up cached,
+// e.g. right after a deploy:
+//
+//	POST /_cache/warm {"urls": ["/products", "/products/1"], "concurrency": 8}
+//
+// The URLs go through the same handler as client traffic, so route policies
+// apply to them too. An absolute URL, like "https://shop.example/products",
+// warms the virtual host it names.
+func (cps *Server) handleWarm(w http.ResponseWriter, r *http.Request) {
+	var req warmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(req.URLs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "urls is required")
+		return
+	}
+	if req.Concurrency <= 0 {
+		req.Concurrency = defaultWarmConcurrency
+	}
+	req.Concurrency = min(req.Concurrency, MaxWarmConcurrency)
+
+	results := make([]WarmResult, len(req.URLs))
+	sem := make(chan struct{}, req.Concurrency)
+	var wg sync.WaitGroup
+	for i, raw := range req.URLs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = cps.warmOne(r, raw)
+		}()
+	}
+	wg.Wait()
+
+	slog.Info("warm", "urls", len(req.URLs), "concurrency", req.Concurrency)
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+// warmKey marks the requests warming makes.
+type warmKey struct{}
+
+// isInternal tells whether r is one the proxy made itself, to refresh or
+// warm entries. They don't count against the allowed clients or the rate
+// limits.
+func isInternal(r *http.Request) bool {
+	return isRefresh(r) || r.Context().Value(warmKey{}) != nil
+}
+
+func (cps *Server) warmOne(parent *http.Request, raw string) WarmResult {
+	res := WarmResult{URL: raw}
+	u, err := url.Parse(raw)
+	if err != nil || u.Path == "" {
+		res.Error = "invalid url"
+		return res
+	}
+
+	// the proxy knows its origin, the host only picks the virtual host
+	target := &url.URL{Path: u.Path, RawQuery: u.RawQuery}
+	req, err := http.NewRequestWithContext(context.WithValue(parent.Context(), warmKey{}, true), http.MethodGet, target.String(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if u.Host != "" {
+		req.Host = u.Host
+	}
+
+	rec := &discardRecorder{header: make(http.Header)}
+	cps.handleRequests(rec, req)
+	res.Status = rec.status
+	if name := cps.config().CacheStatus.Header; name != "" {
+		res.Cache = rec.header.Get(name)
+	}
+	return res
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Requests the proxy makes itself have no client address, and mustn't be
+// turned away by allow_clients or the rate limits.
+func TestInternalRequestsAllowed(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+	cps := newTestServer(t, origin.URL, func(cfg *Config) {
+		cfg.AllowClients = []string{"10.0.0.0/8"}
+		cfg.RateLimit = RateLimitConfig{Rate: 0.001, Burst: 1}
+	})
+
+	rec := httptest.NewRecorder()
+	cps.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d for a client outside allow_clients, want 403", rec.Code)
+	}
+
+	parent := httptest.NewRequest(http.MethodPost, "/_cache/warm", nil)
+	for _, u := range []string{"/a", "/b"} {
+		if res := cps.warmOne(parent, u); res.Status != http.StatusOK {
+			t.Errorf("warming %s: got status %d (%s), want 200", u, res.Status, res.Error)
+		}
+	}
+	cps.refresh(context.Background(), "GET-/a")
+	cps.refresh(context.Background(), "GET-/a")
+	if n := hits.Load(); n != 4 {
+		t.Errorf("the origin got %d requests, want 4", n)
+	}
+}
+
+func TestWarmVirtualHost(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+	cps := newTestServer(t, origin.URL, func(cfg *Config) {
+		cfg.Hosts = []HostConfig{{Names: []string{"shop.example"}, Origin: origin.URL}}
+	})
+
+	parent := httptest.NewRequest(http.MethodPost, "/_cache/warm", nil)
+	if res := cps.warmOne(parent, "https://shop.example/products?page=2"); res.Status != http.StatusOK {
+		t.Fatalf("got status %d (%s), want 200", res.Status, res.Error)
+	}
+	key := withVariant("GET-/products?page=2", hostVariant, "shop.example")
+	if _, ok := cps.Cache.Get(key); !ok {
+		t.Errorf("%s isn't cached, got %v", key, cps.Cache.Entries())
+	}
+	if _, ok := cps.Cache.Get("GET-/products?page=2"); ok {
+		t.Error("warmed the default site instead")
+	}
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	eventOriginDown     = "origin_down"
+	eventCircuitOpen    = "circuit_open"
+	eventCacheFull      = "cache_full"
+	eventPurgeCompleted = "purge_completed"
+)
+
+var webhookEvents = []string{eventOriginDown, eventCircuitOpen, eventCacheFull, eventPurgeCompleted}
+
+const (
+	webhookQueueSize    = 64
+	webhookTimeout      = 10 * time.Second
+	webhookMinBackoff   = time.Second
+	webhookMaxBackoff   = 30 * time.Second
+	webhookDrainTimeout = 10 * time.Second
+	signatureHeader     = "X-Webhook-Signature"
+)
+
+// WebhooksConfig posts events to URLs as they happen, so operators get
+// alerted without scraping logs:
+//
+//   - origin_down: a backend failed enough checks or requests to be ejected
+//   - circuit_open: an origin's circuit breaker opened
+//   - cache_full: the cache dir's disk has fewer free bytes than the
+//     degradation min_free_disk_bytes
+//   - purge_completed: a purge asked of this proxy is done
+//
+// Each is a JSON object like {"event": "origin_down", "time": "...",
+// "host": "proxy-1", "data": {"origin": "...", "backend": "..."}}.
+type WebhooksConfig struct {
+	URLs []string `json:"urls"`
+	// Events are the events posted, all of them when empty.
+	Events []string `json:"events"`
+	// Secret signs each body with HMAC-SHA256, sent hex encoded as
+	// "X-Webhook-Signature: sha256=<hex>".
+	Secret string `json:"secret"`
+	// Retries is how many times a post that failed, or was answered with a
+	// 429 or 5xx, is tried again, with backoff.
+	Retries int `json:"retries"`
+}
+
+func (c *WebhooksConfig) validate() error {
+	for _, s := range c.URLs {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks: invalid URL %q", s)
+		}
+	}
+	for _, e := range c.Events {
+		if !slices.Contains(webhookEvents, e) {
+			return fmt.Errorf("webhooks: unknown event %q", e)
+		}
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("webhooks: retries must not be negative")
+	}
+	return nil
+}
+
+type webhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Host is the proxy's hostname.
+	Host string         `json:"host"`
+	Data map[string]any `json:"data"`
+}
+
+// webhooks posts events in the background, each URL from a queue of its
+// own so a slow one doesn't hold up the others. A nil webhooks, without
+// URLs configured, drops them.
+type webhooks struct {
+	cfg     WebhooksConfig
+	host    string
+	client  *http.Client
+	targets []*webhookTarget
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan []byte
+}
+
+func newWebhooks(cfg WebhooksConfig) *webhooks {
+	if len(cfg.URLs) == 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	wh := &webhooks{cfg: cfg, host: host, client: &http.Client{Timeout: webhookTimeout}}
+	for _, u := range cfg.URLs {
+		wh.targets = append(wh.targets, &webhookTarget{url: u, queue: make(chan []byte, webhookQueueSize)})
+	}
+	return wh
+}
+
+// wants tells whether event is posted.
+func (wh *webhooks) wants(event string) bool {
+	return wh != nil && (len(wh.cfg.Events) == 0 || slices.Contains(wh.cfg.Events, event))
+}
+
+// send queues event for every URL. It never blocks: when a URL's queue is
+// full the event is dropped for it.
+func (wh *webhooks) send(event string, data map[string]any) {
+	if !wh.wants(event) {
+		return
+	}
+	body, err := json.Marshal(webhookEvent{Event: event, Time: time.Now().UTC(), Host: wh.host, Data: data})
+	if err != nil {
+		slog.Error("webhooks: couldn't encode event", "event", event, "err", err)
+		return
+	}
+	for _, t := range wh.targets {
+		select {
+		case t.queue <- body:
+		default:
+			slog.Warn("webhooks: queue full, dropping event", "event", event, "url", t.url)
+		}
+	}
+}
+
+// run posts queued events until ctx is done, then gives what's left in the
+// queues up to webhookDrainTimeout to be posted.
+func (wh *webhooks) run(ctx context.Context, wg *sync.WaitGroup) {
+	if wh == nil {
+		return
+	}
+	for _, t := range wh.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case body := <-t.queue:
+					wh.post(ctx, t.url, body)
+				case <-ctx.Done():
+					wh.drain(t)
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (wh *webhooks) drain(t *webhookTarget) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookDrainTimeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		select {
+		case body := <-t.queue:
+			wh.post(ctx, t.url, body)
+		default:
+			return
+		}
+	}
+}
+
+// post sends body to u, retrying with backoff until it's accepted, the
+// retries run out or ctx is done.
+func (wh *webhooks) post(ctx context.Context, u string, body []byte) {
+	backoff := webhookMinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := wh.postOnce(ctx, u, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= wh.cfg.Retries {
+			slog.Error("webhooks: couldn't post event", "url", u, "attempts", attempt+1, "err", err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			slog.Error("webhooks: couldn't post event", "url", u, "attempts", attempt+1, "err", err)
+			return
+		}
+		backoff = min(2*backoff, webhookMaxBackoff)
+	}
+}
+
+// postOnce sends body to u once, telling whether a failure is worth
+// retrying.
+func (wh *webhooks) postOnce(ctx context.Context, u string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("answered %s", resp.Status)
+	}
+}
+
+// watchDisk sends cache_full when dir's free bytes drop under minFree,
+// checking every interval, and again only once they've been back above.
+func (wh *webhooks) watchDisk(ctx context.Context, wg *sync.WaitGroup, dir string, minFree uint64, interval time.Duration) {
+	if !wh.wants(eventCacheFull) || dir == "" || minFree == 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		full := false
+		for {
+			select {
+			case <-ticker.C:
+				free, err := diskFree(dir)
+				if err != nil {
+					continue
+				}
+				if free < minFree && !full {
+					wh.send(eventCacheFull, map[string]any{"cache_dir": dir, "free_bytes": free, "min_free_bytes": minFree})
+				}
+				full = free < minFree
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// purged sends purge_completed for inv, which purged n entries here.
+func (wh *webhooks) purged(inv invalidation, n int) {
+	if !wh.wants(eventPurgeCompleted) {
+		return
+	}
+	data := map[string]any{"purged": n, "soft": inv.Soft}
+	for k, v := range map[string]string{"key": inv.Key, "prefix": inv.Prefix, "path": inv.Path, "host": inv.Host, "regex": inv.Regex} {
+		if v != "" {
+			data[k] = v
+		}
+	}
+	if len(inv.Tags) > 0 {
+		data["tags"] = inv.Tags
+	}
+	wh.send(eventPurgeCompleted, data)
+}
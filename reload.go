@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/proxy"
+)
+
+// configWatchInterval is how often -watch-config checks the config file.
+const configWatchInterval = 2 * time.Second
+
+// bindMainFlags binds the flags the command has on top of the proxy's.
+func bindMainFlags(fs *flag.FlagSet, cfg *proxy.Config, watch *bool) {
+	fs.BoolVar(&cfg.SkipChecks, "skip-checks", false, "don't run the doctor checks on startup")
+	fs.BoolVar(watch, "watch-config", false, "reload the -config file whenever it changes, not only on SIGHUP")
+}
+
+// reloadConfig reloads server with the config args give on SIGHUP, and
+// with watch whenever the -config file changes, until ctx is done. A
+// config that doesn't load keeps the current one.
+func reloadConfig(ctx context.Context, server *proxy.Server, args []string, file string, watch bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	var last os.FileInfo
+	if watch && file != "" {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		last, _ = os.Stat(file)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("SIGHUP, reloading config")
+		case <-tick:
+			info, err := os.Stat(file)
+			if err != nil || last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			slog.Info("config file changed, reloading", "file", file)
+		}
+
+		cfg, err := loadConfig(args)
+		if err == nil {
+			err = server.Reload(cfg)
+		}
+		if err != nil {
+			slog.Error("config reload failed, keeping the current config", "err", err)
+		}
+	}
+}
+
+// loadConfig parses the config args give again, for a reload.
+func loadConfig(args []string) (proxy.Config, error) {
+	var cfg proxy.Config
+	fs := flag.NewFlagSet("caching-proxy", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	bindMainFlags(fs, &cfg, new(bool))
+	err := proxy.ParseConfig(fs, &cfg, args)
+	return cfg, err
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+
+	"github.com/assaidy/caching-proxy/pkg/proxy"
+)
+
+// upgradeOnSignal does nothing, there's no SIGUSR2 to upgrade on.
+func upgradeOnSignal(ctx context.Context, server *proxy.Server) {}
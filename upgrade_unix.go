@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/assaidy/caching-proxy/pkg/proxy"
+)
+
+// upgradeOnSignal replaces server with the binary installed in its place
+// on SIGUSR2, until ctx is done. A failed upgrade keeps server running.
+func upgradeOnSignal(ctx context.Context, server *proxy.Server) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr2:
+		}
+		slog.Info("SIGUSR2, upgrading")
+		if err := server.Upgrade(); err != nil {
+			slog.Error("upgrade failed, keeping this proxy", "err", err)
+		}
+	}
+}
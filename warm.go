@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assaidy/caching-proxy/pkg/proxy"
+)
+
+// runWarm is the warm subcommand. It requests every URL from a list or a
+// sitemap through a running proxy, so a fresh deployment starts hot:
+//
+//	caching-proxy warm -proxy http://localhost:8080 -urls urls.txt
+//	caching-proxy warm -sitemap https://example.com/sitemap.xml
+//
+// Absolute URLs keep their host in the Host header, for virtual hosts.
+func runWarm(args []string) int {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	proxyAddr := fs.String("proxy", "http://localhost:8080", "address of the proxy to warm")
+	urlsFile := fs.String("urls", "", "file with one URL or path per line, - for stdin")
+	sitemap := fs.String("sitemap", "", "sitemap.xml, or sitemap index, to take the URLs from")
+	concurrency := fs.Int("concurrency", 8, "requests sent at once")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long each request may take")
+	statusHeader := fs.String("cache-status-header", "X-Cache", "header the proxy reports cache results in")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: *timeout}
+	var urls []string
+	var err error
+	switch {
+	case *urlsFile != "":
+		urls, err = readURLList(*urlsFile)
+	case *sitemap != "":
+		urls, err = readSitemap(client, *sitemap, 0)
+	default:
+		err = fmt.Errorf("one of -urls or -sitemap is required")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	base, err := url.Parse(*proxyAddr)
+	if err != nil || base.Host == "" {
+		fmt.Fprintf(os.Stderr, "invalid -proxy %q\n", *proxyAddr)
+		return 1
+	}
+
+	results := make([]proxy.WarmResult, len(urls))
+	sem := make(chan struct{}, min(max(*concurrency, 1), proxy.MaxWarmConcurrency))
+	var wg sync.WaitGroup
+	for i, raw := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = warmThrough(client, base, raw, *statusHeader)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			failed++
+			fmt.Printf("[FAIL] %s: %s\n", res.URL, res.Error)
+		case res.Status >= 500:
+			failed++
+			fmt.Printf("[%d] %s %s\n", res.Status, res.Cache, res.URL)
+		default:
+			fmt.Printf("[%d] %s %s\n", res.Status, res.Cache, res.URL)
+		}
+	}
+	fmt.Printf("warmed %d of %d URLs\n", len(urls)-failed, len(urls))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// warmThrough GETs raw from the proxy at base, and drains the body so the
+// proxy finishes storing it. The cache result is read from statusHeader.
+func warmThrough(client *http.Client, base *url.URL, raw, statusHeader string) proxy.WarmResult {
+	res := proxy.WarmResult{URL: raw}
+	u, err := url.Parse(raw)
+	if err != nil || u.Path == "" && u.Host == "" {
+		res.Error = "invalid url"
+		return res
+	}
+	target := *base
+	target.Path = u.Path
+	target.RawQuery = u.RawQuery
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if u.Host != "" {
+		req.Host = u.Host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	res.Status = resp.StatusCode
+	res.Cache = resp.Header.Get(statusHeader)
+	return res
+}
+
+// readURLList reads one URL per line, skipping blank lines and # comments.
+func readURLList(name string) ([]string, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, fmt.Errorf("couldn't open url list. error: %v", err)
+		}
+		defer f.Close()
+	}
+	var urls []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read url list. error: %v", err)
+	}
+	return urls, nil
+}
+
+// sitemap is either a urlset or a sitemapindex pointing at more sitemaps.
+type sitemap struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+const maxSitemapDepth = 3
+
+func readSitemap(client *http.Client, loc string, depth int) ([]string, error) {
+	resp, err := client.Get(loc)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch sitemap %s. error: %v", loc, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't fetch sitemap %s. status: %s", loc, resp.Status)
+	}
+	var sm sitemap
+	if err := xml.NewDecoder(resp.Body).Decode(&sm); err != nil {
+		return nil, fmt.Errorf("couldn't parse sitemap %s. error: %v", loc, err)
+	}
+
+	var urls []string
+	for _, u := range sm.URLs {
+		urls = append(urls, strings.TrimSpace(u.Loc))
+	}
+	if depth < maxSitemapDepth {
+		for _, s := range sm.Sitemaps {
+			more, err := readSitemap(client, strings.TrimSpace(s.Loc), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, more...)
+		}
+	}
+	return urls, nil
+}